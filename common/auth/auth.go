@@ -1,12 +1,21 @@
 package auth
 
-import "github.com/sagernet/sing/common"
+import (
+	"context"
+
+	"github.com/sagernet/sing/common"
+)
 
 type User struct {
 	Username string
 	Password string
 }
 
+var (
+	_ Verifier       = (*Authenticator)(nil)
+	_ PasswordLookup = (*Authenticator)(nil)
+)
+
 type Authenticator struct {
 	userMap map[string][]string
 }
@@ -25,6 +34,23 @@ func NewAuthenticator(users []User) *Authenticator {
 }
 
 func (au *Authenticator) Verify(username string, password string) bool {
+	if au == nil {
+		return false
+	}
 	passwordList, ok := au.userMap[username]
 	return ok && common.Contains(passwordList, password)
 }
+
+func (au *Authenticator) VerifyContext(ctx context.Context, username string, password string) (context.Context, error) {
+	if !au.Verify(username, password) {
+		return nil, ErrInvalidCredentials
+	}
+	return ContextWithUser(ctx, username), nil
+}
+
+func (au *Authenticator) Passwords(username string) []string {
+	if au == nil {
+		return nil
+	}
+	return au.userMap[username]
+}
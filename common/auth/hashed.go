@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+type HashedUser struct {
+	Username     string
+	PasswordHash string
+}
+
+// CompareFunc matches the signature of bcrypt.CompareHashAndPassword,
+// so hashes from golang.org/x/crypto (bcrypt, argon2 wrappers) can be plugged in directly.
+type CompareFunc func(hashedPassword []byte, password []byte) error
+
+var _ Verifier = (*HashedAuthenticator)(nil)
+
+type HashedAuthenticator struct {
+	userMap map[string][]string
+	compare CompareFunc
+	// dummyHash is compared for unknown users, so that they take as long as known ones.
+	dummyHash string
+}
+
+func NewHashedAuthenticator(users []HashedUser, compare CompareFunc) *HashedAuthenticator {
+	if compare == nil {
+		compare = ComparePBKDF2
+	}
+	au := &HashedAuthenticator{
+		userMap: make(map[string][]string),
+		compare: compare,
+	}
+	for _, user := range users {
+		au.userMap[user.Username] = append(au.userMap[user.Username], user.PasswordHash)
+	}
+	if len(users) > 0 {
+		au.dummyHash = users[0].PasswordHash
+	}
+	return au
+}
+
+func (au *HashedAuthenticator) VerifyContext(ctx context.Context, username string, password string) (context.Context, error) {
+	passwordHashes, loaded := au.userMap[username]
+	if !loaded {
+		if au.dummyHash != "" {
+			au.compare([]byte(au.dummyHash), []byte(password))
+		}
+		return nil, ErrInvalidCredentials
+	}
+	for _, passwordHash := range passwordHashes {
+		if au.compare([]byte(passwordHash), []byte(password)) == nil {
+			return ContextWithUser(ctx, username), nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+const (
+	pbkdf2Prefix     = "$pbkdf2-sha256$"
+	pbkdf2Iterations = 600000
+	pbkdf2SaltLen    = 16
+	pbkdf2KeyLen     = 32
+)
+
+// GeneratePBKDF2 hashes password into the modular crypt format
+// $pbkdf2-sha256$<iterations>$<salt>$<hash>, with salt and hash in unpadded base64.
+func GeneratePBKDF2(password string) (string, error) {
+	salt := make([]byte, pbkdf2SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iterations, pbkdf2KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return pbkdf2Prefix + strconv.Itoa(pbkdf2Iterations) + "$" + base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key), nil
+}
+
+func ComparePBKDF2(hashedPassword []byte, password []byte) error {
+	hashString, isPBKDF2 := strings.CutPrefix(string(hashedPassword), pbkdf2Prefix)
+	if !isPBKDF2 {
+		return E.New("unsupported password hash")
+	}
+	parts := strings.Split(hashString, "$")
+	if len(parts) != 3 {
+		return E.New("invalid pbkdf2 hash")
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil || iterations <= 0 {
+		return E.New("invalid pbkdf2 iterations: ", parts[0])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return E.Cause(err, "decode pbkdf2 salt")
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return E.Cause(err, "decode pbkdf2 hash")
+	}
+	key, err := pbkdf2.Key(sha256.New, string(password), salt, iterations, len(expected))
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(key, expected) != 1 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
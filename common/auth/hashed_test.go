@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashedAuthenticator(t *testing.T) {
+	t.Parallel()
+	passwordHash, err := GeneratePBKDF2("password")
+	require.NoError(t, err)
+	authenticator := NewHashedAuthenticator([]HashedUser{{Username: "user", PasswordHash: passwordHash}}, nil)
+	ctx, err := authenticator.VerifyContext(context.Background(), "user", "password")
+	require.NoError(t, err)
+	user, loaded := UserFromContext[string](ctx)
+	require.True(t, loaded)
+	require.Equal(t, "user", user)
+	_, err = authenticator.VerifyContext(context.Background(), "user", "wrong")
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = authenticator.VerifyContext(context.Background(), "nobody", "password")
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestHashedAuthenticatorUnknownUser(t *testing.T) {
+	t.Parallel()
+	var compared []string
+	authenticator := NewHashedAuthenticator([]HashedUser{{Username: "user", PasswordHash: "password"}}, func(hashedPassword []byte, password []byte) error {
+		compared = append(compared, string(hashedPassword))
+		if string(hashedPassword) != string(password) {
+			return ErrInvalidCredentials
+		}
+		return nil
+	})
+	_, err := authenticator.VerifyContext(context.Background(), "nobody", "password")
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+	require.Equal(t, []string{"password"}, compared, "unknown users should be compared against a dummy hash")
+}
+
+func TestIsEnabled(t *testing.T) {
+	t.Parallel()
+	require.False(t, IsEnabled(nil))
+	require.False(t, IsEnabled(NewAuthenticator(nil)))
+	require.True(t, IsEnabled(NewAuthenticator([]User{{Username: "user"}})))
+}
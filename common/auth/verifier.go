@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"context"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+var ErrInvalidCredentials = E.New("invalid username or password")
+
+// Verifier checks credentials presented to a server.
+// On success, the returned context carries the authenticated user, usually set by ContextWithUser.
+type Verifier interface {
+	VerifyContext(ctx context.Context, username string, password string) (context.Context, error)
+}
+
+// PasswordLookup is implemented by credential stores that can return the passwords of a user,
+// which challenge-response schemes such as HTTP Digest need to compute the expected response.
+type PasswordLookup interface {
+	Passwords(username string) []string
+}
+
+type VerifierFunc func(ctx context.Context, username string, password string) (context.Context, error)
+
+func (f VerifierFunc) VerifyContext(ctx context.Context, username string, password string) (context.Context, error) {
+	return f(ctx, username, password)
+}
+
+// IsEnabled reports whether verifier requires credentials.
+// A nil *Authenticator, returned by NewAuthenticator for an empty user list, is treated as disabled.
+func IsEnabled(verifier Verifier) bool {
+	if verifier == nil {
+		return false
+	}
+	if authenticator, isAuthenticator := verifier.(*Authenticator); isAuthenticator {
+		return authenticator != nil
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// AcceptLoop accepts connections from listener and passes each of them to handle until the listener is closed or ctx is done.
+// Temporary accept errors are retried with exponential backoff, like net/http does.
+func AcceptLoop(ctx context.Context, listener net.Listener, handle func(conn net.Conn)) error {
+	stop := context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	defer stop()
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var netErr net.Error
+			//nolint:staticcheck
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				if delay == 0 {
+					delay = minAcceptDelay
+				} else {
+					delay = min(delay*2, maxAcceptDelay)
+				}
+				timer := time.NewTimer(delay)
+				select {
+				case <-timer.C:
+					continue
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				}
+			}
+			return err
+		}
+		delay = 0
+		go handle(conn)
+	}
+}
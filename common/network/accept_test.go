@@ -0,0 +1,66 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testTemporaryError struct{}
+
+func (e testTemporaryError) Error() string   { return "temporary" }
+func (e testTemporaryError) Timeout() bool   { return false }
+func (e testTemporaryError) Temporary() bool { return true }
+
+// testFailingListener returns err from the first failures calls to Accept.
+type testFailingListener struct {
+	net.Listener
+	failures int
+	err      error
+}
+
+func (l *testFailingListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, l.err
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptLoop(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	connChan := make(chan net.Conn, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- AcceptLoop(ctx, &testFailingListener{Listener: listener, failures: 3, err: testTemporaryError{}}, func(conn net.Conn) {
+			connChan <- conn
+		})
+	}()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer clientConn.Close()
+	select {
+	case conn := <-connChan:
+		conn.Close()
+	case err = <-done:
+		t.Fatal("accept loop returned on a temporary error: ", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not accepted")
+	}
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	err = AcceptLoop(context.Background(), &testFailingListener{Listener: listener, failures: 1, err: net.ErrClosed}, func(conn net.Conn) {
+		conn.Close()
+	})
+	require.ErrorIs(t, err, net.ErrClosed)
+}
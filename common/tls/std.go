@@ -0,0 +1,93 @@
+package tls
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+var (
+	_ ServerConfig = (*STDServerConfig)(nil)
+	_ Config       = (*STDClientConfig)(nil)
+)
+
+type STDClientConfig struct {
+	config           *STDConfig
+	handshakeTimeout time.Duration
+}
+
+func NewSTDClient(config *STDConfig) *STDClientConfig {
+	if config == nil {
+		config = &STDConfig{}
+	}
+	return &STDClientConfig{config: config}
+}
+
+func (c *STDClientConfig) ServerName() string {
+	return c.config.ServerName
+}
+
+func (c *STDClientConfig) SetServerName(serverName string) {
+	c.config.ServerName = serverName
+}
+
+func (c *STDClientConfig) NextProtos() []string {
+	return c.config.NextProtos
+}
+
+func (c *STDClientConfig) SetNextProtos(nextProto []string) {
+	c.config.NextProtos = nextProto
+}
+
+func (c *STDClientConfig) HandshakeTimeout() time.Duration {
+	return c.handshakeTimeout
+}
+
+func (c *STDClientConfig) SetHandshakeTimeout(timeout time.Duration) {
+	c.handshakeTimeout = timeout
+}
+
+func (c *STDClientConfig) STDConfig() (*STDConfig, error) {
+	return c.config, nil
+}
+
+func (c *STDClientConfig) Client(conn net.Conn) (Conn, error) {
+	return tls.Client(conn, c.config), nil
+}
+
+func (c *STDClientConfig) Clone() Config {
+	return &STDClientConfig{
+		config:           c.config.Clone(),
+		handshakeTimeout: c.handshakeTimeout,
+	}
+}
+
+type STDServerConfig struct {
+	STDClientConfig
+}
+
+func NewSTDServer(config *STDConfig) *STDServerConfig {
+	if config == nil {
+		config = &STDConfig{}
+	}
+	return &STDServerConfig{STDClientConfig{config: config}}
+}
+
+func (c *STDServerConfig) Start() error {
+	return nil
+}
+
+func (c *STDServerConfig) Close() error {
+	return nil
+}
+
+func (c *STDServerConfig) Server(conn net.Conn) (Conn, error) {
+	return tls.Server(conn, c.config), nil
+}
+
+func (c *STDServerConfig) Clone() Config {
+	return &STDServerConfig{STDClientConfig{
+		config:           c.config.Clone(),
+		handshakeTimeout: c.handshakeTimeout,
+	}}
+}
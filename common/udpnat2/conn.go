@@ -6,6 +6,7 @@ import (
 	"net/netip"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sagernet/sing/common"
@@ -20,6 +21,7 @@ import (
 type Conn interface {
 	N.PacketConn
 	SetHandler(handler N.UDPHandlerEx)
+	Dropped() uint64
 	canceler.PacketConn
 }
 
@@ -30,12 +32,31 @@ var (
 )
 
 type natConn struct {
-	cache           freelru.Cache[netip.AddrPort, *natConn]
+	cache           freelru.Cache[natKey, *natConn]
+	key             natKey
+	mapping         Behavior
+	filtering       Behavior
+	filterAccess    sync.Mutex
+	contacted       map[netip.AddrPort]struct{}
+	unfiltered      bool
+	destination     M.Socksaddr
 	writer          N.PacketWriter
 	localAddr       M.Socksaddr
 	handlerAccess   sync.RWMutex
 	handler         N.UDPHandlerEx
 	packetChan      chan *N.PacketBuffer
+	queuePolicy     QueuePolicy
+	queueTimeout    time.Duration
+	blockedChan     chan *N.PacketBuffer
+	blocked         atomic.Int32
+	blockOnce       sync.Once
+	dropped         atomic.Uint64
+	createdAt       time.Time
+	lastActive      atomic.Int64
+	packets         atomic.Uint64
+	bytes           atomic.Uint64
+	replyPackets    atomic.Uint64
+	replyBytes      atomic.Uint64
 	closeOnce       sync.Once
 	doneChan        chan struct{}
 	readDeadline    pipe.Deadline
@@ -58,17 +79,34 @@ func (c *natConn) ReadPacket(buffer *buf.Buffer) (addr M.Socksaddr, err error) {
 }
 
 func (c *natConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	if !c.allow(destination) {
+		buffer.Release()
+		return nil
+	}
+	c.countReply(buffer.Len())
 	return c.writer.WritePacket(buffer, destination)
 }
 
+func (c *natConn) countReply(n int) {
+	c.replyPackets.Add(1)
+	c.replyBytes.Add(uint64(n))
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
 func (c *natConn) CreatePacketBatchWriter() (N.PacketBatchWriter, bool) {
-	if writer, isWriter := c.writer.(N.PacketBatchWriter); isWriter {
-		return writer, true
+	var (
+		writer  N.PacketBatchWriter
+		created bool
+	)
+	if batchWriter, isWriter := c.writer.(N.PacketBatchWriter); isWriter {
+		writer, created = batchWriter, true
+	} else if creator, isCreator := c.writer.(N.PacketBatchWriteCreator); isCreator {
+		writer, created = creator.CreatePacketBatchWriter()
 	}
-	if creator, isCreator := c.writer.(N.PacketBatchWriteCreator); isCreator {
-		return creator.CreatePacketBatchWriter()
+	if !created {
+		return nil, false
 	}
-	return nil, false
+	return &natBatchWriter{c, writer}, true
 }
 
 func (c *natConn) InitializeReadWaiter(options N.ReadWaitOptions) (needCopy bool) {
@@ -125,21 +163,11 @@ func (c *natConn) SetHandler(handler N.UDPHandlerEx) {
 	c.handler = handler
 	c.readWaitOptions = N.NewReadWaitOptions(c.writer, handler)
 	c.handlerAccess.Unlock()
-fetch:
-	for {
-		select {
-		case packet := <-c.packetChan:
-			c.handler.NewPacketEx(packet.Buffer, packet.Destination)
-			N.PutPacketBuffer(packet)
-			continue fetch
-		default:
-			break fetch
-		}
-	}
+	c.flush()
 }
 
 func (c *natConn) Timeout() time.Duration {
-	rawConn, lifetime, loaded := c.cache.PeekWithLifetime(c.localAddr.AddrPort())
+	rawConn, lifetime, loaded := c.cache.PeekWithLifetime(c.key)
 	if !loaded || rawConn != c {
 		return 0
 	}
@@ -147,15 +175,40 @@ func (c *natConn) Timeout() time.Duration {
 }
 
 func (c *natConn) SetTimeout(timeout time.Duration) bool {
-	return c.cache.UpdateLifetime(c.localAddr.AddrPort(), c, timeout)
+	return c.cache.UpdateLifetime(c.key, c, timeout)
 }
 
+// Close removes the session from the service, so that it no longer counts against the session limits.
 func (c *natConn) Close() error {
+	select {
+	case <-c.doneChan:
+		return nil
+	default:
+	}
+	if !c.close() {
+		return nil
+	}
+	c.cache.RemoveValue(c.key, c)
+	c.closeHandler()
+	return nil
+}
+
+// close marks the session done and reports whether it was open.
+// It is also called by the evict callback, which runs under the cache lock.
+func (c *natConn) close() (closed bool) {
 	c.closeOnce.Do(func() {
 		close(c.doneChan)
-		common.Close(c.handler)
+		closed = true
 	})
-	return nil
+	return
+}
+
+// closeHandler must not run under the cache lock, since the handler may close the conn again.
+func (c *natConn) closeHandler() {
+	c.handlerAccess.RLock()
+	handler := c.handler
+	c.handlerAccess.RUnlock()
+	common.Close(handler)
 }
 
 func (c *natConn) LocalAddr() net.Addr {
@@ -182,3 +235,27 @@ func (c *natConn) SetWriteDeadline(t time.Time) error {
 func (c *natConn) Upstream() any {
 	return c.writer
 }
+
+// natBatchWriter counts the packets written back to the source, and drops those not accepted by the filter of the session.
+type natBatchWriter struct {
+	conn   *natConn
+	writer N.PacketBatchWriter
+}
+
+func (w *natBatchWriter) WritePacketBatch(buffers []*buf.Buffer, destinations []M.Socksaddr) error {
+	filteredBuffers := make([]*buf.Buffer, 0, len(buffers))
+	filteredDestinations := make([]M.Socksaddr, 0, len(destinations))
+	for index, buffer := range buffers {
+		if !w.conn.allow(destinations[index]) {
+			buffer.Release()
+			continue
+		}
+		w.conn.countReply(buffer.Len())
+		filteredBuffers = append(filteredBuffers, buffer)
+		filteredDestinations = append(filteredDestinations, destinations[index])
+	}
+	if len(filteredBuffers) == 0 {
+		return nil
+	}
+	return w.writer.WritePacketBatch(filteredBuffers, filteredDestinations)
+}
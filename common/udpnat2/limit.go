@@ -0,0 +1,152 @@
+package udpnat
+
+import (
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const DefaultMaxSessions = 1024
+
+// fullPurgeInterval rate-limits purging expired sessions while new sessions are rejected,
+// since PurgeExpired scans the cache under its lock.
+const fullPurgeInterval = time.Second
+
+// LimitPolicy selects what happens to a packet that would create a session over a limit.
+type LimitPolicy uint8
+
+const (
+	// LimitEvictOldest closes the least recently active session to make room.
+	// For the global limit it is the least recently used session of any source.
+	LimitEvictOldest LimitPolicy = iota
+	// LimitReject drops the packet. Expired sessions are purged at most once per second to make room.
+	LimitReject
+)
+
+func (p LimitPolicy) String() string {
+	switch p {
+	case LimitEvictOldest:
+		return "evict-oldest"
+	case LimitReject:
+		return "reject"
+	default:
+		return "unknown"
+	}
+}
+
+// Session is a snapshot of a session.
+type Session struct {
+	Source      M.Socksaddr
+	Destination M.Socksaddr
+	CreatedAt   time.Time
+	LastActive  time.Time
+	// Packets and Bytes count the packets received from the source.
+	Packets uint64
+	Bytes   uint64
+	// ReplyPackets and ReplyBytes count the packets written back to the source.
+	ReplyPackets uint64
+	ReplyBytes   uint64
+	Dropped      uint64
+}
+
+// Sessions returns a snapshot of the active sessions.
+func (s *Service) Sessions() []Session {
+	s.access.Lock()
+	defer s.access.Unlock()
+	sessions := make([]Session, 0, s.sessionCount)
+	for _, conns := range s.sources {
+		for _, conn := range conns {
+			sessions = append(sessions, conn.snapshot())
+		}
+	}
+	return sessions
+}
+
+// full reports whether new sessions are rejected by the global limit.
+func (s *Service) full() bool {
+	if s.limitPolicy != LimitReject {
+		return false
+	}
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.sessionCount >= s.maxSessions
+}
+
+// purgeExpiredIfFull makes room for new sessions by removing expired ones, if new sessions are rejected.
+func (s *Service) purgeExpiredIfFull() {
+	if !s.full() {
+		return
+	}
+	now := time.Now().UnixNano()
+	lastPurge := s.lastPurge.Load()
+	if now-lastPurge < int64(fullPurgeInterval) || !s.lastPurge.CompareAndSwap(lastPurge, now) {
+		return
+	}
+	s.cache.PurgeExpired()
+}
+
+// admit reports whether a session may be created for source,
+// and the session of the same source to close to make room for it.
+func (s *Service) admit(source M.Socksaddr) (ok bool, victim *natConn) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if s.limitPolicy == LimitReject && s.sessionCount >= s.maxSessions {
+		return false, nil
+	}
+	conns := s.sources[source.Addr.Unmap()]
+	if s.maxSessionsPerSource == 0 || len(conns) < s.maxSessionsPerSource {
+		return true, nil
+	}
+	if s.limitPolicy == LimitReject {
+		return false, nil
+	}
+	victim = conns[0]
+	for _, conn := range conns[1:] {
+		if conn.lastActive.Load() < victim.lastActive.Load() {
+			victim = conn
+		}
+	}
+	return true, victim
+}
+
+func (s *Service) register(conn *natConn) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	addr := conn.localAddr.Addr.Unmap()
+	s.sources[addr] = append(s.sources[addr], conn)
+	s.sessionCount++
+}
+
+func (s *Service) unregister(conn *natConn) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	addr := conn.localAddr.Addr.Unmap()
+	conns := s.sources[addr]
+	for index, sourceConn := range conns {
+		if sourceConn != conn {
+			continue
+		}
+		conns = append(conns[:index], conns[index+1:]...)
+		if len(conns) == 0 {
+			delete(s.sources, addr)
+		} else {
+			s.sources[addr] = conns
+		}
+		s.sessionCount--
+		return
+	}
+}
+
+func (c *natConn) snapshot() Session {
+	return Session{
+		Source:       c.localAddr,
+		Destination:  c.destination,
+		CreatedAt:    c.createdAt,
+		LastActive:   time.Unix(0, c.lastActive.Load()),
+		Packets:      c.packets.Load(),
+		Bytes:        c.bytes.Load(),
+		ReplyPackets: c.replyPackets.Load(),
+		ReplyBytes:   c.replyBytes.Load(),
+		Dropped:      c.dropped.Load(),
+	}
+}
@@ -0,0 +1,95 @@
+package udpnat
+
+import (
+	"net/netip"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// Behavior is a mapping or filtering behavior of sessions, as defined in RFC 4787.
+type Behavior uint8
+
+const (
+	// EndpointIndependent maps each source to one session, or lets a session accept packets from any remote endpoint.
+	EndpointIndependent Behavior = iota
+	// AddressDependent maps each source and destination address to a session,
+	// or lets a session only accept packets from addresses it has sent to.
+	AddressDependent
+	// AddressAndPortDependent maps each source and destination endpoint to a session,
+	// or lets a session only accept packets from endpoints it has sent to.
+	AddressAndPortDependent
+)
+
+func (b Behavior) String() string {
+	switch b {
+	case EndpointIndependent:
+		return "endpoint-independent"
+	case AddressDependent:
+		return "address-dependent"
+	case AddressAndPortDependent:
+		return "address-and-port-dependent"
+	default:
+		return "unknown"
+	}
+}
+
+type natKey struct {
+	source      netip.AddrPort
+	destination M.Socksaddr
+}
+
+func (b Behavior) key(source M.Socksaddr, destination M.Socksaddr) natKey {
+	key := natKey{source: source.AddrPort()}
+	switch b {
+	case AddressDependent:
+		key.destination = destination.Unwrap()
+		key.destination.Port = 0
+	case AddressAndPortDependent:
+		key.destination = destination.Unwrap()
+	}
+	return key
+}
+
+// endpoint returns the part of an IP endpoint the filtering behavior compares.
+func (b Behavior) endpoint(addr M.Socksaddr) netip.AddrPort {
+	if b == AddressDependent {
+		return netip.AddrPortFrom(addr.Addr.Unmap(), 0)
+	}
+	return netip.AddrPortFrom(addr.Addr.Unmap(), addr.Port)
+}
+
+// contact records a destination the session sent to. Only sessions whose filtering is stricter than their mapping
+// can send to destinations that are not part of their key, so other sessions keep no record.
+func (c *natConn) contact(destination M.Socksaddr) {
+	if c.filtering <= c.mapping {
+		return
+	}
+	c.filterAccess.Lock()
+	defer c.filterAccess.Unlock()
+	if !destination.IsIP() {
+		c.unfiltered = true
+		return
+	}
+	if c.contacted == nil {
+		c.contacted = make(map[netip.AddrPort]struct{})
+	}
+	c.contacted[c.filtering.endpoint(destination)] = struct{}{}
+}
+
+// allow reports whether the session accepts a packet from remote.
+// Sessions that sent to domain destinations are not filtered.
+func (c *natConn) allow(remote M.Socksaddr) bool {
+	if c.filtering == EndpointIndependent || !remote.IsIP() {
+		return true
+	}
+	if c.filtering <= c.mapping {
+		return !c.destination.IsIP() || c.filtering.endpoint(c.destination) == c.filtering.endpoint(remote)
+	}
+	c.filterAccess.Lock()
+	defer c.filterAccess.Unlock()
+	if c.unfiltered {
+		return true
+	}
+	_, loaded := c.contacted[c.filtering.endpoint(remote)]
+	return loaded
+}
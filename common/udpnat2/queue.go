@@ -0,0 +1,147 @@
+package udpnat
+
+import (
+	"time"
+
+	N "github.com/sagernet/sing/common/network"
+)
+
+const (
+	DefaultQueueSize    = 64
+	DefaultQueueTimeout = 100 * time.Millisecond
+)
+
+// QueuePolicy selects what happens to a packet for a session whose queue is full,
+// before the handler of the session is set.
+type QueuePolicy uint8
+
+const (
+	// QueueDropNewest drops the incoming packet.
+	QueueDropNewest QueuePolicy = iota
+	// QueueDropOldest drops the oldest queued packet to make room for the incoming one.
+	QueueDropOldest
+	// QueueBlock waits up to the queue timeout for room, and drops the packet after that.
+	// The wait happens in a goroutine of the session, so that other sessions keep flowing.
+	// Up to the queue size packets wait for room, and packets beyond that are dropped.
+	QueueBlock
+)
+
+func (p QueuePolicy) String() string {
+	switch p {
+	case QueueDropNewest:
+		return "drop-newest"
+	case QueueDropOldest:
+		return "drop-oldest"
+	case QueueBlock:
+		return "block"
+	default:
+		return "unknown"
+	}
+}
+
+func (c *natConn) enqueue(packet *N.PacketBuffer) {
+	if c.queuePolicy == QueueBlock && c.blocked.Load() > 0 {
+		// keep the order of packets behind a blocked one
+		c.block(packet)
+		return
+	}
+	select {
+	case c.packetChan <- packet:
+		return
+	default:
+	}
+	switch c.queuePolicy {
+	case QueueDropOldest:
+		for {
+			select {
+			case oldPacket := <-c.packetChan:
+				c.drop(oldPacket)
+			default:
+			}
+			select {
+			case c.packetChan <- packet:
+				return
+			default:
+			}
+		}
+	case QueueBlock:
+		c.block(packet)
+		return
+	}
+	c.drop(packet)
+}
+
+// block hands the packet to the goroutine of the session, which waits for room in the queue.
+func (c *natConn) block(packet *N.PacketBuffer) {
+	c.blocked.Add(1)
+	select {
+	case c.blockedChan <- packet:
+	default:
+		c.blocked.Add(-1)
+		c.drop(packet)
+		return
+	}
+	c.blockOnce.Do(func() {
+		go c.loopBlocked()
+	})
+}
+
+func (c *natConn) loopBlocked() {
+	timer := time.NewTimer(c.queueTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case packet := <-c.blockedChan:
+			timer.Reset(c.queueTimeout)
+			select {
+			case c.packetChan <- packet:
+			case <-timer.C:
+				c.drop(packet)
+			case <-c.doneChan:
+				c.drop(packet)
+			}
+			c.blocked.Add(-1)
+			c.flush()
+		case <-c.doneChan:
+			for {
+				select {
+				case packet := <-c.blockedChan:
+					c.drop(packet)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush passes queued packets to the handler once it is set.
+// It is called after every enqueue, so that packets queued while SetHandler drains are not left behind.
+func (c *natConn) flush() {
+	c.handlerAccess.RLock()
+	handler := c.handler
+	c.handlerAccess.RUnlock()
+	if handler == nil {
+		return
+	}
+	for {
+		select {
+		case packet := <-c.packetChan:
+			handler.NewPacketEx(packet.Buffer, packet.Destination)
+			N.PutPacketBuffer(packet)
+		default:
+			return
+		}
+	}
+}
+
+func (c *natConn) drop(packet *N.PacketBuffer) {
+	packet.Buffer.Release()
+	N.PutPacketBuffer(packet)
+	c.dropped.Add(1)
+}
+
+// Dropped returns the number of packets dropped because the queue of the session was full.
+func (c *natConn) Dropped() uint64 {
+	return c.dropped.Load()
+}
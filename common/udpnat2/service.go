@@ -3,6 +3,8 @@ package udpnat
 import (
 	"context"
 	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sagernet/sing/common"
@@ -15,25 +17,83 @@ import (
 )
 
 type Service struct {
-	cache   freelru.Cache[netip.AddrPort, *natConn]
-	handler N.UDPConnectionHandlerEx
-	prepare PrepareFunc
+	cache     freelru.Cache[natKey, *natConn]
+	handler   N.UDPConnectionHandlerEx
+	prepare   PrepareFunc
+	mapping   Behavior
+	filtering Behavior
+
+	queueSize    int
+	queuePolicy  QueuePolicy
+	queueTimeout time.Duration
+
+	maxSessions          int
+	maxSessionsPerSource int
+	limitPolicy          LimitPolicy
+	access               sync.Mutex
+	sources              map[netip.Addr][]*natConn
+	sessionCount         int
+	lastPurge            atomic.Int64
 }
 
 type PrepareFunc func(source M.Socksaddr, destination M.Socksaddr, userData any) (bool, context.Context, N.PacketWriter, N.CloseHandlerFunc)
 
+type Options struct {
+	Handler N.UDPConnectionHandlerEx
+	Prepare PrepareFunc
+	Timeout time.Duration
+	Shared  bool
+	// Mapping selects which packets of a source share a session, defaults to EndpointIndependent.
+	Mapping Behavior
+	// Filtering selects which remote endpoints a session accepts packets from, defaults to EndpointIndependent.
+	// A port-restricted cone is EndpointIndependent mapping with AddressAndPortDependent filtering.
+	Filtering Behavior
+	// QueueSize is the number of packets queued for a session until its handler is set, defaults to DefaultQueueSize.
+	QueueSize int
+	// QueuePolicy defaults to QueueDropNewest.
+	QueuePolicy QueuePolicy
+	// QueueTimeout is how long QueueBlock waits, defaults to DefaultQueueTimeout.
+	QueueTimeout time.Duration
+	// MaxSessions defaults to DefaultMaxSessions.
+	// If Shared is set, the cache is split into shards holding a fraction of MaxSessions each,
+	// and a full shard evicts its least recently used session before the limit is reached, even with LimitReject.
+	MaxSessions int
+	// MaxSessionsPerSource limits the sessions of a source IP address, unlimited if zero.
+	MaxSessionsPerSource int
+	// LimitPolicy defaults to LimitEvictOldest.
+	LimitPolicy LimitPolicy
+}
+
 func New(handler N.UDPConnectionHandlerEx, prepare PrepareFunc, timeout time.Duration, shared bool) *Service {
-	if timeout == 0 {
+	return NewWithOptions(Options{
+		Handler: handler,
+		Prepare: prepare,
+		Timeout: timeout,
+		Shared:  shared,
+	})
+}
+
+func NewWithOptions(options Options) *Service {
+	if options.Timeout == 0 {
 		panic("invalid timeout")
 	}
-	var cache freelru.Cache[netip.AddrPort, *natConn]
-	if !shared {
-		cache = common.Must1(freelru.NewSynced[netip.AddrPort, *natConn](1024, maphash.NewHasher[netip.AddrPort]().Hash32))
+	if options.QueueSize == 0 {
+		options.QueueSize = DefaultQueueSize
+	}
+	if options.QueueTimeout == 0 {
+		options.QueueTimeout = DefaultQueueTimeout
+	}
+	if options.MaxSessions == 0 {
+		options.MaxSessions = DefaultMaxSessions
+	}
+	var cache freelru.Cache[natKey, *natConn]
+	if !options.Shared {
+		cache = common.Must1(freelru.NewSynced[natKey, *natConn](uint32(options.MaxSessions), maphash.NewHasher[natKey]().Hash32))
 	} else {
-		cache = common.Must1(freelru.NewSharded[netip.AddrPort, *natConn](1024, maphash.NewHasher[netip.AddrPort]().Hash32))
+		cache = common.Must1(freelru.NewSharded[natKey, *natConn](uint32(options.MaxSessions), maphash.NewHasher[natKey]().Hash32))
 	}
-	cache.SetLifetime(timeout)
-	cache.SetHealthCheck(func(port netip.AddrPort, conn *natConn) bool {
+	cache.SetLifetime(options.Timeout)
+	cache.SetHealthCheck(func(_ natKey, conn *natConn) bool {
 		select {
 		case <-conn.doneChan:
 			return false
@@ -41,33 +101,72 @@ func New(handler N.UDPConnectionHandlerEx, prepare PrepareFunc, timeout time.Dur
 			return true
 		}
 	})
-	cache.SetOnEvict(func(_ netip.AddrPort, conn *natConn) {
-		conn.Close()
-	})
-	return &Service{
-		cache:   cache,
-		handler: handler,
-		prepare: prepare,
+	service := &Service{
+		cache:     cache,
+		handler:   options.Handler,
+		prepare:   options.Prepare,
+		mapping:   options.Mapping,
+		filtering: options.Filtering,
+
+		queueSize:    options.QueueSize,
+		queuePolicy:  options.QueuePolicy,
+		queueTimeout: options.QueueTimeout,
+
+		maxSessions:          options.MaxSessions,
+		maxSessionsPerSource: options.MaxSessionsPerSource,
+		limitPolicy:          options.LimitPolicy,
+		sources:              make(map[netip.Addr][]*natConn),
 	}
+	cache.SetOnEvict(func(_ natKey, conn *natConn) {
+		service.unregister(conn)
+		if conn.close() {
+			go conn.closeHandler()
+		}
+	})
+	return service
 }
 
 func (s *Service) NewPacket(bufferSlices [][]byte, source M.Socksaddr, destination M.Socksaddr, userData any) {
-	conn, _, ok := s.cache.GetAndRefreshOrAdd(source.AddrPort(), func() (*natConn, bool) {
+	key := s.mapping.key(source, destination)
+	s.purgeExpiredIfFull()
+	var victim *natConn
+	conn, _, ok := s.cache.GetAndRefreshOrAdd(key, func() (*natConn, bool) {
+		var admitted bool
+		admitted, victim = s.admit(source)
+		if !admitted {
+			return nil, false
+		}
 		ok, ctx, writer, onClose := s.prepare(source, destination, userData)
 		if !ok {
+			victim = nil
 			return nil, false
 		}
 		newConn := &natConn{
 			cache:        s.cache,
+			key:          key,
+			mapping:      s.mapping,
+			filtering:    s.filtering,
+			destination:  destination,
 			writer:       writer,
 			localAddr:    source,
-			packetChan:   make(chan *N.PacketBuffer, 64),
+			packetChan:   make(chan *N.PacketBuffer, s.queueSize),
+			queuePolicy:  s.queuePolicy,
+			queueTimeout: s.queueTimeout,
 			doneChan:     make(chan struct{}),
 			readDeadline: pipe.MakeDeadline(),
+			createdAt:    time.Now(),
+		}
+		if s.queuePolicy == QueueBlock {
+			newConn.blockedChan = make(chan *N.PacketBuffer, s.queueSize)
 		}
+		newConn.lastActive.Store(newConn.createdAt.UnixNano())
+		s.register(newConn)
 		go s.handler.NewPacketConnectionEx(ctx, newConn, source, destination, onClose)
 		return newConn, true
 	})
+	if victim != nil {
+		s.cache.Remove(victim.key)
+	}
 	if !ok {
 		return
 	}
@@ -84,6 +183,10 @@ func (s *Service) NewPacket(bufferSlices [][]byte, source M.Socksaddr, destinati
 		buffer.Write(bufferSlice)
 	}
 	readWaitOptions.PostReturn(buffer)
+	conn.packets.Add(1)
+	conn.bytes.Add(uint64(dataLen))
+	conn.lastActive.Store(time.Now().UnixNano())
+	conn.contact(destination)
 	if handler != nil {
 		handler.NewPacketEx(buffer, destination)
 		return
@@ -93,12 +196,8 @@ func (s *Service) NewPacket(bufferSlices [][]byte, source M.Socksaddr, destinati
 		Buffer:      buffer,
 		Destination: destination,
 	}
-	select {
-	case conn.packetChan <- packet:
-	default:
-		packet.Buffer.Release()
-		N.PutPacketBuffer(packet)
-	}
+	conn.enqueue(packet)
+	conn.flush()
 }
 
 func (s *Service) NewPacketBatch(buffers []*buf.Buffer, sources []M.Socksaddr, destination M.Socksaddr, userData any) {
@@ -112,6 +211,15 @@ func (s *Service) NewPacketBatch(buffers []*buf.Buffer, sources []M.Socksaddr, d
 	}
 }
 
+// Dropped returns the number of packets dropped by the session of source to destination.
+func (s *Service) Dropped(source M.Socksaddr, destination M.Socksaddr) (dropped uint64, loaded bool) {
+	conn, loaded := s.cache.Peek(s.mapping.key(source, destination))
+	if !loaded {
+		return 0, false
+	}
+	return conn.Dropped(), true
+}
+
 func (s *Service) Purge() {
 	s.cache.Purge()
 }
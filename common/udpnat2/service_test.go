@@ -0,0 +1,363 @@
+package udpnat
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestServiceBehavior(t *testing.T) {
+	t.Parallel()
+
+	source := M.ParseSocksaddr("10.0.0.1:1234")
+	destinations := []M.Socksaddr{
+		M.ParseSocksaddr("1.1.1.1:53"),
+		M.ParseSocksaddr("1.1.1.1:54"),
+		M.ParseSocksaddr("2.2.2.2:53"),
+	}
+	remotes := append(destinations, M.ParseSocksaddr("3.3.3.3:53"))
+	for _, testCase := range []struct {
+		mapping   Behavior
+		filtering Behavior
+		sessions  int
+		writes    int
+	}{
+		{EndpointIndependent, EndpointIndependent, 1, 4},
+		{EndpointIndependent, AddressDependent, 1, 3},
+		{EndpointIndependent, AddressAndPortDependent, 1, 3},
+		{AddressDependent, EndpointIndependent, 2, 4},
+		{AddressDependent, AddressDependent, 2, 2},
+		{AddressDependent, AddressAndPortDependent, 2, 2},
+		{AddressAndPortDependent, EndpointIndependent, 3, 4},
+		{AddressAndPortDependent, AddressDependent, 3, 2},
+		{AddressAndPortDependent, AddressAndPortDependent, 3, 1},
+	} {
+		name := testCase.mapping.String() + "/" + testCase.filtering.String()
+		handler := &testHandler{conns: make(chan testSession, len(destinations))}
+		writer := &testPacketBatchWriter{}
+		service := NewWithOptions(Options{
+			Handler: handler,
+			Prepare: func(source M.Socksaddr, destination M.Socksaddr, userData any) (bool, context.Context, N.PacketWriter, N.CloseHandlerFunc) {
+				return true, context.Background(), writer, nil
+			},
+			Timeout:   time.Minute,
+			Mapping:   testCase.mapping,
+			Filtering: testCase.filtering,
+		})
+		for _, destination := range destinations {
+			service.NewPacket([][]byte{[]byte("ping")}, source, destination, nil)
+		}
+		var conn N.PacketConn
+		for index := range testCase.sessions {
+			select {
+			case session := <-handler.conns:
+				if session.destination == destinations[0] {
+					conn = session.conn
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s: unexpected session count: %d", name, index)
+			}
+		}
+		select {
+		case <-handler.conns:
+			t.Fatalf("%s: unexpected session count: %d", name, testCase.sessions+1)
+		case <-time.After(50 * time.Millisecond):
+		}
+		for _, remote := range remotes {
+			err := conn.WritePacket(buf.As([]byte("pong")).ToOwned(), remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if writer.count != testCase.writes {
+			t.Fatalf("%s: unexpected write count: %d", name, writer.count)
+		}
+		service.Purge()
+	}
+}
+
+func TestServiceQueuePolicy(t *testing.T) {
+	t.Parallel()
+
+	source := M.ParseSocksaddr("10.0.0.1:1234")
+	destination := M.ParseSocksaddr("1.1.1.1:53")
+	for policy, expected := range map[QueuePolicy][]string{
+		QueueDropNewest: {"1", "2"},
+		QueueDropOldest: {"3", "4"},
+		QueueBlock:      {"1", "2"},
+	} {
+		handler := &testHandler{conns: make(chan testSession, 1)}
+		service := NewWithOptions(Options{
+			Handler: handler,
+			Prepare: func(source M.Socksaddr, destination M.Socksaddr, userData any) (bool, context.Context, N.PacketWriter, N.CloseHandlerFunc) {
+				return true, context.Background(), testPacketWriter{}, nil
+			},
+			Timeout:      time.Minute,
+			QueueSize:    2,
+			QueuePolicy:  policy,
+			QueueTimeout: 10 * time.Millisecond,
+		})
+		for _, message := range []string{"1", "2", "3", "4"} {
+			service.NewPacket([][]byte{[]byte(message)}, source, destination, nil)
+		}
+		deadline := time.Now().Add(time.Second)
+		for {
+			dropped, loaded := service.Dropped(source, destination)
+			if loaded && dropped == 2 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: unexpected drop count: %d", policy, dropped)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		conn := (<-handler.conns).conn
+		for _, message := range expected {
+			buffer := buf.NewPacket()
+			_, err := conn.ReadPacket(buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buffer.Bytes()) != message {
+				t.Fatalf("%s: unexpected packet: %q", policy, buffer.Bytes())
+			}
+			buffer.Release()
+		}
+		service.Purge()
+	}
+}
+
+func TestServiceQueueBlockIsolation(t *testing.T) {
+	t.Parallel()
+
+	handler := &testHandler{conns: make(chan testSession, 2)}
+	service := NewWithOptions(Options{
+		Handler: handler,
+		Prepare: func(source M.Socksaddr, destination M.Socksaddr, userData any) (bool, context.Context, N.PacketWriter, N.CloseHandlerFunc) {
+			return true, context.Background(), testPacketWriter{}, nil
+		},
+		Timeout:      time.Minute,
+		QueueSize:    1,
+		QueuePolicy:  QueueBlock,
+		QueueTimeout: time.Minute,
+	})
+	destination := M.ParseSocksaddr("1.1.1.1:53")
+	blockedSource := M.ParseSocksaddr("10.0.0.1:1234")
+	source := M.ParseSocksaddr("10.0.0.2:1234")
+	start := time.Now()
+	for _, message := range []string{"1", "2"} {
+		service.NewPacket([][]byte{[]byte(message)}, blockedSource, destination, nil)
+	}
+	service.NewPacket([][]byte{[]byte("other")}, source, destination, nil)
+	if time.Since(start) > time.Second {
+		t.Fatal("a blocked session stalled the service")
+	}
+	sessions := map[M.Socksaddr]N.PacketConn{}
+	for range 2 {
+		session := <-handler.conns
+		sessions[M.SocksaddrFromNet(session.conn.LocalAddr())] = session.conn
+	}
+	buffer := buf.NewPacket()
+	defer buffer.Release()
+	_, err := sessions[source].ReadPacket(buffer)
+	if err != nil || string(buffer.Bytes()) != "other" {
+		t.Fatalf("unexpected packet: %q, %v", buffer.Bytes(), err)
+	}
+	for _, message := range []string{"1", "2"} {
+		buffer.Reset()
+		_, err = sessions[blockedSource].ReadPacket(buffer)
+		if err != nil || string(buffer.Bytes()) != message {
+			t.Fatalf("unexpected packet: %q, %v", buffer.Bytes(), err)
+		}
+	}
+	service.Purge()
+}
+
+func TestServiceSetHandler(t *testing.T) {
+	t.Parallel()
+
+	handler := &testHandler{conns: make(chan testSession, 1)}
+	service := NewWithOptions(Options{
+		Handler: handler,
+		Prepare: func(source M.Socksaddr, destination M.Socksaddr, userData any) (bool, context.Context, N.PacketWriter, N.CloseHandlerFunc) {
+			return true, context.Background(), testPacketWriter{}, nil
+		},
+		Timeout: time.Minute,
+	})
+	source := M.ParseSocksaddr("10.0.0.1:1234")
+	destination := M.ParseSocksaddr("1.1.1.1:53")
+	service.NewPacket([][]byte{[]byte("0")}, source, destination, nil)
+	conn := (<-handler.conns).conn.(*natConn)
+	packetHandler := &testCountHandler{}
+	done := make(chan struct{})
+	go func() {
+		for range 100 {
+			service.NewPacket([][]byte{[]byte("ping")}, source, destination, nil)
+		}
+		close(done)
+	}()
+	conn.SetHandler(packetHandler)
+	<-done
+	if count := packetHandler.count.Load(); count != 101 {
+		t.Fatalf("packets lost around SetHandler: %d", count)
+	}
+	service.Purge()
+}
+
+type testCountHandler struct {
+	count atomic.Int32
+}
+
+func (h *testCountHandler) NewPacketEx(buffer *buf.Buffer, destination M.Socksaddr) {
+	buffer.Release()
+	h.count.Add(1)
+}
+
+func TestServiceLimit(t *testing.T) {
+	t.Parallel()
+
+	prepare := func(source M.Socksaddr, destination M.Socksaddr, userData any) (bool, context.Context, N.PacketWriter, N.CloseHandlerFunc) {
+		return true, context.Background(), testPacketWriter{}, nil
+	}
+	sourceA := M.ParseSocksaddr("10.0.0.1:1234")
+	sourceB := M.ParseSocksaddr("10.0.0.2:1234")
+	destinations := []M.Socksaddr{
+		M.ParseSocksaddr("1.1.1.1:53"),
+		M.ParseSocksaddr("2.2.2.2:53"),
+		M.ParseSocksaddr("3.3.3.3:53"),
+	}
+
+	service := NewWithOptions(Options{
+		Handler:              &testHandler{conns: make(chan testSession, 4)},
+		Prepare:              prepare,
+		Timeout:              time.Minute,
+		Mapping:              AddressAndPortDependent,
+		MaxSessionsPerSource: 2,
+	})
+	for _, destination := range destinations {
+		service.NewPacket([][]byte{[]byte("ping")}, sourceA, destination, nil)
+		time.Sleep(time.Millisecond)
+	}
+	service.NewPacket([][]byte{[]byte("ping")}, sourceB, destinations[0], nil)
+	sessions := service.Sessions()
+	if len(sessions) != 3 {
+		t.Fatalf("unexpected session count: %d", len(sessions))
+	}
+	for _, session := range sessions {
+		if session.Source == sourceA && session.Destination == destinations[0] {
+			t.Fatal("oldest session of source not evicted")
+		}
+		if session.Packets != 1 || session.Bytes != 4 {
+			t.Fatalf("unexpected counters: %d packets, %d bytes", session.Packets, session.Bytes)
+		}
+	}
+	service.Purge()
+	if len(service.Sessions()) != 0 {
+		t.Fatal("sessions not removed on purge")
+	}
+
+	handler := &testHandler{conns: make(chan testSession, 3)}
+	service = NewWithOptions(Options{
+		Handler:     handler,
+		Prepare:     prepare,
+		Timeout:     time.Minute,
+		MaxSessions: 2,
+		LimitPolicy: LimitReject,
+	})
+	sourceC := M.ParseSocksaddr("10.0.0.3:1234")
+	for _, source := range []M.Socksaddr{sourceA, sourceB, sourceC} {
+		service.NewPacket([][]byte{[]byte("ping")}, source, destinations[0], nil)
+	}
+	sessions = service.Sessions()
+	if len(sessions) != 2 {
+		t.Fatalf("unexpected session count: %d", len(sessions))
+	}
+	for _, session := range sessions {
+		if session.Source != sourceA && session.Source != sourceB {
+			t.Fatalf("unexpected session: %s", session.Source)
+		}
+	}
+	var closed testSession
+	select {
+	case closed = <-handler.conns:
+	case <-time.After(time.Second):
+		t.Fatal("missing session")
+	}
+	closed.conn.Close()
+	sessions = service.Sessions()
+	if len(sessions) != 1 || sessions[0].Source == M.SocksaddrFromNet(closed.conn.LocalAddr()) {
+		t.Fatal("closed session not removed")
+	}
+	service.NewPacket([][]byte{[]byte("ping")}, sourceC, destinations[0], nil)
+	if len(service.Sessions()) != 2 {
+		t.Fatal("session not admitted after close")
+	}
+	service.Purge()
+}
+
+type testSession struct {
+	conn        N.PacketConn
+	destination M.Socksaddr
+}
+
+type testHandler struct {
+	conns chan testSession
+}
+
+func (h *testHandler) NewPacketConnectionEx(ctx context.Context, conn N.PacketConn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	h.conns <- testSession{conn, destination}
+}
+
+// testClosingHandler closes its conn on shutdown, like handlers that own the conn.
+type testClosingHandler struct {
+	conn   N.PacketConn
+	closed chan struct{}
+}
+
+func (h *testClosingHandler) NewPacketEx(buffer *buf.Buffer, destination M.Socksaddr) {
+	buffer.Release()
+}
+
+func (h *testClosingHandler) Close() error {
+	h.conn.Close()
+	close(h.closed)
+	return nil
+}
+
+func TestServiceCloseReentrant(t *testing.T) {
+	t.Parallel()
+
+	source := M.ParseSocksaddr("10.0.0.1:1234")
+	handler := &testHandler{conns: make(chan testSession, 2)}
+	service := NewWithOptions(Options{
+		Handler: handler,
+		Prepare: func(source M.Socksaddr, destination M.Socksaddr, userData any) (bool, context.Context, N.PacketWriter, N.CloseHandlerFunc) {
+			return true, context.Background(), testPacketWriter{}, nil
+		},
+		Timeout: time.Minute,
+	})
+	for _, purge := range []bool{false, true} {
+		service.NewPacket([][]byte{[]byte("ping")}, source, M.ParseSocksaddr("1.1.1.1:53"), nil)
+		conn := (<-handler.conns).conn
+		closingHandler := &testClosingHandler{conn: conn, closed: make(chan struct{})}
+		conn.(*natConn).SetHandler(closingHandler)
+		if purge {
+			service.Purge()
+		} else {
+			conn.Close()
+		}
+		select {
+		case <-closingHandler.closed:
+		case <-time.After(time.Second):
+			t.Fatalf("purge=%v: handler not closed", purge)
+		}
+		if len(service.Sessions()) != 0 {
+			t.Fatalf("purge=%v: session not removed", purge)
+		}
+	}
+}
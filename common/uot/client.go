@@ -3,6 +3,8 @@ package uot
 import (
 	"context"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/sagernet/sing/common/bufio"
 	E "github.com/sagernet/sing/common/exceptions"
@@ -13,10 +15,30 @@ import (
 type Client struct {
 	Dialer  N.Dialer
 	Version uint8
+	// Capabilities are requested from the server in version 3.
+	Capabilities uint8
+	// Multiplex carries the sessions of DialContext and ListenPacket over one stream to MagicAddressMux.
+	Multiplex bool
+	// IdleTimeout closes idle multiplexed sessions, defaults to DefaultMuxIdleTimeout.
+	IdleTimeout time.Duration
+
+	muxAccess sync.Mutex
+	mux       *muxClient
 }
 
 func (c *Client) DialConn(conn net.Conn, isConnect bool, destination M.Socksaddr) (*Conn, error) {
 	switch c.Version {
+	case Version3:
+		request := Request{
+			IsConnect:    isConnect,
+			Destination:  destination,
+			Capabilities: c.Capabilities,
+		}
+		err := WriteRequestV3(conn, request)
+		if err != nil {
+			return nil, err
+		}
+		return NewConnV3(conn, request), nil
 	case 0, Version:
 		request := Request{
 			IsConnect:   isConnect,
@@ -36,6 +58,12 @@ func (c *Client) DialConn(conn net.Conn, isConnect bool, destination M.Socksaddr
 
 func (c *Client) DialEarlyConn(conn net.Conn, isConnect bool, destination M.Socksaddr) (*Conn, error) {
 	switch c.Version {
+	case Version3:
+		return NewLazyConnV3(conn, Request{
+			IsConnect:    isConnect,
+			Destination:  destination,
+			Capabilities: c.Capabilities,
+		}), nil
 	case 0, Version:
 		request := Request{
 			IsConnect:   isConnect,
@@ -52,6 +80,9 @@ func (c *Client) DialEarlyConn(conn net.Conn, isConnect bool, destination M.Sock
 func (c *Client) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
 	switch N.NetworkName(network) {
 	case N.NetworkUDP:
+		if c.Multiplex {
+			return c.dialMux(ctx, Request{IsConnect: true, Destination: destination})
+		}
 		tcpConn, err := c.Dialer.DialContext(ctx, N.NetworkTCP, RequestDestination(c.Version))
 		if err != nil {
 			return nil, err
@@ -71,6 +102,9 @@ func (c *Client) DialContext(ctx context.Context, network string, destination M.
 }
 
 func (c *Client) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	if c.Multiplex {
+		return c.dialMux(ctx, Request{Destination: destination})
+	}
 	tcpConn, err := c.Dialer.DialContext(ctx, N.NetworkTCP, RequestDestination(c.Version))
 	if err != nil {
 		return nil, err
@@ -82,3 +116,38 @@ func (c *Client) ListenPacket(ctx context.Context, destination M.Socksaddr) (net
 	}
 	return uConn, nil
 }
+
+// dialMux dials outside of the lock, so a slow dial does not hold up sessions opened on an existing stream.
+func (c *Client) dialMux(ctx context.Context, request Request) (*muxConn, error) {
+	c.muxAccess.Lock()
+	mux := c.mux
+	c.muxAccess.Unlock()
+	if mux != nil {
+		conn, err := mux.open(request)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	tcpConn, err := c.Dialer.DialContext(ctx, N.NetworkTCP, M.Socksaddr{Fqdn: MagicAddressMux})
+	if err != nil {
+		return nil, err
+	}
+	idleTimeout := c.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultMuxIdleTimeout
+	}
+	newMux := newMuxClient(tcpConn, idleTimeout)
+	c.muxAccess.Lock()
+	if c.mux != mux {
+		// Another session has replaced the stream in the meantime.
+		conn, err := c.mux.open(request)
+		if err == nil {
+			c.muxAccess.Unlock()
+			newMux.close(false)
+			return conn, nil
+		}
+	}
+	c.mux = newMux
+	c.muxAccess.Unlock()
+	return newMux.open(request)
+}
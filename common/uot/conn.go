@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
@@ -15,8 +16,9 @@ import (
 )
 
 var (
-	_ N.NetPacketConn    = (*Conn)(nil)
-	_ N.PacketReadWaiter = (*Conn)(nil)
+	_ N.NetPacketConn     = (*Conn)(nil)
+	_ N.PacketReadWaiter  = (*Conn)(nil)
+	_ N.PacketBatchWriter = (*Conn)(nil)
 )
 
 type Conn struct {
@@ -26,6 +28,13 @@ type Conn struct {
 	writer          N.VectorisedWriter
 	readWaitOptions N.ReadWaitOptions
 	writeAccess     sync.Mutex
+
+	// frames is set for version 3.
+	frames           *frameReader
+	capabilities     uint8
+	capabilitiesRead bool
+	// negotiated holds the capabilities accepted by the server, once its reply has been read.
+	negotiated atomic.Uint32
 }
 
 func NewConn(conn net.Conn, request Request) *Conn {
@@ -48,6 +57,15 @@ func (c *Conn) Write(p []byte) (n int, err error) {
 }
 
 func (c *Conn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	if c.frames != nil {
+		buffer := buf.With(p)
+		var destination M.Socksaddr
+		destination, err = c.readPacketV3(buffer)
+		if err != nil {
+			return
+		}
+		return buffer.Len(), destination.UDPAddr(), nil
+	}
 	var destination M.Socksaddr
 	if c.isConnect {
 		destination = c.destination
@@ -74,6 +92,13 @@ func (c *Conn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 }
 
 func (c *Conn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if c.frames != nil {
+		err = c.writePacketsV3([]*buf.Buffer{buf.As(p)}, []M.Socksaddr{M.SocksaddrFromNet(addr)})
+		if err != nil {
+			return
+		}
+		return len(p), nil
+	}
 	c.writeAccess.Lock()
 	defer c.writeAccess.Unlock()
 
@@ -107,6 +132,9 @@ func (c *Conn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 }
 
 func (c *Conn) ReadPacket(buffer *buf.Buffer) (destination M.Socksaddr, err error) {
+	if c.frames != nil {
+		return c.readPacketV3(buffer)
+	}
 	if c.isConnect {
 		destination = c.destination
 	} else {
@@ -128,6 +156,9 @@ func (c *Conn) ReadPacket(buffer *buf.Buffer) (destination M.Socksaddr, err erro
 }
 
 func (c *Conn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	if c.frames != nil {
+		return c.writePacketsV3([]*buf.Buffer{buffer}, []M.Socksaddr{destination})
+	}
 	c.writeAccess.Lock()
 	defer c.writeAccess.Unlock()
 
@@ -0,0 +1,99 @@
+package uot
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// NewConnV3 creates the client side of a version 3 session whose request has been written.
+//
+// Until the capabilities accepted by the server are read, datagrams are sent one per frame without padding,
+// which every version 3 server accepts.
+func NewConnV3(conn net.Conn, request Request) *Conn {
+	return &Conn{
+		Conn:         conn,
+		isConnect:    request.IsConnect,
+		destination:  request.Destination,
+		writer:       bufio.NewVectorisedWriter(N.UnwrapWriter(conn)),
+		capabilities: request.Capabilities,
+		frames: &frameReader{
+			reader:      conn,
+			isConnect:   request.IsConnect,
+			destination: request.Destination,
+		},
+	}
+}
+
+// NewLazyConnV3 is like NewConnV3, but sends the request along with the first datagrams.
+func NewLazyConnV3(conn net.Conn, request Request) *Conn {
+	return NewConnV3(&LazyClientConn{
+		Conn:    conn,
+		request: request,
+		writer:  bufio.NewVectorisedWriter(conn),
+		version: Version3,
+	}, request)
+}
+
+func (c *Conn) readPacketV3(buffer *buf.Buffer) (M.Socksaddr, error) {
+	if !c.capabilitiesRead {
+		var capabilities [1]byte
+		_, err := io.ReadFull(c.Conn, capabilities[:])
+		if err != nil {
+			return M.Socksaddr{}, E.Cause(err, "UoT read capabilities")
+		}
+		c.negotiated.Store(uint32(capabilities[0] & c.capabilities))
+		c.capabilitiesRead = true
+	}
+	return c.frames.readPacket(buffer)
+}
+
+func (c *Conn) writePacketsV3(buffers []*buf.Buffer, destinations []M.Socksaddr) error {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	negotiated := c.negotiated.Load()
+	batchSize := 1
+	if negotiated&CapabilityBatch != 0 {
+		batchSize = maxFrameCount
+	}
+	return writeFrames(c.writer, buffers, destinations, c.isConnect, batchSize, negotiated&CapabilityPadding != 0)
+}
+
+// WritePacketBatch writes all datagrams with a single write, coalesced into frames in version 3.
+func (c *Conn) WritePacketBatch(buffers []*buf.Buffer, destinations []M.Socksaddr) error {
+	if c.frames != nil {
+		return c.writePacketsV3(buffers, destinations)
+	}
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	vectorised := make([]*buf.Buffer, 0, len(buffers)*2)
+	for index, buffer := range buffers {
+		var headerLen int
+		if !c.isConnect {
+			headerLen += AddrParser.AddrPortLen(destinations[index])
+		}
+		header := buf.NewSize(headerLen + 2)
+		if !c.isConnect {
+			err := AddrParser.WriteAddrPort(header, destinations[index])
+			if err != nil {
+				header.Release()
+				buf.ReleaseMulti(vectorised)
+				buf.ReleaseMulti(buffers[index:])
+				return err
+			}
+		}
+		common.Must(binary.Write(header, binary.BigEndian, uint16(buffer.Len())))
+		vectorised = append(vectorised, header, buffer)
+	}
+	if c.writer == nil {
+		return bufio.NewVectorisedWriter(c.Conn).WriteVectorised(vectorised)
+	}
+	return c.writer.WriteVectorised(vectorised)
+}
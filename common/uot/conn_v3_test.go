@@ -0,0 +1,99 @@
+package uot
+
+import (
+	"net"
+	"testing"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnV3(t *testing.T) {
+	t.Parallel()
+	t.Run("ipv4", func(t *testing.T) {
+		testConnV3(t, "127.0.0.1:0")
+	})
+	t.Run("ipv6", func(t *testing.T) {
+		testConnV3(t, "[::1]:0")
+	})
+}
+
+func testConnV3(t *testing.T, address string) {
+	echoConn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer echoConn.Close()
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, addr, err := echoConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			echoConn.WriteTo(buffer[:n], addr)
+		}
+	}()
+	echoAddr := M.SocksaddrFromNet(echoConn.LocalAddr())
+	for _, capabilities := range []uint8{0, CapabilityBatch, CapabilityBatch | CapabilityPadding} {
+		for _, isConnect := range []bool{false, true} {
+			serverUDPConn, err := net.ListenPacket("udp", address)
+			require.NoError(t, err)
+			clientConn, serverConn := net.Pipe()
+			uotServerConn := NewServerConn(serverUDPConn, Version3)
+			go func() {
+				buffer := make([]byte, 65535)
+				for {
+					n, err := serverConn.Read(buffer)
+					if err != nil {
+						return
+					}
+					_, err = uotServerConn.Write(buffer[:n])
+					if err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				buffer := make([]byte, 65535)
+				for {
+					n, err := uotServerConn.Read(buffer)
+					if err != nil {
+						return
+					}
+					_, err = serverConn.Write(buffer[:n])
+					if err != nil {
+						return
+					}
+				}
+			}()
+			client := &Client{Version: Version3, Capabilities: capabilities}
+			conn, err := client.DialEarlyConn(clientConn, isConnect, echoAddr)
+			require.NoError(t, err)
+			for round := 0; round < 2; round++ {
+				messages := []string{"first", "second", "third"}
+				var buffers []*buf.Buffer
+				var destinations []M.Socksaddr
+				for _, message := range messages {
+					buffers = append(buffers, buf.As([]byte(message)))
+					destinations = append(destinations, echoAddr)
+				}
+				require.NoError(t, conn.WritePacketBatch(buffers, destinations))
+				for range messages {
+					buffer := buf.NewPacket()
+					destination, err := conn.ReadPacket(buffer)
+					require.NoError(t, err)
+					require.Equal(t, echoAddr, destination)
+					require.Contains(t, messages, string(buffer.Bytes()))
+					buffer.Release()
+				}
+			}
+			require.Equal(t, uint32(capabilities), conn.negotiated.Load())
+			conn.Close()
+			uotServerConn.Close()
+			serverConn.Close()
+		}
+	}
+}
@@ -15,6 +15,16 @@ func (c *Conn) InitializeReadWaiter(options N.ReadWaitOptions) (needCopy bool) {
 }
 
 func (c *Conn) WaitReadPacket() (buffer *buf.Buffer, destination M.Socksaddr, err error) {
+	if c.frames != nil {
+		buffer = c.readWaitOptions.NewPacketBuffer()
+		destination, err = c.readPacketV3(buffer)
+		if err != nil {
+			buffer.Release()
+			return nil, M.Socksaddr{}, err
+		}
+		c.readWaitOptions.PostReturn(buffer)
+		return
+	}
 	if c.isConnect {
 		destination = c.destination
 	} else {
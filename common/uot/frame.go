@@ -0,0 +1,140 @@
+package uot
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// Version 3 carries datagrams in frames, each of which may hold several datagrams and random padding.
+//
+// Frame {
+//   Count (1),
+//   Padding Length (2),
+//   Datagram {
+//     Destination (..),  // omitted for connected sessions
+//     Length (2),
+//     Payload (..),
+//   }[Count],
+//   Padding (..),
+// }
+//
+// Frames with a count of zero only carry padding.
+
+const (
+	// CapabilityBatch allows frames with more than one datagram.
+	CapabilityBatch = 1 << 0
+	// CapabilityPadding allows random padding after every frame.
+	CapabilityPadding = 1 << 1
+
+	// Capabilities are the capabilities supported by this implementation.
+	Capabilities = CapabilityBatch | CapabilityPadding
+
+	frameHeaderLen = 1 + 2
+	maxFrameCount  = 255
+	maxPaddingLen  = 256
+)
+
+type frameReader struct {
+	reader      io.Reader
+	isConnect   bool
+	destination M.Socksaddr
+	remaining   uint8
+	padding     uint16
+}
+
+func (r *frameReader) readPacket(buffer *buf.Buffer) (destination M.Socksaddr, err error) {
+	for r.remaining == 0 {
+		if r.padding > 0 {
+			_, err = io.CopyN(io.Discard, r.reader, int64(r.padding))
+			if err != nil {
+				return
+			}
+			r.padding = 0
+		}
+		var header [frameHeaderLen]byte
+		_, err = io.ReadFull(r.reader, header[:])
+		if err != nil {
+			return
+		}
+		r.remaining = header[0]
+		r.padding = binary.BigEndian.Uint16(header[1:])
+	}
+	if r.isConnect {
+		destination = r.destination
+	} else {
+		destination, err = AddrParser.ReadAddrPort(r.reader)
+		if err != nil {
+			return
+		}
+	}
+	var length uint16
+	err = binary.Read(r.reader, binary.BigEndian, &length)
+	if err != nil {
+		return
+	}
+	if buffer.FreeLen() < int(length) {
+		return M.Socksaddr{}, E.Cause(io.ErrShortBuffer, "UoT read")
+	}
+	_, err = buffer.ReadFullFrom(r.reader, int(length))
+	if err != nil {
+		return M.Socksaddr{}, E.Cause(err, "UoT read")
+	}
+	r.remaining--
+	return
+}
+
+// encodeFrames encodes datagrams as frames of at most batchSize datagrams into vectorised buffers.
+// The payloads are included as they are, and are released on error.
+func encodeFrames(buffers []*buf.Buffer, destinations []M.Socksaddr, isConnect bool, batchSize int, padding bool) ([]*buf.Buffer, error) {
+	vectorised := make([]*buf.Buffer, 0, len(buffers)*2+(len(buffers)+batchSize-1)/batchSize*2)
+	for start := 0; start < len(buffers); start += batchSize {
+		end := min(start+batchSize, len(buffers))
+		var paddingLen int
+		if padding {
+			paddingLen = rand.IntN(maxPaddingLen)
+		}
+		header := buf.NewSize(frameHeaderLen)
+		common.Must(header.WriteByte(byte(end - start)))
+		binary.BigEndian.PutUint16(header.Extend(2), uint16(paddingLen))
+		vectorised = append(vectorised, header)
+		for index := start; index < end; index++ {
+			var datagramHeaderLen int
+			if !isConnect {
+				datagramHeaderLen += AddrParser.AddrPortLen(destinations[index])
+			}
+			datagramHeader := buf.NewSize(datagramHeaderLen + 2)
+			vectorised = append(vectorised, datagramHeader)
+			if !isConnect {
+				err := AddrParser.WriteAddrPort(datagramHeader, destinations[index])
+				if err != nil {
+					buf.ReleaseMulti(vectorised)
+					buf.ReleaseMulti(buffers[index:])
+					return nil, err
+				}
+			}
+			binary.BigEndian.PutUint16(datagramHeader.Extend(2), uint16(buffers[index].Len()))
+			vectorised = append(vectorised, buffers[index])
+		}
+		if paddingLen > 0 {
+			paddingBuffer := buf.NewSize(paddingLen)
+			paddingBuffer.WriteRandom(paddingLen)
+			vectorised = append(vectorised, paddingBuffer)
+		}
+	}
+	return vectorised, nil
+}
+
+func writeFrames(writer N.VectorisedWriter, buffers []*buf.Buffer, destinations []M.Socksaddr, isConnect bool, batchSize int, padding bool) error {
+	vectorised, err := encodeFrames(buffers, destinations, isConnect, batchSize, padding)
+	if err != nil {
+		return err
+	}
+	return writer.WriteVectorised(vectorised)
+}
@@ -16,6 +16,7 @@ type LazyClientConn struct {
 	request        Request
 	access         sync.Mutex
 	requestWritten atomic.Bool
+	version        uint8
 }
 
 func NewLazyClientConn(conn net.Conn, request Request) *LazyClientConn {
@@ -57,7 +58,15 @@ func (c *LazyClientConn) writeVectorised(buffers []*buf.Buffer) error {
 		return c.writer.WriteVectorised(buffers)
 	}
 
-	request, err := EncodeRequest(c.request)
+	var (
+		request *buf.Buffer
+		err     error
+	)
+	if c.version == Version3 {
+		request, err = EncodeRequestV3(c.request)
+	} else {
+		request, err = EncodeRequest(c.request)
+	}
 	if err != nil {
 		buf.ReleaseMulti(buffers)
 		return err
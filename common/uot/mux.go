@@ -0,0 +1,98 @@
+package uot
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// Multiplexed sessions share one stream to MagicAddressMux, which carries frames in both directions.
+//
+// Frame {
+//   Type (1),
+//   Session ID (4),
+//   Length (2),
+//   Body (..),
+// }
+//
+// Open is sent by the client before any data of a session, with a request as its body.
+// Data holds the destination, omitted for connected sessions, followed by the payload.
+// Close has no body and may be sent by either side.
+
+const (
+	MagicAddressMux       = "sp.mux.udp-over-tcp.arpa"
+	DefaultMuxIdleTimeout = 5 * time.Minute
+
+	muxFrameOpen  = 0
+	muxFrameData  = 1
+	muxFrameClose = 2
+
+	muxFrameHeaderLen = 1 + 4 + 2
+	muxMaxBodyLen     = 65535
+)
+
+type muxWriter struct {
+	access sync.Mutex
+	writer N.VectorisedWriter
+}
+
+func newMuxWriter(writer io.Writer) *muxWriter {
+	return &muxWriter{writer: bufio.NewVectorisedWriter(writer)}
+}
+
+// writeFrame writes a frame with the concatenation of body, which is released.
+func (w *muxWriter) writeFrame(frameType uint8, sessionID uint32, body ...*buf.Buffer) error {
+	bodyLen := buf.LenMulti(body)
+	if bodyLen > muxMaxBodyLen {
+		buf.ReleaseMulti(body)
+		return E.New("UoT mux: frame too large: ", bodyLen)
+	}
+	header := buf.NewSize(muxFrameHeaderLen)
+	common.Must(header.WriteByte(frameType))
+	binary.BigEndian.PutUint32(header.Extend(4), sessionID)
+	binary.BigEndian.PutUint16(header.Extend(2), uint16(bodyLen))
+	w.access.Lock()
+	defer w.access.Unlock()
+	return w.writer.WriteVectorised(append([]*buf.Buffer{header}, body...))
+}
+
+// writeFrameHeader fills the frame header in the front headroom of buffer and writes it.
+func (w *muxWriter) writeFrameHeader(frameType uint8, sessionID uint32, buffer *buf.Buffer) error {
+	if buffer.Len() > muxMaxBodyLen {
+		buffer.Release()
+		return E.New("UoT mux: frame too large: ", buffer.Len())
+	}
+	bodyLen := buffer.Len()
+	header := buffer.ExtendHeader(muxFrameHeaderLen)
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:], sessionID)
+	binary.BigEndian.PutUint16(header[5:], uint16(bodyLen))
+	w.access.Lock()
+	defer w.access.Unlock()
+	return w.writer.WriteVectorised([]*buf.Buffer{buffer})
+}
+
+func readMuxFrame(reader io.Reader) (frameType uint8, sessionID uint32, body *buf.Buffer, err error) {
+	var header [muxFrameHeaderLen]byte
+	_, err = io.ReadFull(reader, header[:])
+	if err != nil {
+		return
+	}
+	frameType = header[0]
+	sessionID = binary.BigEndian.Uint32(header[1:])
+	bodyLen := int(binary.BigEndian.Uint16(header[5:]))
+	body = buf.NewSize(bodyLen)
+	_, err = body.ReadFullFrom(reader, bodyLen)
+	if err != nil {
+		body.Release()
+		return 0, 0, nil, E.Cause(err, "UoT mux read")
+	}
+	return
+}
@@ -0,0 +1,346 @@
+package uot
+
+import (
+	std_bufio "bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/canceler"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/pipe"
+)
+
+// muxClient is a stream of multiplexed sessions, closed once it has been without sessions for the idle timeout.
+type muxClient struct {
+	conn        net.Conn
+	writer      *muxWriter
+	idleTimeout time.Duration
+	access      sync.Mutex
+	sessions    map[uint32]*muxConn
+	nextID      uint32
+	closed      bool
+	idleTimer   *time.Timer
+}
+
+func newMuxClient(conn net.Conn, idleTimeout time.Duration) *muxClient {
+	client := &muxClient{
+		conn:        conn,
+		writer:      newMuxWriter(conn),
+		idleTimeout: idleTimeout,
+		sessions:    make(map[uint32]*muxConn),
+	}
+	go client.loopRead()
+	return client
+}
+
+func (c *muxClient) open(request Request) (*muxConn, error) {
+	requestBuffer, err := EncodeRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	c.access.Lock()
+	if c.closed {
+		c.access.Unlock()
+		requestBuffer.Release()
+		return nil, net.ErrClosed
+	}
+	c.nextID++
+	session := newMuxConn(c, c.nextID, request)
+	c.sessions[session.sessionID] = session
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	c.access.Unlock()
+	err = c.writer.writeFrame(muxFrameOpen, session.sessionID, requestBuffer)
+	if err != nil {
+		c.close(false)
+		return nil, err
+	}
+	return session, nil
+}
+
+func (c *muxClient) loopRead() {
+	reader := std_bufio.NewReader(c.conn)
+	for {
+		frameType, sessionID, body, err := readMuxFrame(reader)
+		if err != nil {
+			c.close(false)
+			return
+		}
+		c.access.Lock()
+		session := c.sessions[sessionID]
+		c.access.Unlock()
+		if session == nil {
+			body.Release()
+			continue
+		}
+		switch frameType {
+		case muxFrameData:
+			session.deliver(body)
+		case muxFrameClose:
+			body.Release()
+			session.close(false)
+		default:
+			body.Release()
+		}
+	}
+}
+
+func (c *muxClient) remove(session *muxConn, sendClose bool) {
+	c.access.Lock()
+	if c.sessions[session.sessionID] != session {
+		c.access.Unlock()
+		return
+	}
+	delete(c.sessions, session.sessionID)
+	if len(c.sessions) == 0 && !c.closed {
+		c.idleTimer = time.AfterFunc(c.idleTimeout, func() {
+			c.close(true)
+		})
+	}
+	closed := c.closed
+	c.access.Unlock()
+	if sendClose && !closed {
+		c.writer.writeFrame(muxFrameClose, session.sessionID)
+	}
+}
+
+// close closes the stream and all of its sessions, or only an idle stream if onlyIdle is set.
+func (c *muxClient) close(onlyIdle bool) {
+	c.access.Lock()
+	if c.closed || onlyIdle && len(c.sessions) > 0 {
+		c.access.Unlock()
+		return
+	}
+	c.closed = true
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	sessions := make([]*muxConn, 0, len(c.sessions))
+	for _, session := range c.sessions {
+		sessions = append(sessions, session)
+	}
+	c.access.Unlock()
+	c.conn.Close()
+	for _, session := range sessions {
+		session.close(false)
+	}
+}
+
+var (
+	_ N.NetPacketConn     = (*muxConn)(nil)
+	_ N.PacketReadWaiter  = (*muxConn)(nil)
+	_ canceler.PacketConn = (*muxConn)(nil)
+)
+
+// muxConn is a session of a multiplexed stream, closed when it has been idle for the idle timeout.
+type muxConn struct {
+	client          *muxClient
+	sessionID       uint32
+	isConnect       bool
+	destination     M.Socksaddr
+	ctx             context.Context
+	idle            *canceler.Instance
+	packetChan      chan *N.PacketBuffer
+	readDeadline    pipe.Deadline
+	readWaitOptions N.ReadWaitOptions
+	dropped         atomic.Uint64
+	closeOnce       sync.Once
+}
+
+func newMuxConn(client *muxClient, sessionID uint32, request Request) *muxConn {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	conn := &muxConn{
+		client:       client,
+		sessionID:    sessionID,
+		isConnect:    request.IsConnect,
+		destination:  request.Destination,
+		ctx:          ctx,
+		idle:         canceler.New(ctx, cancel, client.idleTimeout),
+		packetChan:   make(chan *N.PacketBuffer, 64),
+		readDeadline: pipe.MakeDeadline(),
+	}
+	context.AfterFunc(ctx, func() {
+		conn.close(true)
+	})
+	return conn
+}
+
+func (c *muxConn) deliver(body *buf.Buffer) {
+	destination := c.destination
+	if !c.isConnect {
+		var err error
+		destination, err = AddrParser.ReadAddrPort(body)
+		if err != nil {
+			body.Release()
+			return
+		}
+	}
+	c.idle.Update()
+	packet := N.NewPacketBuffer()
+	*packet = N.PacketBuffer{
+		Buffer:      body,
+		Destination: destination,
+	}
+	select {
+	case c.packetChan <- packet:
+	default:
+		packet.Buffer.Release()
+		N.PutPacketBuffer(packet)
+		c.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of packets dropped because the session was not read fast enough.
+func (c *muxConn) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+func (c *muxConn) Read(p []byte) (n int, err error) {
+	n, _, err = c.ReadFrom(p)
+	return
+}
+
+func (c *muxConn) Write(p []byte) (n int, err error) {
+	return c.WriteTo(p, c.destination)
+}
+
+func (c *muxConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	buffer := buf.With(p)
+	destination, err := c.ReadPacket(buffer)
+	if err != nil {
+		return
+	}
+	return buffer.Len(), destination.UDPAddr(), nil
+}
+
+func (c *muxConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	err = c.WritePacket(buf.As(p), M.SocksaddrFromNet(addr))
+	if err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+func (c *muxConn) ReadPacket(buffer *buf.Buffer) (destination M.Socksaddr, err error) {
+	select {
+	case packet := <-c.packetChan:
+		if packet.Buffer.Len() > buffer.FreeLen() {
+			err = io.ErrShortBuffer
+		} else {
+			common.Must1(buffer.Write(packet.Buffer.Bytes()))
+			destination = packet.Destination
+		}
+		packet.Buffer.Release()
+		N.PutPacketBuffer(packet)
+		return
+	case <-c.ctx.Done():
+		return M.Socksaddr{}, net.ErrClosed
+	case <-c.readDeadline.Wait():
+		return M.Socksaddr{}, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *muxConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	select {
+	case <-c.ctx.Done():
+		buffer.Release()
+		return net.ErrClosed
+	default:
+	}
+	var header *buf.Buffer
+	if !c.isConnect {
+		header = buf.NewSize(AddrParser.AddrPortLen(destination))
+		err := AddrParser.WriteAddrPort(header, destination)
+		if err != nil {
+			header.Release()
+			buffer.Release()
+			return err
+		}
+	} else {
+		header = buf.NewSize(0)
+	}
+	err := c.client.writer.writeFrame(muxFrameData, c.sessionID, header, buffer)
+	if err != nil {
+		return err
+	}
+	c.idle.Update()
+	return nil
+}
+
+func (c *muxConn) InitializeReadWaiter(options N.ReadWaitOptions) (needCopy bool) {
+	c.readWaitOptions = options
+	return false
+}
+
+func (c *muxConn) WaitReadPacket() (buffer *buf.Buffer, destination M.Socksaddr, err error) {
+	select {
+	case packet := <-c.packetChan:
+		buffer = c.readWaitOptions.Copy(packet.Buffer)
+		destination = packet.Destination
+		N.PutPacketBuffer(packet)
+		return
+	case <-c.ctx.Done():
+		return nil, M.Socksaddr{}, net.ErrClosed
+	case <-c.readDeadline.Wait():
+		return nil, M.Socksaddr{}, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *muxConn) Timeout() time.Duration {
+	return c.idle.Timeout()
+}
+
+func (c *muxConn) SetTimeout(timeout time.Duration) bool {
+	return c.idle.SetTimeout(timeout)
+}
+
+func (c *muxConn) close(sendClose bool) {
+	c.closeOnce.Do(func() {
+		c.idle.Close()
+		c.client.remove(c, sendClose)
+	})
+}
+
+func (c *muxConn) Close() error {
+	c.close(true)
+	return nil
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.client.conn.LocalAddr()
+}
+
+func (c *muxConn) RemoteAddr() net.Addr {
+	return c.destination
+}
+
+func (c *muxConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+func (c *muxConn) SetWriteDeadline(t time.Time) error {
+	return os.ErrInvalid
+}
+
+func (c *muxConn) NeedAdditionalReadDeadline() bool {
+	return false
+}
+
+func (c *muxConn) Upstream() any {
+	return c.client.conn
+}
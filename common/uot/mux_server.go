@@ -0,0 +1,227 @@
+package uot
+
+import (
+	std_bufio "bufio"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	"github.com/sagernet/sing/common/canceler"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const (
+	DefaultMuxMaxSessions = 256
+	muxFrontHeadroom      = muxFrameHeaderLen + M.MaxSocksaddrLength
+)
+
+type MuxServerOptions struct {
+	ServerOptions
+	// ListenPacket creates the socket of a session, defaults to a UDP socket on an unspecified address.
+	// It is called from the read loop of the stream.
+	ListenPacket func(ctx context.Context, request Request) (net.PacketConn, error)
+	// IdleTimeout closes sessions without traffic, defaults to DefaultMuxIdleTimeout.
+	IdleTimeout time.Duration
+	// MaxSessions limits the open sessions of a stream, defaults to DefaultMuxMaxSessions.
+	// Sessions opened over the limit are closed immediately.
+	MaxSessions int
+}
+
+// ServeMux serves the multiplexed sessions of a stream to MagicAddressMux until the stream or ctx is closed.
+func ServeMux(ctx context.Context, conn net.Conn, options MuxServerOptions) error {
+	if options.ListenPacket == nil {
+		options.ListenPacket = func(ctx context.Context, request Request) (net.PacketConn, error) {
+			return new(net.ListenConfig).ListenPacket(ctx, N.NetworkUDP, "")
+		}
+	}
+	if options.IdleTimeout == 0 {
+		options.IdleTimeout = DefaultMuxIdleTimeout
+	}
+	if options.MaxSessions == 0 {
+		options.MaxSessions = DefaultMuxMaxSessions
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	server := &muxServer{
+		ctx:      ctx,
+		cancel:   cancel,
+		conn:     conn,
+		writer:   newMuxWriter(conn),
+		options:  options,
+		sessions: make(map[uint32]*muxServerSession),
+	}
+	defer server.close()
+	reader := std_bufio.NewReader(conn)
+	for {
+		frameType, sessionID, body, err := readMuxFrame(reader)
+		if err != nil {
+			if E.IsClosedOrCanceled(err) || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		switch frameType {
+		case muxFrameOpen:
+			server.open(sessionID, body)
+		case muxFrameData:
+			server.data(sessionID, body)
+		case muxFrameClose:
+			body.Release()
+			server.access.Lock()
+			session := server.sessions[sessionID]
+			server.access.Unlock()
+			if session != nil {
+				session.close(false)
+			}
+		default:
+			body.Release()
+		}
+	}
+}
+
+type muxServer struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	conn     net.Conn
+	writer   *muxWriter
+	options  MuxServerOptions
+	access   sync.Mutex
+	sessions map[uint32]*muxServerSession
+}
+
+func (s *muxServer) open(sessionID uint32, body *buf.Buffer) {
+	request, err := ReadRequest(body)
+	body.Release()
+	s.access.Lock()
+	_, loaded := s.sessions[sessionID]
+	sessionCount := len(s.sessions)
+	s.access.Unlock()
+	if loaded {
+		return
+	}
+	if err != nil || sessionCount >= s.options.MaxSessions {
+		s.writer.writeFrame(muxFrameClose, sessionID)
+		return
+	}
+	packetConn, err := s.options.ListenPacket(s.ctx, *request)
+	if err != nil {
+		s.writer.writeFrame(muxFrameClose, sessionID)
+		return
+	}
+	session := &muxServerSession{
+		server:      s,
+		sessionID:   sessionID,
+		isConnect:   request.IsConnect,
+		destination: request.Destination,
+		packetConn:  bufio.NewPacketConn(packetConn),
+	}
+	ctx, cancel := context.WithCancelCause(s.ctx)
+	session.idle = canceler.New(ctx, cancel, s.options.IdleTimeout)
+	session.writer = newResolveWriter(ctx, session.packetConn, s.options.ServerOptions, func() {
+		session.close(true)
+	})
+	context.AfterFunc(ctx, func() {
+		session.close(true)
+	})
+	s.access.Lock()
+	s.sessions[sessionID] = session
+	s.access.Unlock()
+	go session.loopReply()
+}
+
+func (s *muxServer) data(sessionID uint32, body *buf.Buffer) {
+	s.access.Lock()
+	session := s.sessions[sessionID]
+	s.access.Unlock()
+	if session == nil {
+		body.Release()
+		return
+	}
+	destination := session.destination
+	if !session.isConnect {
+		var err error
+		destination, err = AddrParser.ReadAddrPort(body)
+		if err != nil {
+			body.Release()
+			return
+		}
+	}
+	err := session.writer.WritePacket(body, destination)
+	if err != nil {
+		session.close(true)
+		return
+	}
+	session.idle.Update()
+}
+
+func (s *muxServer) close() {
+	s.cancel()
+	s.conn.Close()
+	s.access.Lock()
+	sessions := make([]*muxServerSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.access.Unlock()
+	for _, session := range sessions {
+		session.close(false)
+	}
+}
+
+type muxServerSession struct {
+	server      *muxServer
+	sessionID   uint32
+	isConnect   bool
+	destination M.Socksaddr
+	packetConn  N.NetPacketConn
+	writer      *resolveWriter
+	idle        *canceler.Instance
+	closeOnce   sync.Once
+}
+
+func (s *muxServerSession) loopReply() {
+	readWaitOptions := N.ReadWaitOptions{FrontHeadroom: muxFrontHeadroom}
+	var readWaiter N.PacketReadWaiter
+	if waiter, isReadWaiter := bufio.CreatePacketReadWaiter(s.packetConn); isReadWaiter && !waiter.InitializeReadWaiter(readWaitOptions) {
+		readWaiter = waiter
+	}
+	for {
+		buffer, destination, err := waitReadPacket(s.packetConn, readWaiter, readWaitOptions)
+		if err != nil {
+			s.close(true)
+			return
+		}
+		if !s.isConnect {
+			err = AddrParser.WriteAddrPort(buf.With(buffer.ExtendHeader(AddrParser.AddrPortLen(destination))), destination)
+			if err != nil {
+				buffer.Release()
+				continue
+			}
+		}
+		err = s.server.writer.writeFrameHeader(muxFrameData, s.sessionID, buffer)
+		if err != nil {
+			s.server.close()
+			return
+		}
+		s.idle.Update()
+	}
+}
+
+func (s *muxServerSession) close(sendClose bool) {
+	s.closeOnce.Do(func() {
+		s.idle.Close()
+		s.packetConn.Close()
+		s.server.access.Lock()
+		if s.server.sessions[s.sessionID] == s {
+			delete(s.server.sessions, s.sessionID)
+		}
+		s.server.access.Unlock()
+		if sendClose && s.server.ctx.Err() == nil {
+			s.server.writer.writeFrame(muxFrameClose, s.sessionID)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package uot
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+
+	"github.com/stretchr/testify/require"
+)
+
+type muxTestDialer struct {
+	dials   atomic.Int32
+	options MuxServerOptions
+	// blockFirst holds the first dial until it is closed.
+	blockFirst chan struct{}
+}
+
+func (d *muxTestDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	if d.dials.Add(1) == 1 && d.blockFirst != nil {
+		<-d.blockFirst
+	}
+	clientConn, serverConn := net.Pipe()
+	options := d.options
+	if options.IdleTimeout == 0 {
+		options.IdleTimeout = 200 * time.Millisecond
+	}
+	go ServeMux(context.Background(), serverConn, options)
+	return clientConn, nil
+}
+
+func (d *muxTestDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return nil, net.ErrClosed
+}
+
+func testEchoServer(t *testing.T) M.Socksaddr {
+	echoConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		echoConn.Close()
+	})
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, addr, err := echoConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			echoConn.WriteTo(buffer[:n], addr)
+		}
+	}()
+	return M.SocksaddrFromNet(echoConn.LocalAddr())
+}
+
+func TestMux(t *testing.T) {
+	t.Parallel()
+	echoAddr := testEchoServer(t)
+	dialer := &muxTestDialer{}
+	client := &Client{Dialer: dialer, Multiplex: true, IdleTimeout: 200 * time.Millisecond}
+	ctx := context.Background()
+
+	conn, err := client.DialContext(ctx, "udp", echoAddr)
+	require.NoError(t, err)
+	packetConn, err := client.ListenPacket(ctx, echoAddr)
+	require.NoError(t, err)
+	for _, message := range []string{"first", "second"} {
+		_, err = conn.Write([]byte(message))
+		require.NoError(t, err)
+		_, err = packetConn.WriteTo([]byte(message), echoAddr.UDPAddr())
+		require.NoError(t, err)
+		buffer := make([]byte, 64)
+		n, err := conn.Read(buffer)
+		require.NoError(t, err)
+		require.Equal(t, message, string(buffer[:n]))
+		n, addr, err := packetConn.ReadFrom(buffer)
+		require.NoError(t, err)
+		require.Equal(t, message, string(buffer[:n]))
+		require.Equal(t, echoAddr, M.SocksaddrFromNet(addr))
+	}
+	require.Equal(t, int32(1), dialer.dials.Load())
+
+	require.NoError(t, packetConn.Close())
+	_, _, err = packetConn.ReadFrom(make([]byte, 64))
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	buffer := buf.NewPacket()
+	defer buffer.Release()
+	_, err = conn.(*muxConn).ReadPacket(buffer)
+	require.ErrorIs(t, err, net.ErrClosed, "idle session should be closed")
+	time.Sleep(500 * time.Millisecond)
+	conn, err = client.DialContext(ctx, "udp", echoAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, int32(2), dialer.dials.Load(), "idle stream should be closed")
+}
+
+func TestMuxMaxSessions(t *testing.T) {
+	t.Parallel()
+	echoAddr := testEchoServer(t)
+	client := &Client{Dialer: &muxTestDialer{options: MuxServerOptions{MaxSessions: 1}}, Multiplex: true}
+	ctx := context.Background()
+	conn, err := client.DialContext(ctx, "udp", echoAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	rejectedConn, err := client.DialContext(ctx, "udp", echoAddr)
+	require.NoError(t, err)
+	defer rejectedConn.Close()
+	_, err = rejectedConn.Write([]byte("rejected"))
+	require.NoError(t, err)
+	_, err = rejectedConn.Read(make([]byte, 64))
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	_, err = conn.Write([]byte("accepted"))
+	require.NoError(t, err)
+	buffer := make([]byte, 64)
+	n, err := conn.Read(buffer)
+	require.NoError(t, err)
+	require.Equal(t, "accepted", string(buffer[:n]))
+}
+
+func TestMuxShortBuffer(t *testing.T) {
+	t.Parallel()
+	echoAddr := testEchoServer(t)
+	client := &Client{Dialer: &muxTestDialer{}, Multiplex: true}
+	conn, err := client.DialContext(context.Background(), "udp", echoAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("truncated"))
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 4))
+	require.ErrorIs(t, err, io.ErrShortBuffer)
+}
+
+func TestMuxSlowDial(t *testing.T) {
+	t.Parallel()
+	echoAddr := testEchoServer(t)
+	dialer := &muxTestDialer{blockFirst: make(chan struct{})}
+	client := &Client{Dialer: dialer, Multiplex: true}
+	ctx := context.Background()
+	slowDone := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := client.DialContext(ctx, "udp", echoAddr)
+		slowDone <- conn
+	}()
+	require.Eventually(t, func() bool {
+		return dialer.dials.Load() == 1
+	}, time.Second, 5*time.Millisecond)
+	dialDone := make(chan error, 1)
+	go func() {
+		conn, err := client.DialContext(ctx, "udp", echoAddr)
+		if err == nil {
+			conn.Close()
+		}
+		dialDone <- err
+	}()
+	select {
+	case err := <-dialDone:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("a slow dial should not block other sessions")
+	}
+	close(dialer.blockFirst)
+	conn := <-slowDone
+	require.NotNil(t, conn)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buffer := make([]byte, 64)
+	n, err := conn.Read(buffer)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buffer[:n]))
+}
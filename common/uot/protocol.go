@@ -10,8 +10,10 @@ import (
 )
 
 const (
+	Version3           = 3
 	Version            = 2
 	LegacyVersion      = 1
+	MagicAddressV3     = "sp.v3.udp-over-tcp.arpa"
 	MagicAddress       = "sp.v2.udp-over-tcp.arpa"
 	LegacyMagicAddress = "sp.udp-over-tcp.arpa"
 )
@@ -24,6 +26,8 @@ var AddrParser = M.NewSerializer(
 
 func RequestDestination(version uint8) M.Socksaddr {
 	switch version {
+	case Version3:
+		return M.Socksaddr{Fqdn: MagicAddressV3}
 	case 0, Version:
 		return M.Socksaddr{Fqdn: MagicAddress}
 	default:
@@ -36,6 +40,8 @@ func RequestDestination(version uint8) M.Socksaddr {
 type Request struct {
 	IsConnect   bool
 	Destination M.Socksaddr
+	// Capabilities are the features requested by the client, only sent in version 3.
+	Capabilities uint8
 }
 
 func ReadRequest(reader io.Reader) (*Request, error) {
@@ -73,3 +79,36 @@ func WriteRequest(writer io.Writer, request Request) error {
 	defer buffer.Release()
 	return common.Error(writer.Write(buffer.Bytes()))
 }
+
+func ReadRequestV3(reader io.Reader) (*Request, error) {
+	request, err := ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &request.Capabilities)
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+func EncodeRequestV3(request Request) (*buf.Buffer, error) {
+	buffer := buf.NewSize(1 + M.SocksaddrSerializer.AddrPortLen(request.Destination) + 1)
+	common.Must(binary.Write(buffer, binary.BigEndian, request.IsConnect))
+	err := M.SocksaddrSerializer.WriteAddrPort(buffer, request.Destination)
+	if err != nil {
+		buffer.Release()
+		return nil, err
+	}
+	common.Must(buffer.WriteByte(request.Capabilities))
+	return buffer, nil
+}
+
+func WriteRequestV3(writer io.Writer, request Request) error {
+	buffer, err := EncodeRequestV3(request)
+	if err != nil {
+		return err
+	}
+	defer buffer.Release()
+	return common.Error(writer.Write(buffer.Bytes()))
+}
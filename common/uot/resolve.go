@@ -0,0 +1,151 @@
+package uot
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const (
+	DefaultResolveCacheTTL = 10 * time.Minute
+
+	// maxPendingPackets bounds the datagrams queued for a domain while it is being resolved.
+	maxPendingPackets = 64
+	maxCachedAddrs    = 1024
+)
+
+// Resolver is satisfied by *net.Resolver.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network string, host string) ([]netip.Addr, error)
+}
+
+// resolveWriter writes datagrams to domain destinations once they are resolved.
+// Domains are resolved in the background, one lookup per domain,
+// so a slow lookup only delays the datagrams to that domain.
+type resolveWriter struct {
+	ctx      context.Context
+	writer   N.PacketWriter
+	resolver Resolver
+	cacheTTL time.Duration
+	// onError is called if a queued datagram could not be written.
+	onError func()
+	access  sync.Mutex
+	cache   map[string]cachedAddr
+	pending map[string][]pendingPacket
+}
+
+type cachedAddr struct {
+	addr     netip.Addr
+	expireAt time.Time
+}
+
+type pendingPacket struct {
+	buffer *buf.Buffer
+	port   uint16
+}
+
+func newResolveWriter(ctx context.Context, writer N.PacketWriter, options ServerOptions, onError func()) *resolveWriter {
+	w := &resolveWriter{
+		ctx:      ctx,
+		writer:   writer,
+		resolver: options.Resolver,
+		cacheTTL: options.CacheTTL,
+		onError:  onError,
+		cache:    make(map[string]cachedAddr),
+		pending:  make(map[string][]pendingPacket),
+	}
+	if w.resolver == nil {
+		w.resolver = net.DefaultResolver
+	}
+	if w.cacheTTL == 0 {
+		w.cacheTTL = DefaultResolveCacheTTL
+	}
+	return w
+}
+
+func (w *resolveWriter) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	if destination.IsFqdn() {
+		addr, loaded := w.lookupCache(destination.Fqdn)
+		if !loaded {
+			w.resolve(buffer, destination)
+			return nil
+		}
+		destination = M.SocksaddrFrom(addr, destination.Port)
+	}
+	return w.writer.WritePacket(buffer, destination)
+}
+
+func (w *resolveWriter) lookupCache(domain string) (netip.Addr, bool) {
+	w.access.Lock()
+	defer w.access.Unlock()
+	cached, loaded := w.cache[domain]
+	if !loaded {
+		return netip.Addr{}, false
+	}
+	if time.Now().After(cached.expireAt) {
+		delete(w.cache, domain)
+		return netip.Addr{}, false
+	}
+	return cached.addr, true
+}
+
+// resolve queues buffer until the domain is resolved, starting the lookup if none is in progress.
+func (w *resolveWriter) resolve(buffer *buf.Buffer, destination M.Socksaddr) {
+	w.access.Lock()
+	queue, resolving := w.pending[destination.Fqdn]
+	if len(queue) >= maxPendingPackets {
+		w.access.Unlock()
+		buffer.Release()
+		return
+	}
+	w.pending[destination.Fqdn] = append(queue, pendingPacket{buffer, destination.Port})
+	w.access.Unlock()
+	if !resolving {
+		go w.loopResolve(destination.Fqdn)
+	}
+}
+
+func (w *resolveWriter) loopResolve(domain string) {
+	addrs, err := w.resolver.LookupNetIP(w.ctx, "ip", domain)
+	var addr netip.Addr
+	if err == nil && len(addrs) > 0 {
+		addr = addrs[0].Unmap()
+	}
+	w.access.Lock()
+	queue := w.pending[domain]
+	delete(w.pending, domain)
+	if addr.IsValid() {
+		if len(w.cache) >= maxCachedAddrs {
+			now := time.Now()
+			for cachedDomain, cached := range w.cache {
+				if now.After(cached.expireAt) {
+					delete(w.cache, cachedDomain)
+				}
+			}
+		}
+		if len(w.cache) < maxCachedAddrs {
+			w.cache[domain] = cachedAddr{addr, time.Now().Add(w.cacheTTL)}
+		}
+	}
+	w.access.Unlock()
+	for index, packet := range queue {
+		if !addr.IsValid() {
+			packet.buffer.Release()
+			continue
+		}
+		err = w.writer.WritePacket(packet.buffer, M.SocksaddrFrom(addr, packet.port))
+		if err != nil {
+			for _, remaining := range queue[index+1:] {
+				remaining.buffer.Release()
+			}
+			w.onError()
+			return
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package uot
+
+import (
+	"context"
+	"net"
+
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var _ N.TCPConnectionHandlerEx = (*Router)(nil)
+
+// Router serves the streams to the magic addresses of every protocol version and of multiplexing,
+// and passes other connections to its handler.
+type Router struct {
+	handler N.TCPConnectionHandlerEx
+	options MuxServerOptions
+}
+
+// NewRouter creates a Router. options.ListenPacket also creates the sockets of streams that are not multiplexed,
+// and is called with an empty request for them, since their request is read later.
+func NewRouter(handler N.TCPConnectionHandlerEx, options MuxServerOptions) *Router {
+	if options.ListenPacket == nil {
+		options.ListenPacket = func(ctx context.Context, request Request) (net.PacketConn, error) {
+			return new(net.ListenConfig).ListenPacket(ctx, N.NetworkUDP, "")
+		}
+	}
+	return &Router{handler, options}
+}
+
+func (r *Router) NewConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	var version int
+	switch destination.Fqdn {
+	case MagicAddressMux:
+		go func() {
+			err := ServeMux(ctx, conn, r.options)
+			conn.Close()
+			if onClose != nil {
+				onClose(err)
+			}
+		}()
+		return
+	case MagicAddressV3:
+		version = Version3
+	case MagicAddress:
+		version = Version
+	case LegacyMagicAddress:
+		version = LegacyVersion
+	default:
+		r.handler.NewConnectionEx(ctx, conn, source, destination, onClose)
+		return
+	}
+	packetConn, err := r.options.ListenPacket(ctx, Request{})
+	if err != nil {
+		N.CloseOnHandshakeFailure(conn, onClose, err)
+		return
+	}
+	serverConn := NewServerConnWithOptions(packetConn, version, r.options.ServerOptions)
+	go func() {
+		err := bufio.CopyConn(ctx, conn, serverConn)
+		if onClose != nil {
+			onClose(err)
+		}
+	}()
+}
@@ -0,0 +1,64 @@
+package uot
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/stretchr/testify/require"
+)
+
+type routerTestHandler struct {
+	destinations chan M.Socksaddr
+}
+
+func (h *routerTestHandler) NewConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	conn.Close()
+	h.destinations <- destination
+}
+
+type routerTestDialer struct {
+	router *Router
+}
+
+func (d *routerTestDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	clientConn, serverConn := net.Pipe()
+	d.router.NewConnectionEx(context.Background(), serverConn, M.Socksaddr{}, destination, nil)
+	return clientConn, nil
+}
+
+func (d *routerTestDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return nil, net.ErrClosed
+}
+
+func TestRouter(t *testing.T) {
+	t.Parallel()
+	echoAddr := testEchoServer(t)
+	handler := &routerTestHandler{destinations: make(chan M.Socksaddr, 1)}
+	dialer := &routerTestDialer{router: NewRouter(handler, MuxServerOptions{})}
+	for _, client := range []*Client{
+		{Dialer: dialer, Version: LegacyVersion},
+		{Dialer: dialer, Version: Version},
+		{Dialer: dialer, Version: Version3},
+		{Dialer: dialer, Multiplex: true},
+	} {
+		conn, err := client.ListenPacket(context.Background(), echoAddr)
+		require.NoError(t, err)
+		_, err = conn.WriteTo([]byte("ping"), echoAddr.UDPAddr())
+		require.NoError(t, err)
+		buffer := make([]byte, 64)
+		n, addr, err := conn.ReadFrom(buffer)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(buffer[:n]))
+		require.Equal(t, echoAddr, M.SocksaddrFromNet(addr))
+		conn.Close()
+	}
+	destination := M.ParseSocksaddr("example.com:443")
+	conn, err := dialer.DialContext(context.Background(), N.NetworkTCP, destination)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, destination, <-handler.destinations)
+}
@@ -1,128 +1,277 @@
 package uot
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"io"
+	"math/rand/v2"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
 	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
 )
 
+const serverFrontHeadroom = frameHeaderLen + M.MaxSocksaddrLength + 2
+
+type ServerOptions struct {
+	// Resolver resolves domain destinations, defaults to net.DefaultResolver.
+	Resolver Resolver
+	// CacheTTL is how long resolved addresses are reused, defaults to DefaultResolveCacheTTL.
+	CacheTTL time.Duration
+}
+
+var _ net.Conn = (*ServerConn)(nil)
+
+// ServerConn is the server side of a session: the client stream is written to it and the replies are read from it.
+//
+// Datagrams are decoded and sent within Write, except those to domains that are still being resolved.
 type ServerConn struct {
-	net.PacketConn
-	version                   int
-	isConnect                 bool
-	destination               M.Socksaddr
-	inputReader, outputReader *io.PipeReader
-	inputWriter, outputWriter *io.PipeWriter
+	packetConn      N.NetPacketConn
+	readWaiter      N.PacketReadWaiter
+	readWaitOptions N.ReadWaitOptions
+	writer          *resolveWriter
+	version         int
+	ctx             context.Context
+	cancel          context.CancelFunc
+	ready           chan struct{}
+
+	inputAccess  sync.Mutex
+	input        []byte
+	requestRead  bool
+	isConnect    bool
+	destination  M.Socksaddr
+	capabilities uint8
+	frames       frameReader
+
+	outputAccess        sync.Mutex
+	output              *buf.Buffer
+	capabilitiesWritten bool
 }
 
 func NewServerConn(packetConn net.PacketConn, version int) net.Conn {
+	return NewServerConnWithOptions(packetConn, version, ServerOptions{})
+}
+
+func NewServerConnWithOptions(packetConn net.PacketConn, version int, options ServerOptions) *ServerConn {
+	ctx, cancel := context.WithCancel(context.Background())
 	c := &ServerConn{
-		PacketConn: packetConn,
+		packetConn: bufio.NewPacketConn(packetConn),
 		version:    version,
+		ctx:        ctx,
+		cancel:     cancel,
+		ready:      make(chan struct{}),
+		readWaitOptions: N.ReadWaitOptions{
+			FrontHeadroom: serverFrontHeadroom,
+			RearHeadroom:  maxPaddingLen,
+		},
+	}
+	c.writer = newResolveWriter(ctx, c.packetConn, options, func() {
+		c.Close()
+	})
+	if readWaiter, isReadWaiter := bufio.CreatePacketReadWaiter(c.packetConn); isReadWaiter && !readWaiter.InitializeReadWaiter(c.readWaitOptions) {
+		c.readWaiter = readWaiter
+	}
+	if version != Version && version != Version3 {
+		c.requestRead = true
+		close(c.ready)
 	}
-	c.inputReader, c.inputWriter = io.Pipe()
-	c.outputReader, c.outputWriter = io.Pipe()
-	go c.loopInput()
-	go c.loopOutput()
 	return c
 }
 
-func (c *ServerConn) Read(b []byte) (n int, err error) {
-	return c.outputReader.Read(b)
-}
-
+// Write decodes the client stream and sends every complete datagram in it.
 func (c *ServerConn) Write(b []byte) (n int, err error) {
-	return c.inputWriter.Write(b)
-}
-
-func (c *ServerConn) RemoteAddr() net.Addr {
-	return M.Socksaddr{Fqdn: "pipe"}
+	c.inputAccess.Lock()
+	defer c.inputAccess.Unlock()
+	c.input = append(c.input, b...)
+	var offset int
+	for offset < len(c.input) {
+		reader := bytes.NewReader(c.input[offset:])
+		err = c.decode(reader)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		offset = len(c.input) - reader.Len()
+	}
+	c.input = append(c.input[:0], c.input[offset:]...)
+	return len(b), nil
 }
 
-//warn:unsafe
-func (c *ServerConn) loopInput() {
-	if c.version == Version {
-		request, err := ReadRequest(c.inputReader)
+// decode decodes the request or one datagram, and returns io.EOF or io.ErrUnexpectedEOF if more input is needed.
+func (c *ServerConn) decode(reader *bytes.Reader) error {
+	if !c.requestRead {
+		var (
+			request *Request
+			err     error
+		)
+		if c.version == Version3 {
+			request, err = ReadRequestV3(reader)
+		} else {
+			request, err = ReadRequest(reader)
+		}
 		if err != nil {
-			return
+			return err
 		}
+		c.requestRead = true
 		c.isConnect = request.IsConnect
 		c.destination = request.Destination
+		c.capabilities = request.Capabilities & Capabilities
+		c.frames = frameReader{
+			isConnect:   request.IsConnect,
+			destination: request.Destination,
+		}
+		close(c.ready)
+		return nil
 	}
 	buffer := buf.NewPacket()
-	defer buffer.Release()
-	for {
-		var destination M.Socksaddr
-		var err error
-		if c.isConnect {
-			destination = c.destination
-		} else {
-			destination, err = AddrParser.ReadAddrPort(c.inputReader)
-			if err != nil {
-				break
-			}
+	var (
+		destination M.Socksaddr
+		err         error
+	)
+	if c.version == Version3 {
+		frames := c.frames
+		frames.reader = reader
+		destination, err = frames.readPacket(buffer)
+		if err == nil {
+			c.frames = frames
 		}
-		if destination.IsDomain() {
-			addr, err := net.ResolveUDPAddr("udp", destination.String())
-			if err != nil {
-				continue
-			}
-			destination = M.SocksaddrFromNet(addr)
-		}
-		var length uint16
-		err = binary.Read(c.inputReader, binary.BigEndian, &length)
-		if err != nil {
-			break
-		}
-		buffer.Reset()
-		_, err = buffer.ReadFullFrom(c.inputReader, int(length))
-		if err != nil {
-			break
-		}
-		_, err = c.WriteTo(buffer.Bytes(), destination.UDPAddr())
+	} else {
+		destination, err = c.readPacket(reader, buffer)
+	}
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	return c.writer.WritePacket(buffer, destination)
+}
+
+func (c *ServerConn) readPacket(reader io.Reader, buffer *buf.Buffer) (destination M.Socksaddr, err error) {
+	if c.isConnect {
+		destination = c.destination
+	} else {
+		destination, err = AddrParser.ReadAddrPort(reader)
 		if err != nil {
-			break
+			return
 		}
 	}
-	c.Close()
+	var length uint16
+	err = binary.Read(reader, binary.BigEndian, &length)
+	if err != nil {
+		return
+	}
+	_, err = buffer.ReadFullFrom(reader, int(length))
+	return
 }
 
-//warn:unsafe
-func (c *ServerConn) loopOutput() {
-	buffer := buf.NewPacket()
-	defer buffer.Release()
-	for {
-		buffer.Reset()
-		n, addr, err := buffer.ReadPacketFrom(c)
-		if err != nil {
-			break
+// Read encodes the replies received from the packet connection into the server stream.
+func (c *ServerConn) Read(b []byte) (n int, err error) {
+	c.outputAccess.Lock()
+	defer c.outputAccess.Unlock()
+	if c.output == nil {
+		select {
+		case <-c.ready:
+		case <-c.ctx.Done():
+			return 0, net.ErrClosed
 		}
-		if !c.isConnect {
-			err = AddrParser.WriteAddrPort(c.outputWriter, M.SocksaddrFromNet(addr))
-			if err != nil {
-				break
+		if c.version == Version3 && !c.capabilitiesWritten {
+			if len(b) == 0 {
+				return
 			}
+			b[0] = c.capabilities
+			c.capabilitiesWritten = true
+			return 1, nil
 		}
-		err = binary.Write(c.outputWriter, binary.BigEndian, uint16(n))
+		c.output, err = c.readReply()
 		if err != nil {
-			break
+			return
 		}
-		_, err = buffer.WriteTo(c.outputWriter)
+	}
+	n, err = c.output.Read(b)
+	if c.output.IsEmpty() {
+		c.output.Release()
+		c.output = nil
+	}
+	return
+}
+
+func (c *ServerConn) readReply() (*buf.Buffer, error) {
+	buffer, destination, err := waitReadPacket(c.packetConn, c.readWaiter, c.readWaitOptions)
+	if err != nil {
+		return nil, err
+	}
+	var paddingLen int
+	if c.version == Version3 && c.capabilities&CapabilityPadding != 0 {
+		paddingLen = min(rand.IntN(maxPaddingLen), buffer.FreeLen())
+		buffer.WriteRandom(paddingLen)
+	}
+	length := buffer.Len() - paddingLen
+	binary.BigEndian.PutUint16(buffer.ExtendHeader(2), uint16(length))
+	if !c.isConnect {
+		err = AddrParser.WriteAddrPort(buf.With(buffer.ExtendHeader(AddrParser.AddrPortLen(destination))), destination)
 		if err != nil {
-			break
+			buffer.Release()
+			return nil, err
 		}
 	}
-	c.Close()
+	if c.version == Version3 {
+		header := buffer.ExtendHeader(frameHeaderLen)
+		header[0] = 1
+		binary.BigEndian.PutUint16(header[1:], uint16(paddingLen))
+	}
+	return buffer, nil
+}
+
+// waitReadPacket reads a packet with the headroom of options, through readWaiter if it is set.
+func waitReadPacket(reader N.PacketReader, readWaiter N.PacketReadWaiter, options N.ReadWaitOptions) (*buf.Buffer, M.Socksaddr, error) {
+	if readWaiter != nil {
+		buffer, destination, err := readWaiter.WaitReadPacket()
+		if err != nil {
+			return nil, M.Socksaddr{}, err
+		}
+		return buffer, destination.Unwrap(), nil
+	}
+	buffer := options.NewPacketBuffer()
+	destination, err := reader.ReadPacket(buffer)
+	if err != nil {
+		buffer.Release()
+		return nil, M.Socksaddr{}, err
+	}
+	options.PostReturn(buffer)
+	return buffer, destination.Unwrap(), nil
 }
 
 func (c *ServerConn) Close() error {
-	c.inputReader.Close()
-	c.inputWriter.Close()
-	c.outputReader.Close()
-	c.outputWriter.Close()
-	c.PacketConn.Close()
-	return nil
+	c.cancel()
+	return c.packetConn.Close()
+}
+
+func (c *ServerConn) LocalAddr() net.Addr {
+	return c.packetConn.LocalAddr()
+}
+
+func (c *ServerConn) RemoteAddr() net.Addr {
+	return M.Socksaddr{Fqdn: "pipe"}
+}
+
+func (c *ServerConn) SetDeadline(t time.Time) error {
+	return c.packetConn.SetReadDeadline(t)
+}
+
+func (c *ServerConn) SetReadDeadline(t time.Time) error {
+	return c.packetConn.SetReadDeadline(t)
+}
+
+func (c *ServerConn) SetWriteDeadline(t time.Time) error {
+	return c.packetConn.SetWriteDeadline(t)
+}
+
+func (c *ServerConn) Upstream() any {
+	return c.packetConn
 }
@@ -0,0 +1,82 @@
+package uot
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testResolver struct {
+	block   chan struct{}
+	lookups atomic.Int32
+}
+
+func (r *testResolver) LookupNetIP(ctx context.Context, network string, host string) ([]netip.Addr, error) {
+	r.lookups.Add(1)
+	if host == "slow.test" {
+		select {
+		case <-r.block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return []netip.Addr{netip.AddrFrom4([4]byte{127, 0, 0, 1})}, nil
+}
+
+func TestServerConnResolve(t *testing.T) {
+	t.Parallel()
+	echoConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echoConn.Close()
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, addr, err := echoConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			echoConn.WriteTo(buffer[:n], addr)
+		}
+	}()
+	echoPort := M.SocksaddrFromNet(echoConn.LocalAddr()).Port
+	serverUDPConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	resolver := &testResolver{block: make(chan struct{})}
+	uotServerConn := NewServerConnWithOptions(serverUDPConn, Version, ServerOptions{Resolver: resolver})
+	defer uotServerConn.Close()
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go bufio.CopyConn(context.Background(), serverConn, uotServerConn)
+	client := &Client{Version: Version}
+	conn, err := client.DialEarlyConn(clientConn, false, M.ParseSocksaddrHostPort("fast.test", echoPort))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WritePacket(buf.As([]byte("slow")), M.ParseSocksaddrHostPort("slow.test", echoPort)))
+	for range 2 {
+		require.NoError(t, conn.WritePacket(buf.As([]byte("fast")), M.ParseSocksaddrHostPort("fast.test", echoPort)))
+		buffer := buf.NewPacket()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.ReadPacket(buffer)
+		require.NoError(t, err)
+		require.Equal(t, "fast", string(buffer.Bytes()))
+		buffer.Release()
+	}
+	require.Equal(t, int32(2), resolver.lookups.Load())
+
+	close(resolver.block)
+	buffer := buf.NewPacket()
+	_, err = conn.ReadPacket(buffer)
+	require.NoError(t, err)
+	require.Equal(t, "slow", string(buffer.Bytes()))
+	buffer.Release()
+}
@@ -75,6 +75,10 @@ type Cache[K comparable, V comparable] interface {
 	// The evict function is called for the removed entry.
 	Remove(key K) bool
 
+	// RemoveValue removes the key from the cache if it is mapped to value.
+	// The evict function is called for the removed entry.
+	RemoveValue(key K, value V) bool
+
 	// RemoveOldest removes the oldest entry from the cache.
 	// Key, value and an indicator of whether the entry has been removed is returned.
 	// The evict function is called for the removed entry.
@@ -660,6 +660,21 @@ func (lru *LRU[K, V]) remove(hash uint32, key K) (removed bool) {
 	return
 }
 
+// RemoveValue removes the key from the cache if it is mapped to value.
+// The evict function is called for the removed entry.
+func (lru *LRU[K, V]) RemoveValue(key K, value V) (removed bool) {
+	return lru.removeValue(lru.hash(key), key, value)
+}
+
+func (lru *LRU[K, V]) removeValue(hash uint32, key K, value V) (removed bool) {
+	if pos, ok := lru.findKeyNoExpire(hash, key); ok && lru.elements[pos].value == value {
+		lru.removeAt(pos)
+		return true
+	}
+
+	return
+}
+
 func (lru *LRU[K, V]) removeAt(pos uint32) {
 	lru.evict(pos)
 	lru.move(pos, lru.len)
@@ -116,3 +116,19 @@ func TestPurgeExpired(t *testing.T) {
 		})
 	}
 }
+
+func TestRemoveValue(t *testing.T) {
+	t.Parallel()
+	lru, err := freelru.NewSynced[string, string](1024, maphash.NewHasher[string]().Hash32)
+	require.NoError(t, err)
+	var evicted []string
+	lru.SetOnEvict(func(key string, value string) {
+		evicted = append(evicted, value)
+	})
+	lru.Add("hello", "world")
+	require.False(t, lru.RemoveValue("hello", "not world"))
+	require.True(t, lru.Contains("hello"))
+	require.True(t, lru.RemoveValue("hello", "world"))
+	require.False(t, lru.Contains("hello"))
+	require.Equal(t, []string{"world"}, evicted)
+}
@@ -288,6 +288,19 @@ func (lru *ShardedLRU[K, V]) Remove(key K) (removed bool) {
 	return
 }
 
+// RemoveValue removes the key from the cache if it is mapped to value.
+// The evict function is called for the removed entry.
+func (lru *ShardedLRU[K, V]) RemoveValue(key K, value V) (removed bool) {
+	hash := lru.hash(key)
+	shard := (hash >> 16) & lru.mask
+
+	lru.mus[shard].Lock()
+	removed = lru.lrus[shard].removeValue(hash, key, value)
+	lru.mus[shard].Unlock()
+
+	return
+}
+
 // RemoveOldest removes the oldest entry from the cache.
 // Key, value and an indicator of whether the entry has been removed is returned.
 // The evict function is called for the removed entry.
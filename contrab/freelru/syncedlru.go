@@ -201,6 +201,18 @@ func (lru *SyncedLRU[K, V]) Remove(key K) (removed bool) {
 	return
 }
 
+// RemoveValue removes the key from the cache if it is mapped to value.
+// The evict function is called for the removed entry.
+func (lru *SyncedLRU[K, V]) RemoveValue(key K, value V) (removed bool) {
+	hash := lru.lru.hash(key)
+
+	lru.mu.Lock()
+	removed = lru.lru.removeValue(hash, key, value)
+	lru.mu.Unlock()
+
+	return
+}
+
 // RemoveOldest removes the oldest entry from the cache.
 // Key, value and an indicator of whether the entry has been removed is returned.
 // The evict function is called for the removed entry.
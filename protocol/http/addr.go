@@ -21,3 +21,14 @@ func SourceAddress(request *http.Request) M.Socksaddr {
 	}
 	return address.Unwrap()
 }
+
+// requestSource returns the client declared by X-Forwarded-For, or source if the request declares none.
+func requestSource(request *http.Request, source M.Socksaddr) M.Socksaddr {
+	if request.Header.Get("X-Forwarded-For") == "" {
+		return source
+	}
+	if sourceAddress := SourceAddress(request); sourceAddress.IsValid() {
+		return sourceAddress
+	}
+	return source
+}
@@ -0,0 +1,105 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/sagernet/sing/common/auth"
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+const DefaultRealm = "sing-box"
+
+// BearerVerifier checks a token presented with the Bearer scheme.
+// On success, the returned context carries the authenticated user, usually set by auth.ContextWithUser.
+type BearerVerifier interface {
+	VerifyToken(ctx context.Context, token string) (context.Context, error)
+}
+
+type BearerVerifierFunc func(ctx context.Context, token string) (context.Context, error)
+
+func (f BearerVerifierFunc) VerifyToken(ctx context.Context, token string) (context.Context, error) {
+	return f(ctx, token)
+}
+
+type ServerOptions struct {
+	// Authenticator verifies Basic credentials.
+	Authenticator auth.Verifier
+	Digest        *DigestAuthenticator
+	Bearer        BearerVerifier
+	// Realm defaults to DefaultRealm.
+	Realm   string
+	Forward ForwardOptions
+}
+
+func (o ServerOptions) authEnabled() bool {
+	return auth.IsEnabled(o.Authenticator) || o.Digest != nil || o.Bearer != nil
+}
+
+func (o ServerOptions) realm() string {
+	if o.Realm == "" {
+		return DefaultRealm
+	}
+	return o.Realm
+}
+
+// authenticate verifies the Proxy-Authorization header of request.
+// stale is set when Digest credentials were valid but the nonce has expired or its count was already used.
+func (o ServerOptions) authenticate(ctx context.Context, request *http.Request) (authCtx context.Context, stale bool, err error) {
+	authorization := request.Header.Get("Proxy-Authorization")
+	if authorization == "" {
+		return nil, false, E.New("http: authentication failed, no Proxy-Authorization header")
+	}
+	scheme, credentials, _ := strings.Cut(authorization, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !auth.IsEnabled(o.Authenticator) {
+			break
+		}
+		username, password, loaded := ParseBasicAuth(authorization)
+		if !loaded {
+			return nil, false, E.New("http: authentication failed, invalid basic credentials")
+		}
+		authCtx, err = o.Authenticator.VerifyContext(ctx, username, password)
+		if err != nil {
+			return nil, false, E.Cause(err, "http: authentication failed, username=", username)
+		}
+		return authCtx, false, nil
+	case "digest":
+		if o.Digest == nil {
+			break
+		}
+		return o.Digest.verify(ctx, request.Method, request.RequestURI, o.realm(), parseAuthParams(credentials))
+	case "bearer":
+		if o.Bearer == nil {
+			break
+		}
+		authCtx, err = o.Bearer.VerifyToken(ctx, strings.TrimSpace(credentials))
+		if err != nil {
+			return nil, false, E.Cause(err, "http: authentication failed, bearer token")
+		}
+		return authCtx, false, nil
+	}
+	return nil, false, E.New("http: authentication failed, unsupported scheme: ", scheme)
+}
+
+// challenges returns the Proxy-Authenticate header values for every enabled scheme, strongest first.
+func (o ServerOptions) challenges(stale bool) []string {
+	var challenges []string
+	realm := o.realm()
+	if o.Digest != nil {
+		challenges = append(challenges, o.Digest.challenges(realm, stale)...)
+	}
+	if o.Bearer != nil {
+		challenges = append(challenges, "Bearer realm="+quoteAuthParam(realm))
+	}
+	if auth.IsEnabled(o.Authenticator) {
+		challenges = append(challenges, "Basic realm="+quoteAuthParam(realm)+`, charset="UTF-8"`)
+	}
+	return challenges
+}
+
+func quoteAuthParam(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
@@ -0,0 +1,175 @@
+package http
+
+import (
+	std_bufio "bufio"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/sagernet/sing/common/auth"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testUserHandler struct {
+	userChan chan string
+}
+
+func (h *testUserHandler) NewConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	user, _ := auth.UserFromContext[string](ctx)
+	h.userChan <- user
+	conn.Close()
+}
+
+func testAuthServer(t *testing.T, options ServerOptions) (M.Socksaddr, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	handler := &testUserHandler{userChan: make(chan string, 1)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				err := HandleConnectionWithOptions(context.Background(), conn, std_bufio.NewReader(conn), handler, M.Socksaddr{}, nil, options)
+				if err != nil {
+					conn.Close()
+				}
+			}()
+		}
+	}()
+	return M.SocksaddrFromNet(listener.Addr()), handler.userChan
+}
+
+func TestServerAuthSchemes(t *testing.T) {
+	t.Parallel()
+	authenticator := auth.NewAuthenticator([]auth.User{{Username: "user", Password: "password"}})
+	server, userChan := testAuthServer(t, ServerOptions{
+		Authenticator: authenticator,
+		Digest:        NewDigestAuthenticator(authenticator, 0),
+		Bearer: BearerVerifierFunc(func(ctx context.Context, token string) (context.Context, error) {
+			if token != "token" {
+				return nil, E.New("invalid token")
+			}
+			return auth.ContextWithUser(ctx, "token-user"), nil
+		}),
+		Realm: "test",
+	})
+	for _, testCase := range []struct {
+		options Options
+		user    string
+	}{
+		{Options{Username: "user", Password: "password"}, "user"},
+		{Options{Username: "user", Password: "password", Digest: true}, "user"},
+		{Options{Username: "user", Password: "password", Digest: true, HTTP2: true}, "user"},
+		{Options{Token: "token"}, "token-user"},
+		{Options{Username: "user", Password: "invalid", Digest: true}, ""},
+		{Options{Token: "invalid"}, ""},
+		{Options{}, ""},
+	} {
+		testCase.options.Server = server
+		client := NewClient(testCase.options)
+		for range 2 {
+			_, err := client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddr("1.1.1.1:53"))
+			if testCase.user == "" {
+				require.Error(t, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, testCase.user, <-userChan)
+		}
+	}
+}
+
+func TestDigestNonceCount(t *testing.T) {
+	t.Parallel()
+	authenticator := auth.NewAuthenticator([]auth.User{{Username: "user", Password: "password"}})
+	digest := NewDigestAuthenticator(authenticator, 0)
+	nonce := digest.newNonce()
+	newHash, sess, err := digestAlgorithm("SHA-256")
+	require.NoError(t, err)
+	params := map[string]string{
+		"username":  "user",
+		"realm":     DefaultRealm,
+		"nonce":     nonce,
+		"uri":       "1.1.1.1:53",
+		"qop":       "auth",
+		"nc":        "00000001",
+		"cnonce":    "cnonce",
+		"algorithm": "SHA-256",
+		"response":  digestResponse(newHash, sess, "user", DefaultRealm, "password", "CONNECT", "1.1.1.1:53", nonce, "00000001", "cnonce", "auth"),
+	}
+	_, stale, err := digest.verify(context.Background(), "CONNECT", "1.1.1.1:53", DefaultRealm, params)
+	require.NoError(t, err)
+	require.False(t, stale)
+	_, stale, err = digest.verify(context.Background(), "CONNECT", "1.1.1.1:53", DefaultRealm, params)
+	require.Error(t, err)
+	require.True(t, stale)
+	params["nonce"] = "unknown"
+	params["response"] = digestResponse(newHash, sess, "user", DefaultRealm, "password", "CONNECT", "1.1.1.1:53", "unknown", "00000001", "cnonce", "auth")
+	_, stale, err = digest.verify(context.Background(), "CONNECT", "1.1.1.1:53", DefaultRealm, params)
+	require.Error(t, err)
+	require.True(t, stale)
+}
+
+func TestDigestNonceCountWindow(t *testing.T) {
+	t.Parallel()
+	digest := NewDigestAuthenticator(nil, 0)
+	nonce := digest.newNonce()
+	for _, testCase := range []struct {
+		count uint64
+		fresh bool
+	}{
+		{3, true},
+		{1, true},
+		{2, true},
+		{2, false},
+		{0, false},
+		{3 + digestCountWindow, true},
+		{3, false},
+		{4, true},
+	} {
+		valid, fresh := digest.useNonce(nonce, testCase.count)
+		require.True(t, valid)
+		require.Equal(t, testCase.fresh, fresh, "nc=", testCase.count)
+	}
+}
+
+func TestDigestNonceLimit(t *testing.T) {
+	t.Parallel()
+	digest := NewDigestAuthenticator(nil, 0)
+	first := digest.newNonce()
+	for range maxDigestNonces {
+		digest.newNonce()
+	}
+	require.Len(t, digest.nonces, maxDigestNonces)
+	valid, _ := digest.useNonce(first, 1)
+	require.False(t, valid)
+}
+
+func TestDigestNilAuthenticator(t *testing.T) {
+	t.Parallel()
+	for _, users := range []auth.PasswordLookup{nil, (*auth.Authenticator)(nil), auth.NewAuthenticator(nil)} {
+		digest := NewDigestAuthenticator(users, 0)
+		nonce := digest.newNonce()
+		params := map[string]string{
+			"username": "user",
+			"realm":    DefaultRealm,
+			"nonce":    nonce,
+			"uri":      "1.1.1.1:53",
+			"qop":      "auth",
+			"nc":       "00000001",
+			"cnonce":   "cnonce",
+			"response": "response",
+		}
+		_, _, err := digest.verify(context.Background(), "CONNECT", "1.1.1.1:53", DefaultRealm, params)
+		require.Error(t, err)
+	}
+}
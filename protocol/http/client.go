@@ -3,17 +3,19 @@ package http
 import (
 	std_bufio "bufio"
 	"context"
-	"encoding/base64"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/tls"
 )
 
 var _ N.Dialer = (*Client)(nil)
@@ -26,6 +28,19 @@ type Client struct {
 	host       string
 	path       string
 	headers    http.Header
+	token      string
+	digest     bool
+	lazy       bool
+	transport  *http.Transport
+	tlsConfig  tls.Config
+	// tlsConfigHTTP1 offers only http/1.1, for connections that must not be negotiated to HTTP/2.
+	tlsConfigHTTP1 tls.Config
+	// http1 is set once the TLS server refused to negotiate HTTP/2.
+	http1 atomic.Bool
+
+	digestAccess    sync.Mutex
+	digestChallenge map[string]string
+	digestCount     uint64
 }
 
 type Options struct {
@@ -35,6 +50,21 @@ type Options struct {
 	Password string
 	Path     string
 	Headers  http.Header
+	// Token is sent with the Bearer scheme instead of Username and Password.
+	Token string
+	// Digest disables preemptive Basic authentication,
+	// so the password is only sent as the response to a Digest challenge.
+	Digest bool
+	// HTTP2 multiplexes all tunnels as CONNECT streams over one HTTP/2 connection,
+	// with prior knowledge in plain text, or negotiated by ALPN over TLS with a fallback to HTTP/1.1.
+	HTTP2 bool
+	// TLSConfig enables TLS to the proxy server. ALPN offers http/1.1, or with HTTP2,
+	// h2 and http/1.1 unless set in the config.
+	TLSConfig tls.Config
+	// Lazy returns HTTP/1.1 tunnels before CONNECT is sent. The request goes out with the first write
+	// and the response is read on the first read, so a failed Digest challenge can not be retried.
+	// A first read waits up to LazyRequestTimeout for a write, then sends the request without a payload.
+	Lazy bool
 }
 
 func NewClient(options Options) *Client {
@@ -45,6 +75,9 @@ func NewClient(options Options) *Client {
 		password:   options.Password,
 		path:       options.Path,
 		headers:    options.Headers,
+		token:      options.Token,
+		digest:     options.Digest,
+		lazy:       options.Lazy,
 	}
 	if options.Dialer == nil {
 		client.dialer = N.SystemDialer
@@ -55,23 +88,163 @@ func NewClient(options Options) *Client {
 		client.headers.Del("Host")
 		client.host = host
 	}
+	if options.TLSConfig != nil {
+		client.tlsConfig = options.TLSConfig.Clone()
+		if client.tlsConfig.ServerName() == "" && client.serverAddr.IsFqdn() {
+			client.tlsConfig.SetServerName(client.serverAddr.Fqdn)
+		}
+		client.tlsConfigHTTP1 = client.tlsConfig.Clone()
+		client.tlsConfigHTTP1.SetNextProtos([]string{"http/1.1"})
+		if len(client.tlsConfig.NextProtos()) == 0 {
+			client.tlsConfig.SetNextProtos([]string{"h2", "http/1.1"})
+		}
+	}
+	if options.HTTP2 {
+		var protocols http.Protocols
+		// Over TLS, the transport sees an already negotiated h2 connection as HTTP/2 with prior knowledge.
+		protocols.SetUnencryptedHTTP2(true)
+		client.transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, err := client.dialServer(ctx, client.tlsConfig)
+				if err != nil {
+					return nil, err
+				}
+				if tlsConn, isTLS := conn.(tls.Conn); isTLS && tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+					client.http1.Store(true)
+					conn.Close()
+					return nil, E.New("http: proxy server does not support HTTP/2")
+				}
+				return conn, nil
+			},
+			Protocols: &protocols,
+		}
+	}
 	return client
 }
 
+// NewClientFromURL creates a client from an http:// or https:// proxy URL.
+// The user info is used for authentication and a non-root path is sent as the CONNECT request path.
+func NewClientFromURL(dialer N.Dialer, rawURL string, headers http.Header) (*Client, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	options := Options{
+		Dialer:  dialer,
+		Server:  M.ParseSocksaddr(proxyURL.Host),
+		Headers: headers.Clone(),
+	}
+	switch proxyURL.Scheme {
+	case "http":
+		if options.Server.Port == 0 {
+			options.Server.Port = 80
+		}
+	case "https":
+		if options.Server.Port == 0 {
+			options.Server.Port = 443
+		}
+		options.TLSConfig = tls.NewSTDClient(&tls.STDConfig{ServerName: proxyURL.Hostname()})
+	default:
+		return nil, E.New("http: unknown scheme: ", proxyURL.Scheme)
+	}
+	if proxyURL.User != nil {
+		options.Username = proxyURL.User.Username()
+		options.Password, _ = proxyURL.User.Password()
+	}
+	if proxyURL.Path != "" && proxyURL.Path != "/" {
+		options.Path = proxyURL.EscapedPath()
+	}
+	return NewClient(options), nil
+}
+
+func (c *Client) dialServer(ctx context.Context, tlsConfig tls.Config) (net.Conn, error) {
+	conn, err := c.dialer.DialContext(ctx, N.NetworkTCP, c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return conn, nil
+	}
+	tlsConn, err := tls.ClientHandshake(ctx, conn, tlsConfig)
+	if err != nil {
+		conn.Close()
+		return nil, E.Cause(err, "http: tls handshake")
+	}
+	return tlsConn, nil
+}
+
 func (c *Client) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
 	network = N.NetworkName(network)
 	switch network {
 	case N.NetworkTCP:
 	case N.NetworkUDP:
-		return nil, os.ErrInvalid
+		conn, err := retryAuth(c, func() (*ConnectUDPConn, error) {
+			return c.dialConnectUDP(ctx, destination)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
 	default:
 		return nil, E.Extend(N.ErrUnknownNetwork, network)
 	}
-	var conn net.Conn
-	conn, err := c.dialer.DialContext(ctx, N.NetworkTCP, c.serverAddr)
+	if c.transport != nil && !c.http1.Load() {
+		conn, err := retryAuth(c, func() (net.Conn, error) {
+			return c.dialHTTP2(ctx, destination)
+		})
+		if err == nil || !c.http1.Load() {
+			return conn, err
+		}
+	}
+	if c.lazy {
+		return c.dialLazy(ctx, destination)
+	}
+	return retryAuth(c, func() (net.Conn, error) {
+		return c.dialHTTP1(ctx, destination)
+	})
+}
+
+func (c *Client) dialHTTP1(ctx context.Context, destination M.Socksaddr) (net.Conn, error) {
+	request, err := c.connectRequest(destination)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.dialServer(ctx, c.tlsConfigHTTP1)
+	if err != nil {
+		return nil, err
+	}
+	err = request.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := std_bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	if response.StatusCode == http.StatusOK {
+		if reader.Buffered() > 0 {
+			buffer := buf.NewSize(reader.Buffered())
+			_, err = buffer.ReadFullFrom(reader, buffer.FreeLen())
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = bufio.NewCachedConn(conn, buffer)
+		}
+		return conn, nil
+	} else {
+		conn.Close()
+		return nil, responseError(request, response)
+	}
+}
+
+func (c *Client) connectRequest(destination M.Socksaddr) (*http.Request, error) {
 	request := &http.Request{
 		Method: http.MethodConnect,
 		Header: http.Header{
@@ -80,7 +253,6 @@ func (c *Client) DialContext(ctx context.Context, network string, destination M.
 	}
 	if c.host != "" && c.host != destination.Fqdn {
 		if c.path != "" {
-			_ = conn.Close()
 			return nil, E.New("Host header and path are not allowed at the same time")
 		}
 		request.Host = c.host
@@ -89,22 +261,82 @@ func (c *Client) DialContext(ctx context.Context, network string, destination M.
 		request.URL = &url.URL{Host: destination.String()}
 	}
 	if c.path != "" {
-		err = URLSetPath(request.URL, c.path)
+		err := URLSetPath(request.URL, c.path)
 		if err != nil {
-			_ = conn.Close()
 			return nil, err
 		}
 	}
+	c.setHeaders(request.Header, request.Method, requestURI(request))
+	return request, nil
+}
+
+func (c *Client) setHeaders(header http.Header, method string, uri string) {
 	for key, valueList := range c.headers {
-		request.Header.Set(key, valueList[0])
+		header.Set(key, valueList[0])
 		for _, value := range valueList[1:] {
-			request.Header.Add(key, value)
+			header.Add(key, value)
+		}
+	}
+	if authorization := c.authorization(method, uri); authorization != "" {
+		header.Set("Proxy-Authorization", authorization)
+	}
+}
+
+// requestURI returns the request target as written by http.Request.Write.
+func requestURI(request *http.Request) string {
+	if request.Method == http.MethodConnect && request.URL.Path == "" {
+		if request.URL.Opaque != "" {
+			return request.URL.Opaque
 		}
+		if request.Host != "" {
+			return request.Host
+		}
+		return request.URL.Host
+	}
+	return request.URL.RequestURI()
+}
+
+func responseError(request *http.Request, response *http.Response) error {
+	switch response.StatusCode {
+	case http.StatusProxyAuthRequired:
+		return &authRequiredError{response: response, authorization: request.Header.Get("Proxy-Authorization")}
+	case http.StatusMethodNotAllowed:
+		return E.New("method not allowed")
+	default:
+		return E.New("unexpected status: ", response.Status)
+	}
+}
+
+// ListenPacket establishes a CONNECT-UDP association to destination over a new HTTP/1.1 connection.
+func (c *Client) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	conn, err := retryAuth(c, func() (*ConnectUDPConn, error) {
+		return c.dialConnectUDP(ctx, destination)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *Client) dialConnectUDP(ctx context.Context, destination M.Socksaddr) (*ConnectUDPConn, error) {
+	conn, err := c.dialServer(ctx, c.tlsConfigHTTP1)
+	if err != nil {
+		return nil, err
 	}
-	if c.username != "" {
-		auth := c.username + ":" + c.password
-		request.Header.Add("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	request := &http.Request{
+		Method: http.MethodGet,
+		URL:    connectUDPPath(destination),
+		Header: http.Header{
+			"Connection":       []string{"Upgrade"},
+			"Upgrade":          []string{ConnectUDPProtocol},
+			"Capsule-Protocol": []string{"?1"},
+		},
+		Host: c.host,
+	}
+	if request.Host == "" {
+		request.Host = c.serverAddr.String()
 	}
+	c.setHeaders(request.Header, request.Method, requestURI(request))
 	err = request.Write(conn)
 	if err != nil {
 		conn.Close()
@@ -116,30 +348,16 @@ func (c *Client) DialContext(ctx context.Context, network string, destination M.
 		conn.Close()
 		return nil, err
 	}
-	if response.StatusCode == http.StatusOK {
-		if reader.Buffered() > 0 {
-			buffer := buf.NewSize(reader.Buffered())
-			_, err = buffer.ReadFullFrom(reader, buffer.FreeLen())
-			if err != nil {
-				conn.Close()
-				return nil, err
-			}
-			conn = bufio.NewCachedConn(conn, buffer)
-		}
-		return conn, nil
-	} else {
+	if response.StatusCode != http.StatusSwitchingProtocols {
 		conn.Close()
-		switch response.StatusCode {
-		case http.StatusProxyAuthRequired:
-			return nil, E.New("authentication required")
-		case http.StatusMethodNotAllowed:
-			return nil, E.New("method not allowed")
-		default:
-			return nil, E.New("unexpected status: ", response.Status)
-		}
+		return nil, responseError(request, response)
 	}
+	return NewConnectUDPConn(conn, reader, destination), nil
 }
 
-func (c *Client) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
-	return nil, os.ErrInvalid
+// CloseIdleConnections closes the idle HTTP/2 connection, if any.
+func (c *Client) CloseIdleConnections() {
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+	}
 }
@@ -0,0 +1,118 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sagernet/sing/common"
+)
+
+type authRequiredError struct {
+	response      *http.Response
+	authorization string
+}
+
+func (e *authRequiredError) Error() string {
+	return "authentication required"
+}
+
+// retryAuth dials again once if the proxy answered with a Digest challenge the client can satisfy.
+func retryAuth[T any](c *Client, dial func() (T, error)) (T, error) {
+	conn, err := dial()
+	var authErr *authRequiredError
+	if errors.As(err, &authErr) && c.updateChallenge(authErr.response, authErr.authorization) {
+		return dial()
+	}
+	return conn, err
+}
+
+// authorization returns the Proxy-Authorization value for a request, or an empty string to send none.
+func (c *Client) authorization(method string, uri string) string {
+	if c.token != "" {
+		return "Bearer " + c.token
+	}
+	if c.username == "" {
+		return ""
+	}
+	if authorization := c.digestAuthorization(method, uri); authorization != "" {
+		return authorization
+	}
+	if c.digest {
+		return ""
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+}
+
+func (c *Client) updateChallenge(response *http.Response, authorization string) bool {
+	if c.token != "" || c.username == "" {
+		return false
+	}
+	var params map[string]string
+	for _, challenge := range response.Header.Values("Proxy-Authenticate") {
+		scheme, challengeParams, _ := strings.Cut(challenge, " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+		challengeParams = strings.TrimSpace(challengeParams)
+		params = parseAuthParams(challengeParams)
+		_, _, err := digestAlgorithm(params["algorithm"])
+		if err == nil && params["nonce"] != "" && common.Contains(strings.Split(strings.ReplaceAll(params["qop"], " ", ""), ","), "auth") {
+			break
+		}
+		params = nil
+	}
+	if params == nil {
+		return false
+	}
+	if strings.HasPrefix(authorization, "Digest ") && params["stale"] != "true" {
+		return false
+	}
+	c.digestAccess.Lock()
+	c.digestChallenge = params
+	c.digestCount = 0
+	c.digestAccess.Unlock()
+	return true
+}
+
+func (c *Client) digestAuthorization(method string, uri string) string {
+	c.digestAccess.Lock()
+	challenge := c.digestChallenge
+	c.digestCount++
+	count := c.digestCount
+	c.digestAccess.Unlock()
+	if challenge == nil {
+		return ""
+	}
+	newHash, sess, err := digestAlgorithm(challenge["algorithm"])
+	if err != nil {
+		return ""
+	}
+	var cnonceBytes [16]byte
+	common.Must1(rand.Read(cnonceBytes[:]))
+	cnonce := hex.EncodeToString(cnonceBytes[:])
+	nc := strconv.FormatUint(count, 16)
+	nc = strings.Repeat("0", max(0, 8-len(nc))) + nc
+	response := digestResponse(newHash, sess, c.username, challenge["realm"], c.password, method, uri, challenge["nonce"], nc, cnonce, "auth")
+	params := []string{
+		"username=" + quoteAuthParam(c.username),
+		"realm=" + quoteAuthParam(challenge["realm"]),
+		"nonce=" + quoteAuthParam(challenge["nonce"]),
+		"uri=" + quoteAuthParam(uri),
+		"qop=auth",
+		"nc=" + nc,
+		"cnonce=" + quoteAuthParam(cnonce),
+		"response=" + quoteAuthParam(response),
+	}
+	if algorithm := challenge["algorithm"]; algorithm != "" {
+		params = append(params, "algorithm="+algorithm)
+	}
+	if opaque, loaded := challenge["opaque"]; loaded {
+		params = append(params, "opaque="+quoteAuthParam(opaque))
+	}
+	return "Digest " + strings.Join(params, ", ")
+}
@@ -0,0 +1,56 @@
+package http
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func (c *Client) dialHTTP2(ctx context.Context, destination M.Socksaddr) (net.Conn, error) {
+	if c.path != "" {
+		return nil, E.New("path is not supported over HTTP/2")
+	}
+	pipeReader, pipeWriter := io.Pipe()
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "http", Host: c.serverAddr.String()},
+		Host:   destination.String(),
+		Header: make(http.Header),
+		Body:   pipeReader,
+	}
+	c.setHeaders(request.Header, request.Method, request.Host)
+	// The stream outlives the dial context, which only bounds the request itself.
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+	response, err := c.transport.RoundTrip(request.WithContext(streamCtx))
+	if !stop() && err == nil {
+		response.Body.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		pipeWriter.Close()
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		cancel()
+		pipeWriter.Close()
+		response.Body.Close()
+		return nil, responseError(request, response)
+	}
+	return &http2Conn{
+		reader: response.Body,
+		writer: pipeWriter,
+		onClose: func() {
+			pipeWriter.Close()
+			cancel()
+		},
+		localAddr:  M.Socksaddr{},
+		remoteAddr: c.serverAddr,
+	}, nil
+}
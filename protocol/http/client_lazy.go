@@ -0,0 +1,179 @@
+package http
+
+import (
+	std_bufio "bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// LazyRequestTimeout is how long a read waits for the first write before sending CONNECT on its own,
+// so that protocols in which the server speaks first do not stall.
+const LazyRequestTimeout = 200 * time.Millisecond
+
+func (c *Client) dialLazy(ctx context.Context, destination M.Socksaddr) (net.Conn, error) {
+	request, err := c.connectRequest(destination)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.dialServer(ctx, c.tlsConfigHTTP1)
+	if err != nil {
+		return nil, err
+	}
+	return NewLazyConn(conn, request), nil
+}
+
+var (
+	_ N.EarlyReader      = (*LazyConn)(nil)
+	_ N.EarlyWriter      = (*LazyConn)(nil)
+	_ N.VectorisedWriter = (*LazyConn)(nil)
+)
+
+// LazyConn is a CONNECT tunnel whose request is sent with the first write
+// and whose response is read on the first read.
+// If the first read comes LazyRequestTimeout before any write, the request is sent without a payload.
+type LazyConn struct {
+	net.Conn
+	writer         N.VectorisedWriter
+	request        *http.Request
+	writeAccess    sync.Mutex
+	requestWritten atomic.Bool
+	requestDone    chan struct{}
+	readAccess     sync.Mutex
+	responseRead   atomic.Bool
+	responseErr    error
+	cache          *buf.Buffer
+	// direct is set once the response is read and the cache is drained, so reads go to the connection.
+	direct atomic.Bool
+}
+
+func NewLazyConn(conn net.Conn, request *http.Request) *LazyConn {
+	return &LazyConn{
+		Conn:        conn,
+		writer:      bufio.NewVectorisedWriter(conn),
+		request:     request,
+		requestDone: make(chan struct{}),
+	}
+}
+
+func (c *LazyConn) Write(p []byte) (n int, err error) {
+	if c.requestWritten.Load() {
+		return c.Conn.Write(p)
+	}
+	err = c.writeRequest([]*buf.Buffer{buf.As(p)})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *LazyConn) WriteVectorised(buffers []*buf.Buffer) error {
+	if c.requestWritten.Load() {
+		return c.writer.WriteVectorised(buffers)
+	}
+	return c.writeRequest(buffers)
+}
+
+func (c *LazyConn) writeRequest(buffers []*buf.Buffer) error {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	if c.requestWritten.Load() {
+		return c.writer.WriteVectorised(buffers)
+	}
+	var request bytes.Buffer
+	err := c.request.Write(&request)
+	if err != nil {
+		buf.ReleaseMulti(buffers)
+		return err
+	}
+	err = c.writer.WriteVectorised(append([]*buf.Buffer{buf.As(request.Bytes())}, buffers...))
+	if err != nil {
+		return err
+	}
+	c.requestWritten.Store(true)
+	close(c.requestDone)
+	return nil
+}
+
+func (c *LazyConn) Read(p []byte) (n int, err error) {
+	if c.direct.Load() {
+		return c.Conn.Read(p)
+	}
+	c.readAccess.Lock()
+	defer c.readAccess.Unlock()
+	if !c.responseRead.Load() {
+		c.readResponse()
+	}
+	if c.responseErr != nil {
+		return 0, c.responseErr
+	}
+	if c.cache != nil {
+		n, err = c.cache.Read(p)
+		if c.cache.IsEmpty() {
+			c.cache.Release()
+			c.cache = nil
+			c.direct.Store(true)
+		}
+		return
+	}
+	c.direct.Store(true)
+	return c.Conn.Read(p)
+}
+
+func (c *LazyConn) readResponse() {
+	defer c.responseRead.Store(true)
+	timer := time.NewTimer(LazyRequestTimeout)
+	select {
+	case <-c.requestDone:
+		timer.Stop()
+	case <-timer.C:
+		c.responseErr = c.writeRequest(nil)
+		if c.responseErr != nil {
+			return
+		}
+	}
+	reader := std_bufio.NewReader(c.Conn)
+	response, err := http.ReadResponse(reader, c.request)
+	if err != nil {
+		c.responseErr = err
+		return
+	}
+	if response.StatusCode != http.StatusOK {
+		c.Conn.Close()
+		c.responseErr = responseError(c.request, response)
+		return
+	}
+	if reader.Buffered() > 0 {
+		c.cache = buf.NewSize(reader.Buffered())
+		_, c.responseErr = c.cache.ReadFullFrom(reader, reader.Buffered())
+	}
+}
+
+func (c *LazyConn) NeedHandshakeForRead() bool {
+	return !c.responseRead.Load()
+}
+
+func (c *LazyConn) NeedHandshakeForWrite() bool {
+	return !c.requestWritten.Load()
+}
+
+func (c *LazyConn) ReaderReplaceable() bool {
+	return c.direct.Load()
+}
+
+func (c *LazyConn) WriterReplaceable() bool {
+	return c.requestWritten.Load()
+}
+
+func (c *LazyConn) Upstream() any {
+	return c.Conn
+}
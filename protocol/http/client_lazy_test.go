@@ -0,0 +1,184 @@
+package http
+
+import (
+	std_bufio "bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/auth"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testWriteRecorder records the payload of every write to the proxy server.
+type testWriteRecorder struct {
+	net.Conn
+	writes chan []byte
+}
+
+func (c *testWriteRecorder) Write(p []byte) (n int, err error) {
+	c.writes <- bytes.Clone(p)
+	return c.Conn.Write(p)
+}
+
+// testPipeDialer serves every dialed connection with handler over a pipe.
+type testPipeDialer struct {
+	handler N.TCPConnectionHandlerEx
+	options ServerOptions
+	writes  chan []byte
+}
+
+func (d *testPipeDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	serverConn, clientConn := net.Pipe()
+	go func() {
+		err := HandleConnectionWithOptions(context.Background(), serverConn, std_bufio.NewReader(serverConn), d.handler, M.ParseSocksaddr("192.0.2.1:1234"), nil, d.options)
+		if err != nil {
+			serverConn.Close()
+		}
+	}()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if d.writes != nil {
+		return &testWriteRecorder{clientConn, d.writes}, nil
+	}
+	return clientConn, nil
+}
+
+func (d *testPipeDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return nil, net.ErrClosed
+}
+
+// testGreetingHandler writes a greeting before echoing, like protocols in which the server speaks first.
+type testGreetingHandler struct{}
+
+func (h testGreetingHandler) NewConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	go func() {
+		_, err := conn.Write([]byte("hello"))
+		if err == nil {
+			io.Copy(conn, conn)
+		}
+		conn.Close()
+	}()
+}
+
+func (h testGreetingHandler) NewPacketConnectionEx(ctx context.Context, conn N.PacketConn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	conn.Close()
+}
+
+func TestLazyConn(t *testing.T) {
+	t.Parallel()
+	handler := &testEchoHandler{sourceChan: make(chan M.Socksaddr, 1)}
+	dialer := &testPipeDialer{handler: handler, writes: make(chan []byte, 4)}
+	conn, err := NewClient(Options{Dialer: dialer, Lazy: true}).DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddr("1.1.1.1:53"))
+	require.NoError(t, err)
+	defer conn.Close()
+	lazyConn, isLazy := conn.(*LazyConn)
+	require.True(t, isLazy)
+	require.True(t, lazyConn.NeedHandshakeForWrite())
+	require.True(t, lazyConn.NeedHandshakeForRead())
+	testEcho(t, conn)
+	firstWrite := <-dialer.writes
+	require.True(t, bytes.HasPrefix(firstWrite, []byte("CONNECT 1.1.1.1:53 ")), string(firstWrite))
+	require.True(t, bytes.HasSuffix(firstWrite, []byte("ping")), "the first payload should be sent with the request")
+	require.False(t, lazyConn.NeedHandshakeForWrite())
+	require.False(t, lazyConn.NeedHandshakeForRead())
+	require.True(t, lazyConn.ReaderReplaceable())
+	require.Equal(t, M.ParseSocksaddr("192.0.2.1:1234"), <-handler.sourceChan)
+}
+
+func TestLazyConnServerFirst(t *testing.T) {
+	t.Parallel()
+	conn, err := NewClient(Options{Dialer: &testPipeDialer{handler: testGreetingHandler{}}, Lazy: true}).DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddr("1.1.1.1:22"))
+	require.NoError(t, err)
+	defer conn.Close()
+	greeting := make([]byte, 5)
+	_, err = io.ReadFull(conn, greeting)
+	require.NoError(t, err, "a read without a write should send the request on its own")
+	require.Equal(t, "hello", string(greeting))
+	testEcho(t, conn)
+}
+
+func TestLazyConnRejected(t *testing.T) {
+	t.Parallel()
+	dialer := &testPipeDialer{handler: testGreetingHandler{}, options: ServerOptions{
+		Authenticator: auth.NewAuthenticator([]auth.User{{Username: "user", Password: "password"}}),
+	}}
+	conn, err := NewClient(Options{Dialer: dialer, Lazy: true}).DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddr("1.1.1.1:53"))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 4))
+	var authErr *authRequiredError
+	require.ErrorAs(t, err, &authErr)
+}
+
+func TestLazyConnConcurrentRead(t *testing.T) {
+	t.Parallel()
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	request, err := NewClient(Options{}).connectRequest(M.ParseSocksaddr("1.1.1.1:22"))
+	require.NoError(t, err)
+	conn := NewLazyConn(clientConn, request)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	payload := strings.Repeat("hello", 200)
+	go func() {
+		reader := std_bufio.NewReader(serverConn)
+		_, err := http.ReadRequest(reader)
+		if err == nil {
+			go io.Copy(io.Discard, reader)
+			// Half of the payload arrives with the response, so that the reads switch from the cache to the connection.
+			serverConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n" + payload[:len(payload)/2]))
+			serverConn.Write([]byte(payload[len(payload)/2:]))
+		}
+	}()
+	_, err = conn.Write(nil)
+	require.NoError(t, err)
+	var buffer [1]byte
+	_, err = conn.Read(buffer[:])
+	require.NoError(t, err)
+	var (
+		received atomic.Int32
+		group    sync.WaitGroup
+	)
+	received.Store(1)
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		for received.Load() < int32(len(payload)) {
+			_, err := conn.Write([]byte("ping"))
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for range 2 {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			var buffer [1]byte
+			for received.Load() < int32(len(payload)) {
+				n, err := conn.Read(buffer[:])
+				if err != nil {
+					return
+				}
+				received.Add(int32(n))
+			}
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return received.Load() == int32(len(payload))
+	}, 5*time.Second, 5*time.Millisecond)
+	conn.Close()
+	group.Wait()
+}
@@ -0,0 +1,70 @@
+package http
+
+import (
+	"context"
+	std_tls "crypto/tls"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/tls"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientTLSHTTP1(t *testing.T) {
+	t.Parallel()
+	for _, testCase := range []struct {
+		name       string
+		http2      bool
+		nextProtos []string
+	}{
+		{"default", false, nil},
+		{"next protos", false, []string{"h2", "http/1.1"}},
+		{"http2 fallback", true, nil},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			serverConfig, pool := testTLSConfig(t)
+			serverConfig.NextProtos = []string{"http/1.1"}
+			protocolsChan := make(chan []string, 2)
+			serverConfig.GetConfigForClient = func(hello *std_tls.ClientHelloInfo) (*std_tls.Config, error) {
+				protocolsChan <- hello.SupportedProtos
+				return nil, nil
+			}
+			server, sourceChan := testEchoServer(t, tls.NewSTDServer(serverConfig))
+			client := NewClient(Options{
+				Server:    server,
+				HTTP2:     testCase.http2,
+				TLSConfig: tls.NewSTDClient(&tls.STDConfig{ServerName: "example.com", RootCAs: pool, NextProtos: testCase.nextProtos}),
+			})
+			for i := 0; i < 2; i++ {
+				conn, err := client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddr("1.1.1.1:53"))
+				require.NoError(t, err)
+				_, isHTTP2 := conn.(*http2Conn)
+				require.False(t, isHTTP2)
+				testEcho(t, conn)
+				conn.Close()
+				require.Equal(t, M.ParseSocksaddr("192.0.2.1:1234"), <-sourceChan)
+				if testCase.http2 && i == 0 {
+					require.Equal(t, []string{"h2", "http/1.1"}, <-protocolsChan)
+				}
+				// HTTP/2 is not retried once refused, and HTTP/1 connections only offer http/1.1.
+				require.Equal(t, []string{"http/1.1"}, <-protocolsChan)
+			}
+		})
+	}
+}
+
+func TestClientFromURLTLS(t *testing.T) {
+	t.Parallel()
+	client, err := NewClientFromURL(nil, "https://example.com", nil)
+	require.NoError(t, err)
+	require.Equal(t, M.ParseSocksaddr("example.com:443"), client.serverAddr)
+	serverConfig, _ := testTLSConfig(t)
+	server, _ := testEchoServer(t, tls.NewSTDServer(serverConfig))
+	client, err = NewClientFromURL(N.SystemDialer, "https://"+server.String(), nil)
+	require.NoError(t, err)
+	_, err = client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddr("1.1.1.1:53"))
+	require.ErrorContains(t, err, "certificate", "the proxy server should be verified")
+}
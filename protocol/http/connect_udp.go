@@ -0,0 +1,278 @@
+package http
+
+import (
+	std_bufio "bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// RFC 9298 UDP proxying over HTTP, with datagrams carried in RFC 9297 capsules.
+//
+// Capsule {
+//   Capsule Type (i) = 0x00,
+//   Capsule Length (i),
+//   Context ID (i) = 0,
+//   UDP Payload (..),
+// }
+
+const (
+	ConnectUDPProtocol      = "connect-udp"
+	ConnectUDPPathPrefix    = "/.well-known/masque/udp/"
+	capsuleTypeDatagram     = 0x00
+	connectUDPContextID     = 0x00
+	connectUDPFrontHeadroom = 1 + 4 + 1
+)
+
+var ErrInvalidCapsule = E.New("http: invalid capsule")
+
+func isConnectUDPRequest(request *http.Request) bool {
+	return strings.EqualFold(request.Header.Get("Upgrade"), ConnectUDPProtocol)
+}
+
+func connectUDPPath(destination M.Socksaddr) *url.URL {
+	host := destination.AddrString()
+	port := strconv.Itoa(int(destination.Port))
+	return &url.URL{
+		Path:    ConnectUDPPathPrefix + host + "/" + port + "/",
+		RawPath: ConnectUDPPathPrefix + strings.ReplaceAll(url.PathEscape(host), ":", "%3A") + "/" + port + "/",
+	}
+}
+
+func parseConnectUDPPath(requestURL *url.URL) (M.Socksaddr, error) {
+	path, loaded := strings.CutPrefix(requestURL.EscapedPath(), ConnectUDPPathPrefix)
+	if !loaded {
+		return M.Socksaddr{}, E.New("http: connect-udp: unexpected path: ", requestURL.Path)
+	}
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(segments) != 2 {
+		return M.Socksaddr{}, E.New("http: connect-udp: unexpected path: ", requestURL.Path)
+	}
+	host, err := url.PathUnescape(segments[0])
+	if err != nil {
+		return M.Socksaddr{}, E.Cause(err, "http: connect-udp: invalid target host")
+	}
+	port, err := strconv.ParseUint(segments[1], 10, 16)
+	if err != nil || port == 0 {
+		return M.Socksaddr{}, E.New("http: connect-udp: invalid target port: ", segments[1])
+	}
+	destination := M.ParseSocksaddrHostPort(host, uint16(port))
+	if !destination.IsValid() {
+		return M.Socksaddr{}, E.New("http: connect-udp: invalid target host: ", host)
+	}
+	return destination, nil
+}
+
+func handleConnectUDP(
+	ctx context.Context,
+	conn net.Conn,
+	reader *std_bufio.Reader,
+	handler N.TCPConnectionHandlerEx,
+	request *http.Request,
+	source M.Socksaddr,
+	onClose N.CloseHandlerFunc,
+) error {
+	udpHandler, isUDPHandler := handler.(N.UDPConnectionHandlerEx)
+	if !isUDPHandler {
+		return E.Errors(E.New("http: connect-udp: udp not supported by handler"), responseWith(request, http.StatusNotImplemented).Write(conn))
+	}
+	destination, err := parseConnectUDPPath(request.URL)
+	if err != nil {
+		return E.Errors(err, responseWith(request, http.StatusBadRequest).Write(conn))
+	}
+	err = responseWith(request, http.StatusSwitchingProtocols,
+		"Connection", "Upgrade",
+		"Upgrade", ConnectUDPProtocol,
+		"Capsule-Protocol", "?1",
+	).Write(conn)
+	if err != nil {
+		return E.Cause(err, "http: write connect-udp response")
+	}
+	udpHandler.NewPacketConnectionEx(ctx, NewConnectUDPConn(conn, reader, destination), source, destination, onClose)
+	return nil
+}
+
+var (
+	_ N.NetPacketConn = (*ConnectUDPConn)(nil)
+	_ N.FrontHeadroom = (*ConnectUDPConn)(nil)
+)
+
+// ConnectUDPConn is a UDP association to a single destination established by CONNECT-UDP.
+type ConnectUDPConn struct {
+	N.AbstractConn
+	conn        N.ExtendedConn
+	reader      *std_bufio.Reader
+	destination M.Socksaddr
+}
+
+func NewConnectUDPConn(conn net.Conn, reader *std_bufio.Reader, destination M.Socksaddr) *ConnectUDPConn {
+	if reader == nil {
+		reader = std_bufio.NewReader(conn)
+	}
+	return &ConnectUDPConn{
+		AbstractConn: conn,
+		conn:         bufio.NewExtendedConn(conn),
+		reader:       reader,
+		destination:  destination,
+	}
+}
+
+func (c *ConnectUDPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	buffer := buf.With(p)
+	destination, err := c.ReadPacket(buffer)
+	if err != nil {
+		return
+	}
+	addr = destination.UDPAddr()
+	n = buffer.Len()
+	return
+}
+
+func (c *ConnectUDPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	buffer := buf.NewSize(connectUDPFrontHeadroom + len(p))
+	buffer.Resize(connectUDPFrontHeadroom, 0)
+	common.Must1(buffer.Write(p))
+	err = c.WritePacket(buffer, M.SocksaddrFromNet(addr))
+	if err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+func (c *ConnectUDPConn) ReadPacket(buffer *buf.Buffer) (destination M.Socksaddr, err error) {
+	for {
+		var capsuleType, length, contextID uint64
+		capsuleType, err = readQUICVarint(c.reader)
+		if err != nil {
+			return
+		}
+		length, err = readQUICVarint(c.reader)
+		if err != nil {
+			return
+		}
+		if capsuleType != capsuleTypeDatagram {
+			_, err = io.CopyN(io.Discard, c.reader, int64(length))
+			if err != nil {
+				return
+			}
+			continue
+		}
+		contextID, err = readQUICVarint(c.reader)
+		if err != nil {
+			return
+		}
+		contextIDLen := uint64(quicVarintLen(contextID))
+		if length < contextIDLen {
+			return M.Socksaddr{}, ErrInvalidCapsule
+		}
+		payloadLen := length - contextIDLen
+		if contextID != connectUDPContextID {
+			_, err = io.CopyN(io.Discard, c.reader, int64(payloadLen))
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if payloadLen > uint64(buffer.FreeLen()) {
+			_, err = io.CopyN(io.Discard, c.reader, int64(payloadLen))
+			if err != nil {
+				return
+			}
+			return M.Socksaddr{}, io.ErrShortBuffer
+		}
+		_, err = buffer.ReadFullFrom(c.reader, int(payloadLen))
+		if err != nil {
+			return
+		}
+		return c.destination, nil
+	}
+}
+
+// WritePacket sends buffer to the destination of the association; the destination argument is ignored.
+func (c *ConnectUDPConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	length := uint64(quicVarintLen(connectUDPContextID) + buffer.Len())
+	header := buffer.ExtendHeader(1 + quicVarintLen(length) + quicVarintLen(connectUDPContextID))
+	header[0] = capsuleTypeDatagram
+	putQUICVarint(header[1:], length)
+	header[len(header)-1] = connectUDPContextID
+	return c.conn.WriteBuffer(buffer)
+}
+
+func (c *ConnectUDPConn) Read(b []byte) (n int, err error) {
+	n, _, err = c.ReadFrom(b)
+	return
+}
+
+func (c *ConnectUDPConn) Write(b []byte) (n int, err error) {
+	return c.WriteTo(b, c.destination)
+}
+
+func (c *ConnectUDPConn) RemoteAddr() net.Addr {
+	return c.destination.UDPAddr()
+}
+
+func (c *ConnectUDPConn) Upstream() any {
+	return c.conn
+}
+
+func (c *ConnectUDPConn) FrontHeadroom() int {
+	return connectUDPFrontHeadroom
+}
+
+func quicVarintLen(value uint64) int {
+	switch {
+	case value <= 63:
+		return 1
+	case value <= 16383:
+		return 2
+	case value <= 1073741823:
+		return 4
+	default:
+		return 8
+	}
+}
+
+func putQUICVarint(b []byte, value uint64) int {
+	length := quicVarintLen(value)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = byte(value)
+		value >>= 8
+	}
+	switch length {
+	case 2:
+		b[0] |= 0x40
+	case 4:
+		b[0] |= 0x80
+	case 8:
+		b[0] |= 0xC0
+	}
+	return length
+}
+
+func readQUICVarint(reader io.ByteReader) (uint64, error) {
+	first, err := reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	length := 1 << (first >> 6)
+	value := uint64(first & 0x3F)
+	for i := 1; i < length; i++ {
+		next, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<8 | uint64(next)
+	}
+	return value, nil
+}
@@ -0,0 +1,34 @@
+package http
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectUDPOversizedCapsule(t *testing.T) {
+	t.Parallel()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	serverConn.SetDeadline(time.Now().Add(5 * time.Second))
+	destination := M.ParseSocksaddr("1.1.1.1:53")
+	client := NewConnectUDPConn(clientConn, nil, destination)
+	server := NewConnectUDPConn(serverConn, nil, destination)
+	go func() {
+		client.Write([]byte("oversized payload"))
+		client.Write([]byte("ok"))
+	}()
+	buffer := make([]byte, 4)
+	_, _, err := server.ReadFrom(buffer)
+	require.ErrorIs(t, err, io.ErrShortBuffer)
+	n, addr, err := server.ReadFrom(buffer)
+	require.NoError(t, err)
+	require.Equal(t, "ok", string(buffer[:n]))
+	require.Equal(t, destination, M.SocksaddrFromNet(addr))
+}
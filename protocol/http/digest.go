@@ -0,0 +1,223 @@
+package http
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/auth"
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+const DefaultDigestNonceTimeout = 5 * time.Minute
+
+const (
+	// maxDigestNonces bounds the issued nonces, the oldest is forgotten first.
+	maxDigestNonces = 4096
+	// digestCountWindow is how far behind the highest nonce count seen a request may arrive.
+	digestCountWindow = 64
+)
+
+// DigestAuthenticator implements RFC 7616 Digest access authentication with qop=auth.
+// Issued nonces are tracked until they expire, and a nonce count may not be reused.
+// Counts may arrive out of order within a window, since a client may share a nonce between concurrent requests.
+type DigestAuthenticator struct {
+	users   auth.PasswordLookup
+	timeout time.Duration
+	access  sync.Mutex
+	nonces  map[string]*digestNonce
+	order   []string
+}
+
+type digestNonce struct {
+	expireAt time.Time
+	count    uint64
+	// seen has bit n set if count-n was used.
+	seen uint64
+}
+
+func NewDigestAuthenticator(users auth.PasswordLookup, nonceTimeout time.Duration) *DigestAuthenticator {
+	if nonceTimeout == 0 {
+		nonceTimeout = DefaultDigestNonceTimeout
+	}
+	return &DigestAuthenticator{
+		users:   users,
+		timeout: nonceTimeout,
+		nonces:  make(map[string]*digestNonce),
+	}
+}
+
+func (a *DigestAuthenticator) newNonce() string {
+	var nonceBytes [16]byte
+	common.Must1(rand.Read(nonceBytes[:]))
+	nonce := hex.EncodeToString(nonceBytes[:])
+	now := time.Now()
+	a.access.Lock()
+	defer a.access.Unlock()
+	// nonces share one timeout, so the issue order is also the expiry order.
+	for len(a.order) > 0 && (len(a.order) >= maxDigestNonces || now.After(a.nonces[a.order[0]].expireAt)) {
+		delete(a.nonces, a.order[0])
+		a.order = a.order[1:]
+	}
+	a.nonces[nonce] = &digestNonce{expireAt: now.Add(a.timeout)}
+	a.order = append(a.order, nonce)
+	return nonce
+}
+
+// useNonce reports whether nonce is still valid, and whether count was not seen before.
+func (a *DigestAuthenticator) useNonce(nonce string, count uint64) (valid bool, fresh bool) {
+	a.access.Lock()
+	defer a.access.Unlock()
+	state, loaded := a.nonces[nonce]
+	if !loaded || time.Now().After(state.expireAt) {
+		return false, false
+	}
+	if count == 0 {
+		return true, false
+	}
+	if count > state.count {
+		shift := count - state.count
+		if shift >= digestCountWindow {
+			state.seen = 0
+		} else {
+			state.seen <<= shift
+		}
+		state.seen |= 1
+		state.count = count
+		return true, true
+	}
+	offset := state.count - count
+	if offset >= digestCountWindow || state.seen&(1<<offset) != 0 {
+		return true, false
+	}
+	state.seen |= 1 << offset
+	return true, true
+}
+
+func (a *DigestAuthenticator) challenges(realm string, stale bool) []string {
+	nonce := a.newNonce()
+	var staleParam string
+	if stale {
+		staleParam = ", stale=true"
+	}
+	return common.Map([]string{"SHA-256", "MD5"}, func(algorithm string) string {
+		return "Digest realm=" + quoteAuthParam(realm) + `, qop="auth", algorithm=` + algorithm + `, nonce="` + nonce + `", charset=UTF-8` + staleParam
+	})
+}
+
+func (a *DigestAuthenticator) verify(ctx context.Context, method string, uri string, realm string, params map[string]string) (context.Context, bool, error) {
+	username := params["username"]
+	if params["userhash"] == "true" {
+		return nil, false, E.New("http: digest: userhash not supported")
+	}
+	if params["realm"] != realm {
+		return nil, false, E.New("http: digest: unexpected realm: ", params["realm"])
+	}
+	if params["uri"] != uri {
+		return nil, false, E.New("http: digest: unexpected uri: ", params["uri"])
+	}
+	if params["qop"] != "auth" {
+		return nil, false, E.New("http: digest: unsupported qop: ", params["qop"])
+	}
+	count, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil || params["cnonce"] == "" {
+		return nil, false, E.New("http: digest: missing nonce count")
+	}
+	newHash, sess, err := digestAlgorithm(params["algorithm"])
+	if err != nil {
+		return nil, false, err
+	}
+	response := []byte(params["response"])
+	var passwords []string
+	// a nil lookup has no users
+	if a.users != nil {
+		passwords = a.users.Passwords(username)
+	}
+	matched := common.Any(passwords, func(password string) bool {
+		expected := digestResponse(newHash, sess, username, realm, password, method, uri, params["nonce"], params["nc"], params["cnonce"], "auth")
+		return subtle.ConstantTimeCompare([]byte(expected), response) == 1
+	})
+	if !matched {
+		return nil, false, E.New("http: authentication failed, username=", username)
+	}
+	valid, fresh := a.useNonce(params["nonce"], count)
+	if !valid {
+		return nil, true, E.New("http: digest: stale nonce, username=", username)
+	}
+	if !fresh {
+		return nil, true, E.New("http: digest: replayed nonce count, username=", username)
+	}
+	return auth.ContextWithUser(ctx, username), false, nil
+}
+
+func digestAlgorithm(algorithm string) (newHash func() hash.Hash, sess bool, err error) {
+	algorithm, sess = strings.CutSuffix(strings.ToUpper(algorithm), "-SESS")
+	switch algorithm {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	case "SHA-512-256":
+		newHash = sha512.New512_256
+	default:
+		err = E.New("http: digest: unsupported algorithm: ", algorithm)
+	}
+	return
+}
+
+func digestResponse(newHash func() hash.Hash, sess bool, username, realm, password, method, uri, nonce, nc, cnonce, qop string) string {
+	h := func(values ...string) string {
+		hasher := newHash()
+		hasher.Write([]byte(strings.Join(values, ":")))
+		return hex.EncodeToString(hasher.Sum(nil))
+	}
+	ha1 := h(username, realm, password)
+	if sess {
+		ha1 = h(ha1, nonce, cnonce)
+	}
+	return h(ha1, nonce, nc, cnonce, qop, h(method, uri))
+}
+
+// parseAuthParams parses the comma-separated auth-param list of a credentials or challenge header.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+		key, rest, found := strings.Cut(s, "=")
+		if !found {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var builder strings.Builder
+			index := 1
+			for ; index < len(rest) && rest[index] != '"'; index++ {
+				if rest[index] == '\\' && index+1 < len(rest) {
+					index++
+				}
+				builder.WriteByte(rest[index])
+			}
+			value = builder.String()
+			s = rest[min(index+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+}
@@ -0,0 +1,120 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const DefaultViaPseudonym = "sing-box"
+
+// ForwardPolicy controls how a forwarding header is handled on requests relayed by the proxy.
+type ForwardPolicy uint8
+
+const (
+	// ForwardPolicyPassThrough leaves the header as sent by the client.
+	ForwardPolicyPassThrough ForwardPolicy = iota
+	// ForwardPolicyAdd appends an entry for this hop to the header.
+	ForwardPolicyAdd
+	// ForwardPolicyStrip removes the header.
+	ForwardPolicyStrip
+)
+
+type ForwardOptions struct {
+	// Forwarded is the policy for the RFC 7239 Forwarded header.
+	Forwarded     ForwardPolicy
+	XForwardedFor ForwardPolicy
+	Via           ForwardPolicy
+	// ViaPseudonym is the received-by value of added Via entries, defaults to DefaultViaPseudonym.
+	ViaPseudonym string
+}
+
+// apply rewrites the forwarding headers in header of a request received from source.
+func (o ForwardOptions) apply(request *http.Request, header http.Header, source M.Socksaddr) {
+	switch o.Forwarded {
+	case ForwardPolicyAdd:
+		element := "for=" + forwardedNode(source)
+		if request.Host != "" {
+			element += ";host=" + forwardedValue(request.Host)
+		}
+		element += ";proto=" + forwardedProto(request)
+		appendHeader(header, "Forwarded", element)
+	case ForwardPolicyStrip:
+		header.Del("Forwarded")
+	}
+	switch o.XForwardedFor {
+	case ForwardPolicyAdd:
+		if source.Addr.IsValid() {
+			appendHeader(header, "X-Forwarded-For", source.Addr.Unmap().String())
+		}
+	case ForwardPolicyStrip:
+		header.Del("X-Forwarded-For")
+	}
+	switch o.Via {
+	case ForwardPolicyAdd:
+		pseudonym := o.ViaPseudonym
+		if pseudonym == "" {
+			pseudonym = DefaultViaPseudonym
+		}
+		version := strconv.Itoa(request.ProtoMajor)
+		if request.ProtoMajor < 2 {
+			version += "." + strconv.Itoa(request.ProtoMinor)
+		}
+		appendHeader(header, "Via", version+" "+pseudonym)
+	case ForwardPolicyStrip:
+		header.Del("Via")
+	}
+}
+
+func appendHeader(header http.Header, key string, value string) {
+	values := header.Values(key)
+	if len(values) == 0 {
+		header.Set(key, value)
+		return
+	}
+	header.Set(key, strings.Join(append(values, value), ", "))
+}
+
+func forwardedNode(source M.Socksaddr) string {
+	if !source.Addr.IsValid() {
+		return "unknown"
+	}
+	addr := source.Addr.Unmap()
+	if addr.Is4() {
+		if source.Port == 0 {
+			return addr.String()
+		}
+		return `"` + addr.String() + ":" + strconv.Itoa(int(source.Port)) + `"`
+	}
+	node := "[" + addr.String() + "]"
+	if source.Port != 0 {
+		node += ":" + strconv.Itoa(int(source.Port))
+	}
+	return `"` + node + `"`
+}
+
+func forwardedProto(request *http.Request) string {
+	if request.URL != nil && request.URL.Scheme != "" {
+		return strings.ToLower(request.URL.Scheme)
+	}
+	if request.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedValue quotes value unless it is a valid RFC 7230 token.
+func forwardedValue(value string) string {
+	for _, char := range value {
+		if !isTokenChar(char) {
+			return quoteAuthParam(value)
+		}
+	}
+	return value
+}
+
+func isTokenChar(char rune) bool {
+	return char < 0x80 && (char >= '0' && char <= '9' || char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || strings.ContainsRune("!#$%&'*+-.^_`|~", char))
+}
@@ -0,0 +1,34 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardOptions(t *testing.T) {
+	t.Parallel()
+	request, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	require.NoError(t, err)
+	request.Header.Set("X-Forwarded-For", "10.0.0.1")
+	request.Header.Set("Via", "1.1 upstream")
+	ForwardOptions{
+		Forwarded:     ForwardPolicyAdd,
+		XForwardedFor: ForwardPolicyAdd,
+		Via:           ForwardPolicyAdd,
+	}.apply(request, request.Header, M.ParseSocksaddr("[2001:db8::1]:1080"))
+	require.Equal(t, `for="[2001:db8::1]:1080";host=example.com;proto=http`, request.Header.Get("Forwarded"))
+	require.Equal(t, "10.0.0.1, 2001:db8::1", request.Header.Get("X-Forwarded-For"))
+	require.Equal(t, "1.1 upstream, 1.1 "+DefaultViaPseudonym, request.Header.Get("Via"))
+
+	ForwardOptions{
+		Forwarded:     ForwardPolicyStrip,
+		XForwardedFor: ForwardPolicyStrip,
+	}.apply(request, request.Header, M.Socksaddr{})
+	require.Empty(t, request.Header.Values("Forwarded"))
+	require.Empty(t, request.Header.Values("X-Forwarded-For"))
+	require.Equal(t, "1.1 upstream, 1.1 "+DefaultViaPseudonym, request.Header.Get("Via"))
+}
@@ -6,7 +6,9 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/auth"
@@ -23,25 +25,51 @@ func HandleConnectionEx(
 	ctx context.Context,
 	conn net.Conn,
 	reader *std_bufio.Reader,
-	authenticator *auth.Authenticator,
+	authenticator auth.Verifier,
 	handler N.TCPConnectionHandlerEx,
 	source M.Socksaddr,
 	onClose N.CloseHandlerFunc,
 ) error {
+	return HandleConnectionWithOptions(ctx, conn, reader, handler, source, onClose, ServerOptions{
+		Authenticator: authenticator,
+	})
+}
+
+// HandleConnectionWithOptions serves HTTP/1.1 and, if the connection starts with the client preface, HTTP/2.
+// Over HTTP/2, RFC 8441 extended CONNECT, which carries CONNECT-UDP and upgrade requests, is only accepted
+// by net/http if GODEBUG contains http2xconnect=1; otherwise such streams are reset and only CONNECT is served.
+func HandleConnectionWithOptions(
+	ctx context.Context,
+	conn net.Conn,
+	reader *std_bufio.Reader,
+	handler N.TCPConnectionHandlerEx,
+	source M.Socksaddr,
+	onClose N.CloseHandlerFunc,
+	options ServerOptions,
+) error {
+	if isHTTP2Preface(reader) {
+		return handleHTTP2Connection(ctx, conn, reader, handler, source, options)
+	}
+	peer := source
+	var forwarder *httpForwarder
+	defer func() {
+		if forwarder != nil {
+			forwarder.Close()
+		}
+	}()
 	for {
 		request, err := ReadRequest(reader)
 		if err != nil {
 			return E.Cause(err, "read http request")
 		}
-		if authenticator != nil {
-			username, password, authOk := ParseBasicAuth(request.Header.Get("Proxy-Authorization"))
-			authOk = authOk && authenticator.Verify(username, password)
-			if authOk {
-				ctx = auth.ContextWithUser(ctx, username)
-			} else {
+		if options.authEnabled() {
+			authCtx, stale, authErr := options.authenticate(ctx, request)
+			if authErr != nil {
 				keepAlive := !(request.ProtoMajor == 1 && request.ProtoMinor == 0) && strings.TrimSpace(strings.ToLower(request.Header.Get("Proxy-Connection"))) == "keep-alive" && request.ContentLength == 0
-				// Since no one else is using the library, use a fixed realm until rewritten
-				headers := []string{"Proxy-Authenticate", `Basic realm="sing-box" charset="UTF-8"`}
+				var headers []string
+				for _, challenge := range options.challenges(stale) {
+					headers = append(headers, "Proxy-Authenticate", challenge)
+				}
 				if !keepAlive {
 					headers = append(headers, "Connection", "close")
 				}
@@ -52,21 +80,12 @@ func HandleConnectionEx(
 				if keepAlive {
 					continue
 				}
-				authorization := request.Header.Get("Proxy-Authorization")
-				switch {
-				case username != "":
-					return E.New("http: authentication failed, username=", username, ", password=", password)
-				case authorization != "":
-					return E.New("http: authentication failed, Proxy-Authorization=", authorization)
-				default:
-					return E.New("http: authentication failed, no Proxy-Authorization header")
-				}
+				return authErr
 			}
+			ctx = authCtx
 		}
 
-		if sourceAddress := SourceAddress(request); sourceAddress.IsValid() {
-			source = sourceAddress
-		}
+		source = requestSource(request, peer)
 
 		if request.Method == "CONNECT" {
 			destination := M.ParseSocksaddrHostPortStr(request.URL.Hostname(), request.URL.Port()).Unwrap()
@@ -95,6 +114,8 @@ func HandleConnectionEx(
 			}
 			handler.NewConnectionEx(ctx, requestConn, source, destination, onClose)
 			return nil
+		} else if isConnectUDPRequest(request) {
+			return handleConnectUDP(ctx, conn, reader, handler, request, source, onClose)
 		} else if strings.ToLower(request.Header.Get("Connection")) == "upgrade" {
 			destination := M.ParseSocksaddrHostPortStr(request.URL.Hostname(), request.URL.Port()).Unwrap()
 			if destination.Port == 0 {
@@ -113,6 +134,7 @@ func HandleConnectionEx(
 					}
 				})
 			}()
+			options.Forward.apply(request, request.Header, peer)
 			err = request.Write(serverConn)
 			if err != nil {
 				return E.Cause(err, "http: write upgrade request")
@@ -125,7 +147,14 @@ func HandleConnectionEx(
 			}
 			return bufio.CopyConn(ctx, conn, serverConn)
 		} else {
-			err = handleHTTPConnection(ctx, handler, conn, request, source)
+			if forwarder != nil && !forwarder.reusable(ctx, source) {
+				forwarder.Close()
+				forwarder = nil
+			}
+			if forwarder == nil {
+				forwarder = newHTTPForwarder(ctx, handler, source)
+			}
+			err = handleHTTPConnection(ctx, forwarder, conn, request, source, peer, options.Forward)
 			if err != nil {
 				return err
 			}
@@ -135,9 +164,11 @@ func HandleConnectionEx(
 
 func handleHTTPConnection(
 	ctx context.Context,
-	handler N.TCPConnectionHandlerEx,
+	forwarder *httpForwarder,
 	conn net.Conn,
 	request *http.Request, source M.Socksaddr,
+	peer M.Socksaddr,
+	forward ForwardOptions,
 ) error {
 	keepAlive := !(request.ProtoMajor == 1 && request.ProtoMinor == 0) && strings.TrimSpace(strings.ToLower(request.Header.Get("Proxy-Connection"))) == "keep-alive"
 	request.RequestURI = ""
@@ -155,30 +186,14 @@ func handleHTTPConnection(
 		return responseWith(request, http.StatusBadRequest).Write(conn)
 	}
 
-	var innerErr common.TypedValue[error]
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			DisableCompression: true,
-			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
-				input, output := pipe.Pipe()
-				go handler.NewConnectionEx(ctx, output, source, M.ParseSocksaddr(address).Unwrap(), func(it error) {
-					innerErr.Store(it)
-					common.Close(input, output)
-				})
-				return input, nil
-			},
-		},
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-	defer httpClient.CloseIdleConnections()
+	forward.apply(request, request.Header, peer)
 
+	forwarder.innerErr.Store(nil)
 	requestCtx, cancel := context.WithCancel(ctx)
-	response, err := httpClient.Do(request.WithContext(requestCtx))
+	response, err := forwarder.client.Do(request.WithContext(requestCtx))
 	if err != nil {
 		cancel()
-		return E.Errors(innerErr.Load(), err, responseWith(request, http.StatusBadGateway).Write(conn))
+		return E.Errors(forwarder.innerErr.Load(), err, responseWith(request, http.StatusBadGateway).Write(conn))
 	}
 
 	removeHopByHopHeaders(response.Header)
@@ -194,7 +209,7 @@ func handleHTTPConnection(
 	err = response.Write(conn)
 	if err != nil {
 		cancel()
-		return E.Errors(innerErr.Load(), err)
+		return E.Errors(forwarder.innerErr.Load(), err)
 	}
 
 	cancel()
@@ -204,6 +219,59 @@ func handleHTTPConnection(
 	return nil
 }
 
+// httpForwarder keeps upstream connections of plain HTTP requests alive
+// across the requests of a single inbound connection that share a source and user,
+// since the handler routes each upstream connection by those of the request that dialed it.
+type httpForwarder struct {
+	client   *http.Client
+	source   M.Socksaddr
+	user     any
+	innerErr common.TypedValue[error]
+}
+
+func newHTTPForwarder(ctx context.Context, handler N.TCPConnectionHandlerEx, source M.Socksaddr) *httpForwarder {
+	user, _ := auth.UserFromContext[any](ctx)
+	forwarder := &httpForwarder{source: source, user: user}
+	forwarder.client = &http.Client{
+		Transport: &http.Transport{
+			DisableCompression: true,
+			IdleConnTimeout:    90 * time.Second,
+			DialContext: func(_ context.Context, network, address string) (net.Conn, error) {
+				input, output := pipe.Pipe()
+				// The upstream connection is pooled, so it gets the context of the inbound connection
+				// instead of that of the request that dialed it.
+				go handler.NewConnectionEx(ctx, output, source, M.ParseSocksaddr(address).Unwrap(), func(it error) {
+					if it != nil {
+						forwarder.innerErr.Store(it)
+					}
+					common.Close(input, output)
+				})
+				return input, nil
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return forwarder
+}
+
+// reusable reports whether a request with ctx and source may use the upstream connections of the forwarder.
+func (f *httpForwarder) reusable(ctx context.Context, source M.Socksaddr) bool {
+	if source != f.source {
+		return false
+	}
+	user, _ := auth.UserFromContext[any](ctx)
+	if user == nil || f.user == nil {
+		return user == f.user
+	}
+	return reflect.TypeOf(user).Comparable() && user == f.user
+}
+
+func (f *httpForwarder) Close() {
+	f.client.CloseIdleConnections()
+}
+
 func removeHopByHopHeaders(header http.Header) {
 	// Strip hop-by-hop header based on RFC:
 	// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html#sec13.5.1
@@ -0,0 +1,133 @@
+package http
+
+import (
+	std_bufio "bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/auth"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testUpstreamHandler serves keep-alive HTTP responses on every forwarded connection.
+type testUpstreamHandler struct {
+	dials   atomic.Int32
+	dialers chan string
+	closed  chan struct{}
+}
+
+func (h *testUpstreamHandler) NewConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	h.dials.Add(1)
+	if h.dialers != nil {
+		user, _ := auth.UserFromContext[string](ctx)
+		h.dialers <- user + "@" + source.Addr.String()
+	}
+	go func() {
+		defer func() {
+			conn.Close()
+			h.closed <- struct{}{}
+		}()
+		reader := std_bufio.NewReader(conn)
+		for {
+			request, err := http.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, request.Body)
+			_, err = io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (h *testUpstreamHandler) NewPacketConnectionEx(ctx context.Context, conn N.PacketConn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	conn.Close()
+}
+
+func TestHTTPForwardKeepAlive(t *testing.T) {
+	t.Parallel()
+	handler := &testUpstreamHandler{closed: make(chan struct{}, 1)}
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	done := make(chan error, 1)
+	go func() {
+		done <- HandleConnectionWithOptions(context.Background(), serverConn, std_bufio.NewReader(serverConn), handler, M.ParseSocksaddr("192.0.2.1:1234"), nil, ServerOptions{})
+		serverConn.Close()
+	}()
+	reader := std_bufio.NewReader(clientConn)
+	for i := 0; i < 3; i++ {
+		_, err := io.WriteString(clientConn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nProxy-Connection: keep-alive\r\n\r\n")
+		require.NoError(t, err)
+		response, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		require.Equal(t, "ok", string(body))
+	}
+	require.Equal(t, int32(1), handler.dials.Load(), "requests of one inbound connection should share the upstream connection")
+
+	clientConn.Close()
+	<-done
+	select {
+	case <-handler.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream connection not closed with the inbound connection")
+	}
+}
+
+func TestHTTPForwardIdentity(t *testing.T) {
+	t.Parallel()
+	handler := &testUpstreamHandler{dialers: make(chan string, 4), closed: make(chan struct{}, 4)}
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		HandleConnectionWithOptions(context.Background(), serverConn, std_bufio.NewReader(serverConn), handler, M.ParseSocksaddr("192.0.2.1:1234"), nil, ServerOptions{
+			Authenticator: auth.NewAuthenticator([]auth.User{{Username: "a", Password: "a"}, {Username: "b", Password: "b"}}),
+		})
+		serverConn.Close()
+	}()
+	reader := std_bufio.NewReader(clientConn)
+	for _, testCase := range []struct {
+		user      string
+		forwarded string
+		dialer    string
+	}{
+		{"a", "", "a@192.0.2.1"},
+		{"a", "", ""},
+		{"b", "", "b@192.0.2.1"},
+		{"b", "10.0.0.1", "b@10.0.0.1"},
+		{"b", "10.0.0.1", ""},
+	} {
+		request, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		require.NoError(t, err)
+		request.SetBasicAuth(testCase.user, testCase.user)
+		request.Header.Set("Proxy-Authorization", request.Header.Get("Authorization"))
+		request.Header.Del("Authorization")
+		request.Header.Set("Proxy-Connection", "keep-alive")
+		if testCase.forwarded != "" {
+			request.Header.Set("X-Forwarded-For", testCase.forwarded)
+		}
+		require.NoError(t, request.WriteProxy(clientConn))
+		response, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		io.Copy(io.Discard, response.Body)
+		require.Equal(t, http.StatusOK, response.StatusCode)
+		if testCase.dialer == "" {
+			require.Empty(t, handler.dialers, "requests of the same source and user should share the upstream connection")
+		} else {
+			require.Equal(t, testCase.dialer, <-handler.dialers)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package http
+
+import (
+	std_bufio "bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/pipe"
+)
+
+// isHTTP2Preface reports whether the connection starts with the HTTP/2 client preface,
+// which is sent with prior knowledge over h2c or after h2 is negotiated by ALPN.
+func isHTTP2Preface(reader *std_bufio.Reader) bool {
+	header, err := reader.Peek(3)
+	return err == nil && string(header) == "PRI"
+}
+
+func handleHTTP2Connection(
+	ctx context.Context,
+	conn net.Conn,
+	reader *std_bufio.Reader,
+	handler N.TCPConnectionHandlerEx,
+	source M.Socksaddr,
+	options ServerOptions,
+) error {
+	if reader.Buffered() > 0 {
+		buffer := buf.NewSize(reader.Buffered())
+		_, err := buffer.ReadFullFrom(reader, reader.Buffered())
+		if err != nil {
+			return err
+		}
+		conn = bufio.NewCachedConn(conn, buffer)
+	}
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{
+		Handler: &http2Handler{
+			options: options,
+			handler: handler,
+			source:  source,
+		},
+		Protocols: &protocols,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	stop := context.AfterFunc(ctx, func() {
+		server.Close()
+	})
+	defer stop()
+	err := server.Serve(newSingleConnListener(conn))
+	if err == net.ErrClosed || err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// http2ProtocolHeader is the header net/http exposes the :protocol pseudo-header of an extended CONNECT request as.
+const http2ProtocolHeader = ":protocol"
+
+// extendedConnectProtocol returns the protocol of an RFC 8441 extended CONNECT request, or an empty string.
+// net/http advertises extended CONNECT and passes :protocol through only if GODEBUG contains http2xconnect=1.
+func extendedConnectProtocol(request *http.Request) string {
+	return request.Header.Get(http2ProtocolHeader)
+}
+
+type http2Handler struct {
+	options ServerOptions
+	handler N.TCPConnectionHandlerEx
+	source  M.Socksaddr
+}
+
+func (h *http2Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	if h.options.authEnabled() {
+		authCtx, stale, err := h.options.authenticate(ctx, request)
+		if err != nil {
+			for _, challenge := range h.options.challenges(stale) {
+				writer.Header().Add("Proxy-Authenticate", challenge)
+			}
+			writer.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		ctx = authCtx
+	}
+	source := requestSource(request, h.source)
+	if request.Method != http.MethodConnect {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	protocol := extendedConnectProtocol(request)
+	destination := M.ParseSocksaddr(request.Host)
+	if destination.Port == 0 {
+		if request.TLS != nil {
+			destination.Port = 443
+		} else {
+			destination.Port = 80
+		}
+	}
+	if protocol == ConnectUDPProtocol {
+		h.handleConnectUDP(ctx, writer, request, source)
+		return
+	} else if protocol != "" {
+		h.handleExtendedConnect(ctx, writer, request, protocol, source, destination)
+		return
+	}
+	controller := http.NewResponseController(writer)
+	writer.WriteHeader(http.StatusOK)
+	err := controller.Flush()
+	if err != nil {
+		return
+	}
+	conn := newHTTP2ServerConn(request, writer, controller)
+	defer conn.finish()
+	h.handler.NewConnectionEx(ctx, conn, source, destination, func(it error) {
+		conn.Close()
+	})
+	select {
+	case <-conn.done:
+	case <-ctx.Done():
+	}
+}
+
+func (h *http2Handler) handleConnectUDP(ctx context.Context, writer http.ResponseWriter, request *http.Request, source M.Socksaddr) {
+	udpHandler, isUDPHandler := h.handler.(N.UDPConnectionHandlerEx)
+	if !isUDPHandler {
+		writer.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	destination, err := parseConnectUDPPath(request.URL)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	controller := http.NewResponseController(writer)
+	writer.Header().Set("Capsule-Protocol", "?1")
+	writer.WriteHeader(http.StatusOK)
+	err = controller.Flush()
+	if err != nil {
+		return
+	}
+	conn := newHTTP2ServerConn(request, writer, controller)
+	defer conn.finish()
+	udpHandler.NewPacketConnectionEx(ctx, NewConnectUDPConn(conn, nil, destination), source, destination, func(it error) {
+		conn.Close()
+	})
+	select {
+	case <-conn.done:
+	case <-ctx.Done():
+	}
+}
+
+// handleExtendedConnect translates an RFC 8441 extended CONNECT request into an HTTP/1.1 Upgrade request
+// to the destination and relays the upgraded stream.
+func (h *http2Handler) handleExtendedConnect(ctx context.Context, writer http.ResponseWriter, request *http.Request, protocol string, source M.Socksaddr, destination M.Socksaddr) {
+	header := request.Header.Clone()
+	header.Del(http2ProtocolHeader)
+	removeHopByHopHeaders(header)
+	h.options.Forward.apply(request, header, h.source)
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", protocol)
+	if protocol == "websocket" && header.Get("Sec-WebSocket-Key") == "" {
+		var key [16]byte
+		common.Must1(rand.Read(key[:]))
+		header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key[:]))
+	}
+	upgradeRequest := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: request.URL.Path, RawPath: request.URL.RawPath, RawQuery: request.URL.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Host:       request.Host,
+	}
+	serverConn, clientConn := pipe.Pipe()
+	go h.handler.NewConnectionEx(ctx, clientConn, source, destination, func(it error) {
+		common.Close(serverConn, clientConn)
+	})
+	defer serverConn.Close()
+	err := upgradeRequest.Write(serverConn)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	reader := std_bufio.NewReader(serverConn)
+	response, err := http.ReadResponse(reader, upgradeRequest)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	removeHopByHopHeaders(response.Header)
+	response.Header.Del("Sec-WebSocket-Accept")
+	for key, values := range response.Header {
+		writer.Header()[key] = values
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		writer.WriteHeader(response.StatusCode)
+		io.Copy(writer, response.Body)
+		response.Body.Close()
+		return
+	}
+	controller := http.NewResponseController(writer)
+	writer.WriteHeader(http.StatusOK)
+	err = controller.Flush()
+	if err != nil {
+		return
+	}
+	var upstream net.Conn = serverConn
+	if reader.Buffered() > 0 {
+		buffer := buf.NewSize(reader.Buffered())
+		_, err = buffer.ReadFullFrom(reader, reader.Buffered())
+		if err != nil {
+			return
+		}
+		upstream = bufio.NewCachedConn(serverConn, buffer)
+	}
+	conn := newHTTP2ServerConn(request, writer, controller)
+	defer conn.finish()
+	bufio.CopyConn(ctx, conn, upstream)
+}
+
+// http2Conn is a CONNECT stream over HTTP/2.
+type http2Conn struct {
+	reader     io.ReadCloser
+	writer     io.Writer
+	flush      func() error
+	controller *http.ResponseController
+	onClose    func()
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	access     sync.Mutex
+	closeOnce  sync.Once
+	closed     bool
+	done       chan struct{}
+}
+
+func newHTTP2ServerConn(request *http.Request, writer http.ResponseWriter, controller *http.ResponseController) *http2Conn {
+	var localAddr net.Addr = M.Socksaddr{}
+	if addr, loaded := request.Context().Value(http.LocalAddrContextKey).(net.Addr); loaded {
+		localAddr = addr
+	}
+	return &http2Conn{
+		reader:     request.Body,
+		writer:     writer,
+		flush:      controller.Flush,
+		controller: controller,
+		localAddr:  localAddr,
+		remoteAddr: M.ParseSocksaddr(request.RemoteAddr),
+		done:       make(chan struct{}),
+	}
+}
+
+func (c *http2Conn) Read(b []byte) (n int, err error) {
+	return c.reader.Read(b)
+}
+
+func (c *http2Conn) Write(b []byte) (n int, err error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	n, err = c.writer.Write(b)
+	if err == nil && c.flush != nil {
+		err = c.flush()
+	}
+	return
+}
+
+func (c *http2Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.reader.Close()
+		if c.onClose != nil {
+			c.onClose()
+		}
+		if c.done != nil {
+			close(c.done)
+		}
+	})
+	return nil
+}
+
+// finish must be called before the server handler returns,
+// since the response writer must not be used after that.
+func (c *http2Conn) finish() {
+	c.Close()
+	c.controller.SetWriteDeadline(time.Now())
+	c.access.Lock()
+	c.closed = true
+	c.access.Unlock()
+}
+
+func (c *http2Conn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *http2Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *http2Conn) SetDeadline(t time.Time) error {
+	if c.controller == nil {
+		return os.ErrInvalid
+	}
+	return E.Errors(c.controller.SetReadDeadline(t), c.controller.SetWriteDeadline(t))
+}
+
+func (c *http2Conn) SetReadDeadline(t time.Time) error {
+	if c.controller == nil {
+		return os.ErrInvalid
+	}
+	return c.controller.SetReadDeadline(t)
+}
+
+func (c *http2Conn) SetWriteDeadline(t time.Time) error {
+	if c.controller == nil {
+		return os.ErrInvalid
+	}
+	return c.controller.SetWriteDeadline(t)
+}
+
+func (c *http2Conn) NeedAdditionalReadDeadline() bool {
+	return c.controller == nil
+}
+
+// singleConnListener serves one connection and blocks further Accept calls until it is closed.
+type singleConnListener struct {
+	conn   net.Conn
+	access sync.Mutex
+	done   chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	l.access.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.access.Unlock()
+	if conn != nil {
+		return &singleConn{Conn: conn, listener: l}, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.access.Lock()
+	defer l.access.Unlock()
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return M.Socksaddr{}
+}
+
+type singleConn struct {
+	net.Conn
+	listener *singleConnListener
+}
+
+func (c *singleConn) Close() error {
+	c.listener.Close()
+	return c.Conn.Close()
+}
+
+func (c *singleConn) Upstream() any {
+	return c.Conn
+}
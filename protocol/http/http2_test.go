@@ -0,0 +1,221 @@
+package http
+
+import (
+	std_bufio "bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	std_tls "crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/tls"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testEchoHandler struct {
+	sourceChan chan M.Socksaddr
+}
+
+func (h *testEchoHandler) NewConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	h.sourceChan <- source
+	go func() {
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+}
+
+func (h *testEchoHandler) NewPacketConnectionEx(ctx context.Context, conn N.PacketConn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	h.sourceChan <- source
+	go func() {
+		bufio.CopyPacket(conn, conn)
+		conn.Close()
+	}()
+}
+
+func testEchoServer(t *testing.T, tlsConfig tls.ServerConfig) (M.Socksaddr, chan M.Socksaddr) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	handler := &testEchoHandler{sourceChan: make(chan M.Socksaddr, 1)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if tlsConfig != nil {
+					tlsConn, err := tls.ServerHandshake(context.Background(), conn, tlsConfig)
+					if err != nil {
+						conn.Close()
+						return
+					}
+					conn = tlsConn
+				}
+				err := HandleConnectionWithOptions(context.Background(), conn, std_bufio.NewReader(conn), handler, M.ParseSocksaddr("192.0.2.1:1234"), nil, ServerOptions{})
+				if err != nil {
+					conn.Close()
+				}
+			}()
+		}
+	}()
+	return M.SocksaddrFromNet(listener.Addr()), handler.sourceChan
+}
+
+func testTLSConfig(t *testing.T) (*tls.STDConfig, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	parsed, err := x509.ParseCertificate(certificate)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return &tls.STDConfig{
+		Certificates: []std_tls.Certificate{{Certificate: [][]byte{certificate}, PrivateKey: key}},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}, pool
+}
+
+func testEcho(t *testing.T, conn net.Conn) {
+	_, err := conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	response := make([]byte, 4)
+	_, err = io.ReadFull(conn, response)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(response))
+}
+
+func TestHTTP2Connect(t *testing.T) {
+	t.Parallel()
+	serverConfig, pool := testTLSConfig(t)
+	h2cServer, h2cSourceChan := testEchoServer(t, nil)
+	h2Server, h2SourceChan := testEchoServer(t, tls.NewSTDServer(serverConfig))
+	for _, testCase := range []struct {
+		name       string
+		options    Options
+		sourceChan chan M.Socksaddr
+	}{
+		{"h2c", Options{Server: h2cServer, HTTP2: true}, h2cSourceChan},
+		{"h2", Options{Server: h2Server, HTTP2: true, TLSConfig: tls.NewSTDClient(&tls.STDConfig{ServerName: "example.com", RootCAs: pool})}, h2SourceChan},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			client := NewClient(testCase.options)
+			conn, err := client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddr("1.1.1.1:53"))
+			require.NoError(t, err)
+			defer conn.Close()
+			_, isHTTP2 := conn.(*http2Conn)
+			require.True(t, isHTTP2)
+			testEcho(t, conn)
+			require.Equal(t, M.ParseSocksaddr("192.0.2.1:1234"), <-testCase.sourceChan)
+		})
+	}
+}
+
+func TestHTTP2ForwardedSource(t *testing.T) {
+	t.Parallel()
+	server, sourceChan := testEchoServer(t, nil)
+	for _, options := range []Options{
+		{Server: server, Headers: http.Header{"X-Forwarded-For": []string{"10.0.0.1"}}},
+		{Server: server, Headers: http.Header{"X-Forwarded-For": []string{"10.0.0.1"}}, HTTP2: true},
+	} {
+		conn, err := NewClient(options).DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddr("1.1.1.1:53"))
+		require.NoError(t, err)
+		testEcho(t, conn)
+		conn.Close()
+		require.Equal(t, "10.0.0.1", (<-sourceChan).Addr.String())
+	}
+}
+
+// TestHTTP2ExtendedConnect runs itself again with extended CONNECT enabled,
+// since net/http reads GODEBUG once at startup. The net/http client can not send :protocol,
+// so the request is written as raw frames.
+func TestHTTP2ExtendedConnect(t *testing.T) {
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		command := exec.Command(os.Args[0], "-test.run=^TestHTTP2ExtendedConnect$", "-test.count=1")
+		command.Env = append(os.Environ(), "GODEBUG=http2xconnect=1")
+		output, err := command.CombinedOutput()
+		require.NoError(t, err, string(output))
+		return
+	}
+	server, sourceChan := testEchoServer(t, nil)
+	conn, err := net.Dial("tcp", server.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	destination := M.ParseSocksaddr("1.1.1.1:53")
+	var headerBlock []byte
+	for _, field := range [][2]string{
+		{":method", http.MethodConnect},
+		{":protocol", ConnectUDPProtocol},
+		{":scheme", "http"},
+		{":path", connectUDPPath(destination).EscapedPath()},
+		{":authority", server.String()},
+		{"capsule-protocol", "?1"},
+	} {
+		// literal header field without indexing, new name, no Huffman coding
+		headerBlock = append(headerBlock, 0, byte(len(field[0])))
+		headerBlock = append(headerBlock, field[0]...)
+		headerBlock = append(headerBlock, byte(len(field[1])))
+		headerBlock = append(headerBlock, field[1]...)
+	}
+	writeFrame := func(frameType byte, flags byte, streamID uint32, payload []byte) {
+		header := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), frameType, flags}
+		header = binary.BigEndian.AppendUint32(header, streamID)
+		_, err := conn.Write(append(header, payload...))
+		require.NoError(t, err)
+	}
+	_, err = conn.Write([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"))
+	require.NoError(t, err)
+	writeFrame(0x4, 0, 0, nil)
+	writeFrame(0x1, 0x4, 1, headerBlock)
+	writeFrame(0x0, 0, 1, []byte{capsuleTypeDatagram, 5, connectUDPContextID, 'p', 'i', 'n', 'g'})
+	var responseHeaders bool
+	for {
+		var header [9]byte
+		_, err = io.ReadFull(conn, header[:])
+		require.NoError(t, err)
+		payload := make([]byte, int(header[0])<<16|int(header[1])<<8|int(header[2]))
+		_, err = io.ReadFull(conn, payload)
+		require.NoError(t, err)
+		frameType, flags, streamID := header[3], header[4], binary.BigEndian.Uint32(header[5:])
+		switch {
+		case frameType == 0x4 && flags&0x1 == 0:
+			writeFrame(0x4, 0x1, 0, nil)
+		case frameType == 0x3 && streamID == 1:
+			t.Fatal("stream reset")
+		case frameType == 0x1 && streamID == 1:
+			// indexed :status 200
+			require.Equal(t, byte(0x88), payload[0])
+			responseHeaders = true
+		case frameType == 0x0 && streamID == 1 && len(payload) > 0:
+			require.True(t, responseHeaders)
+			require.Equal(t, []byte{capsuleTypeDatagram, 5, connectUDPContextID, 'p', 'i', 'n', 'g'}, payload)
+			require.Equal(t, M.ParseSocksaddr("192.0.2.1:1234"), <-sourceChan)
+			return
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package mixed
+
+import (
+	std_bufio "bufio"
+	"context"
+	"net"
+
+	"github.com/sagernet/sing/common/auth"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/protocol/http"
+	"github.com/sagernet/sing/protocol/socks"
+	"github.com/sagernet/sing/protocol/socks/socks4"
+	"github.com/sagernet/sing/protocol/socks/socks5"
+)
+
+type HandlerEx = socks.HandlerEx
+
+type ServerOptions struct {
+	// Authenticator is shared by all protocols and overrides SOCKS.Authenticator and HTTP.Authenticator when set.
+	Authenticator auth.Verifier
+	SOCKS         socks.ServerOptions
+	HTTP          http.ServerOptions
+	DisableSOCKS4 bool
+	DisableSOCKS5 bool
+	DisableHTTP   bool
+}
+
+func HandleConnectionEx(
+	ctx context.Context, conn net.Conn, reader *std_bufio.Reader,
+	handler HandlerEx,
+	source M.Socksaddr,
+	onClose N.CloseHandlerFunc,
+	options ServerOptions,
+) error {
+	header, err := reader.Peek(1)
+	if err != nil {
+		return E.Cause(err, "mixed: read header")
+	}
+	switch {
+	case header[0] == socks4.Version && !options.DisableSOCKS4, header[0] == socks5.Version && !options.DisableSOCKS5:
+		socksOptions := options.SOCKS
+		if auth.IsEnabled(options.Authenticator) {
+			socksOptions.Authenticator = options.Authenticator
+		}
+		return socks.HandleConnectionWithOptions(ctx, conn, reader, handler, source, onClose, socksOptions)
+	case isHTTPMethod(header[0]) && !options.DisableHTTP:
+		httpOptions := options.HTTP
+		if auth.IsEnabled(options.Authenticator) {
+			httpOptions.Authenticator = options.Authenticator
+		}
+		return http.HandleConnectionWithOptions(ctx, conn, reader, handler, source, onClose, httpOptions)
+	default:
+		return E.New("mixed: unknown protocol, first byte: ", header[0])
+	}
+}
+
+// isHTTPMethod reports whether b may start a request method, all of which are upper-case tokens.
+func isHTTPMethod(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
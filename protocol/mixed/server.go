@@ -0,0 +1,21 @@
+package mixed
+
+import (
+	std_bufio "bufio"
+	"context"
+	"net"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// Serve accepts connections from listener and handles each of them with HandleConnectionEx
+// until the listener is closed or ctx is done, retrying temporary accept errors. onClose receives the result of every connection.
+func Serve(ctx context.Context, listener net.Listener, handler HandlerEx, onClose N.CloseHandlerFunc, options ServerOptions) error {
+	return N.AcceptLoop(ctx, listener, func(conn net.Conn) {
+		err := HandleConnectionEx(ctx, conn, std_bufio.NewReader(conn), handler, M.SocksaddrFromNet(conn.RemoteAddr()), onClose, options)
+		if err != nil {
+			N.CloseOnHandshakeFailure(conn, onClose, err)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package mixed
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/protocol/http"
+	"github.com/sagernet/sing/protocol/socks"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testEchoHandler struct{}
+
+func (h testEchoHandler) NewConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	go func() {
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+}
+
+func (h testEchoHandler) NewPacketConnectionEx(ctx context.Context, conn N.PacketConn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	go func() {
+		bufio.CopyPacket(conn, conn)
+		conn.Close()
+	}()
+}
+
+func testServe(t *testing.T, options ServerOptions) M.Socksaddr {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, listener, testEchoHandler{}, nil, options)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.ErrorIs(t, <-done, context.Canceled)
+	})
+	return M.SocksaddrFromNet(listener.Addr())
+}
+
+func testDial(dialer N.Dialer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, N.NetworkTCP, M.ParseSocksaddr("1.1.1.1:53"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		return err
+	}
+	response := make([]byte, 4)
+	_, err = io.ReadFull(conn, response)
+	return err
+}
+
+func TestServe(t *testing.T) {
+	t.Parallel()
+	server := testServe(t, ServerOptions{})
+	for _, version := range []socks.Version{socks.Version4, socks.Version4A, socks.Version5} {
+		require.NoError(t, testDial(socks.NewClient(N.SystemDialer, server, version, "", "")), version)
+	}
+	require.NoError(t, testDial(http.NewClient(http.Options{Dialer: N.SystemDialer, Server: server})))
+}
+
+func TestServeDisabled(t *testing.T) {
+	t.Parallel()
+	server := testServe(t, ServerOptions{DisableSOCKS4: true, DisableHTTP: true})
+	require.Error(t, testDial(socks.NewClient(N.SystemDialer, server, socks.Version4, "", "")))
+	require.Error(t, testDial(http.NewClient(http.Options{Dialer: N.SystemDialer, Server: server})))
+	require.NoError(t, testDial(socks.NewClient(N.SystemDialer, server, socks.Version5, "", "")))
+}
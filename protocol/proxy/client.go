@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"strings"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/protocol/http"
+	"github.com/sagernet/sing/protocol/socks"
+)
+
+// NewClientFromURL creates a socks or http client from a proxy URL, which defaults to the http scheme.
+// As with curl, socks5 URLs resolve names locally, while socks5h URLs leave resolution to the proxy.
+func NewClientFromURL(dialer N.Dialer, rawURL string) (N.Dialer, error) {
+	if dialer == nil {
+		dialer = N.SystemDialer
+	}
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	scheme, _, _ := strings.Cut(rawURL, "://")
+	switch strings.ToLower(scheme) {
+	case "http", "https":
+		client, err := http.NewClientFromURL(dialer, rawURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	case "socks", "socks4", "socks4a", "socks5", "socks5h",
+		"socks+tls", "socks4+tls", "socks4a+tls", "socks5+tls", "socks5h+tls":
+		client, err := socks.NewClientFromURL(dialer, rawURL)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	default:
+		return nil, E.New("proxy: unknown scheme: ", scheme)
+	}
+}
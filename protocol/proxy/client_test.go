@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/sagernet/sing/protocol/http"
+	"github.com/sagernet/sing/protocol/socks"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestClientFromURL only checks the dispatch by scheme, the clients are tested with their URLs in their own packages.
+func TestClientFromURL(t *testing.T) {
+	t.Parallel()
+	for _, rawURL := range []string{"proxy.example.com:3128", "http://proxy.example.com", "HTTPS://proxy.example.com"} {
+		client, err := NewClientFromURL(nil, rawURL)
+		require.NoError(t, err, rawURL)
+		require.IsType(t, (*http.Client)(nil), client, rawURL)
+	}
+	for _, rawURL := range []string{"socks4://proxy.example.com", "socks5://proxy.example.com", "socks5h+tls://proxy.example.com"} {
+		client, err := NewClientFromURL(nil, rawURL)
+		require.NoError(t, err, rawURL)
+		require.IsType(t, (*socks.Client)(nil), client, rawURL)
+	}
+	_, err := NewClientFromURL(nil, "ftp://proxy.example.com")
+	require.Error(t, err)
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// Environment is the proxy configuration conventionally read from environment variables.
+type Environment struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	AllProxy   string
+	NoProxy    string
+}
+
+// EnvironmentFromOS reads HTTP_PROXY, HTTPS_PROXY, ALL_PROXY and NO_PROXY,
+// falling back to their lowercase variants.
+//
+// As with net/http, HTTP_PROXY is ignored when REQUEST_METHOD is set, since in a CGI environment
+// it may come from the Proxy header of the request (httpoxy).
+func EnvironmentFromOS() Environment {
+	environment := Environment{
+		HTTPSProxy: getEnvAny("HTTPS_PROXY", "https_proxy"),
+		AllProxy:   getEnvAny("ALL_PROXY", "all_proxy"),
+		NoProxy:    getEnvAny("NO_PROXY", "no_proxy"),
+	}
+	if os.Getenv("REQUEST_METHOD") == "" {
+		environment.HTTPProxy = getEnvAny("HTTP_PROXY", "http_proxy")
+	}
+	return environment
+}
+
+func getEnvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+type schemeKey struct{}
+
+// ContextWithScheme sets the URL scheme of the request that EnvironmentDialer.DialContext dials for.
+func ContextWithScheme(ctx context.Context, scheme string) context.Context {
+	return context.WithValue(ctx, (*schemeKey)(nil), scheme)
+}
+
+func SchemeFromContext(ctx context.Context) (string, bool) {
+	scheme, loaded := ctx.Value((*schemeKey)(nil)).(string)
+	return scheme, loaded
+}
+
+var _ N.Dialer = (*EnvironmentDialer)(nil)
+
+// EnvironmentDialer routes connections through the proxy selected by an Environment.
+//
+// TCP connections for http and ws requests use HTTP_PROXY, those for https and wss requests use HTTPS_PROXY,
+// and all other connections, including UDP, use ALL_PROXY, which is also the fallback of the former two.
+// The scheme is taken from ContextWithScheme, as the destination port does not tell it.
+// Destinations matched by NO_PROXY, as well as localhost and loopback addresses, are dialed directly.
+type EnvironmentDialer struct {
+	dialer     N.Dialer
+	httpProxy  N.Dialer
+	httpsProxy N.Dialer
+	allProxy   N.Dialer
+	noProxy    noProxyMatcher
+}
+
+func NewEnvironmentDialer(dialer N.Dialer, environment Environment) (*EnvironmentDialer, error) {
+	if dialer == nil {
+		dialer = N.SystemDialer
+	}
+	environmentDialer := &EnvironmentDialer{
+		dialer:  dialer,
+		noProxy: parseNoProxy(environment.NoProxy),
+	}
+	for _, proxy := range []struct {
+		rawURL string
+		client *N.Dialer
+	}{
+		{environment.HTTPProxy, &environmentDialer.httpProxy},
+		{environment.HTTPSProxy, &environmentDialer.httpsProxy},
+		{environment.AllProxy, &environmentDialer.allProxy},
+	} {
+		if proxy.rawURL == "" {
+			continue
+		}
+		client, err := NewClientFromURL(dialer, proxy.rawURL)
+		if err != nil {
+			return nil, E.Cause(err, "proxy: parse ", proxy.rawURL)
+		}
+		*proxy.client = client
+	}
+	return environmentDialer, nil
+}
+
+// NewEnvironmentDialerFromOS is a shorthand for NewEnvironmentDialer with EnvironmentFromOS.
+func NewEnvironmentDialerFromOS(dialer N.Dialer) (*EnvironmentDialer, error) {
+	return NewEnvironmentDialer(dialer, EnvironmentFromOS())
+}
+
+// Proxy returns the dialer for a request of scheme to destination, which is the underlying dialer for direct connections.
+func (d *EnvironmentDialer) Proxy(scheme string, destination M.Socksaddr) N.Dialer {
+	if d.noProxy.match(destination) {
+		return d.dialer
+	}
+	var proxy N.Dialer
+	switch scheme {
+	case "http", "ws":
+		proxy = d.httpProxy
+	case "https", "wss":
+		proxy = d.httpsProxy
+	}
+	if proxy == nil {
+		proxy = d.allProxy
+	}
+	if proxy == nil {
+		return d.dialer
+	}
+	return proxy
+}
+
+func (d *EnvironmentDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	var scheme string
+	if N.NetworkName(network) == N.NetworkTCP {
+		scheme, _ = SchemeFromContext(ctx)
+	}
+	return d.Proxy(scheme, destination).DialContext(ctx, network, destination)
+}
+
+func (d *EnvironmentDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return d.Proxy("", destination).ListenPacket(ctx, destination)
+}
+
+func (d *EnvironmentDialer) Upstream() any {
+	return d.dialer
+}
+
+type noProxyMatcher struct {
+	all      bool
+	prefixes []noProxyPrefix
+	domains  []noProxyDomain
+}
+
+type noProxyPrefix struct {
+	prefix netip.Prefix
+	port   uint16
+}
+
+type noProxyDomain struct {
+	domain string
+	// exact is set unless the entry starts with a dot, which only matches subdomains.
+	exact bool
+	port  uint16
+}
+
+func parseNoProxy(noProxy string) noProxyMatcher {
+	var matcher noProxyMatcher
+	for entry := range strings.SplitSeq(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			matcher.all = true
+			return matcher
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			matcher.prefixes = append(matcher.prefixes, noProxyPrefix{prefix: prefix.Masked()})
+			continue
+		}
+		var port uint16
+		if host, portString, err := net.SplitHostPort(entry); err == nil {
+			if portValue, err := strconv.ParseUint(portString, 10, 16); err == nil {
+				entry = host
+				port = uint16(portValue)
+			}
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			addr = addr.Unmap()
+			matcher.prefixes = append(matcher.prefixes, noProxyPrefix{prefix: netip.PrefixFrom(addr, addr.BitLen()), port: port})
+			continue
+		}
+		entry = strings.TrimPrefix(entry, "*")
+		domain := noProxyDomain{port: port}
+		domain.domain, domain.exact = strings.CutPrefix(entry, ".")
+		domain.exact = !domain.exact
+		matcher.domains = append(matcher.domains, domain)
+	}
+	return matcher
+}
+
+func (m noProxyMatcher) match(destination M.Socksaddr) bool {
+	if m.all {
+		return true
+	}
+	if destination.IsIP() {
+		addr := destination.Addr.Unmap()
+		if addr.IsLoopback() {
+			return true
+		}
+		for _, prefix := range m.prefixes {
+			if (prefix.port == 0 || prefix.port == destination.Port) && prefix.prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	host := strings.ToLower(strings.TrimSuffix(destination.Fqdn, "."))
+	if host == "localhost" {
+		return true
+	}
+	for _, domain := range m.domains {
+		if domain.port != 0 && domain.port != destination.Port {
+			continue
+		}
+		if domain.exact && host == domain.domain || strings.HasSuffix(host, "."+domain.domain) {
+			return true
+		}
+	}
+	return false
+}
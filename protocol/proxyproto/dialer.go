@@ -0,0 +1,75 @@
+package proxyproto
+
+import (
+	"context"
+	"net"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type sourceKey struct{}
+
+// ContextWithSource sets the source written by Dialer, which otherwise uses the local address of the connection.
+func ContextWithSource(ctx context.Context, source M.Socksaddr) context.Context {
+	return context.WithValue(ctx, (*sourceKey)(nil), source)
+}
+
+func SourceFromContext(ctx context.Context) (M.Socksaddr, bool) {
+	source, loaded := ctx.Value((*sourceKey)(nil)).(M.Socksaddr)
+	return source, loaded
+}
+
+var _ N.Dialer = (*Dialer)(nil)
+
+// Dialer writes a PROXY protocol header on every TCP connection it dials.
+// UDP connections are passed through unchanged, since the header would be read as a datagram by the peer.
+type Dialer struct {
+	dialer  N.Dialer
+	version byte
+}
+
+func NewDialer(dialer N.Dialer, version byte) *Dialer {
+	return &Dialer{
+		dialer:  dialer,
+		version: version,
+	}
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, destination)
+	if err != nil {
+		return nil, err
+	}
+	if N.NetworkName(network) != N.NetworkTCP {
+		return conn, nil
+	}
+	source, loaded := SourceFromContext(ctx)
+	if !loaded {
+		source = M.SocksaddrFromNet(conn.LocalAddr())
+	}
+	if !destination.IsIP() {
+		destination = M.SocksaddrFromNet(conn.RemoteAddr())
+	}
+	err = WriteHeader(conn, &Header{
+		Version:     d.version,
+		Command:     CommandProxy,
+		Network:     N.NetworkName(network),
+		Source:      source.Unwrap(),
+		Destination: destination.Unwrap(),
+	})
+	if err != nil {
+		return nil, E.Errors(E.Cause(err, "proxyproto: write header"), common.Close(conn))
+	}
+	return conn, nil
+}
+
+func (d *Dialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return d.dialer.ListenPacket(ctx, destination)
+}
+
+func (d *Dialer) Upstream() any {
+	return d.dialer
+}
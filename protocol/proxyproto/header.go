@@ -0,0 +1,360 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const (
+	Version1 = 1
+	Version2 = 2
+)
+
+const (
+	// CommandLocal marks a connection established by the proxy itself, such as a health check.
+	CommandLocal = 0x0
+	CommandProxy = 0x1
+)
+
+const (
+	TLVTypeALPN      = 0x01
+	TLVTypeAuthority = 0x02
+	TLVTypeCRC32C    = 0x03
+	TLVTypeNoop      = 0x04
+	TLVTypeUniqueID  = 0x05
+	TLVTypeSSL       = 0x20
+	TLVTypeNetNS     = 0x30
+)
+
+const (
+	familyUnspec = 0x0
+	familyInet   = 0x1
+	familyInet6  = 0x2
+	familyUnix   = 0x3
+
+	transportUnspec = 0x0
+	transportStream = 0x1
+	transportDgram  = 0x2
+
+	v1MaxLength = 107
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrNoHeader = E.New("proxyproto: no PROXY protocol header")
+
+type Header struct {
+	Version byte
+	Command byte
+	// Network is N.NetworkTCP or N.NetworkUDP, or empty if the transport is unknown or not carried over IP.
+	Network     string
+	Source      M.Socksaddr
+	Destination M.Socksaddr
+	// TLVs are the type-length-value vectors of a version 2 header.
+	TLVs []TLV
+}
+
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// TLV returns the value of the first vector of type tlvType.
+func (h *Header) TLV(tlvType byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == tlvType {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ReadHeader reads a version 1 or version 2 header from reader without reading past its end.
+func ReadHeader(reader io.Reader) (*Header, error) {
+	var prefix [12]byte
+	_, err := io.ReadFull(reader, prefix[:])
+	if err != nil {
+		return nil, E.Cause(err, "proxyproto: read header")
+	}
+	if bytes.Equal(prefix[:], v2Signature) {
+		return readHeaderV2(reader)
+	} else if bytes.HasPrefix(prefix[:], v1Prefix) {
+		return readHeaderV1(reader, prefix[:])
+	}
+	return nil, ErrNoHeader
+}
+
+func readHeaderV1(reader io.Reader, prefix []byte) (*Header, error) {
+	line := make([]byte, len(prefix), v1MaxLength)
+	copy(line, prefix)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == v1MaxLength {
+			return nil, E.New("proxyproto: v1 header too long")
+		}
+		line = line[:len(line)+1]
+		_, err := io.ReadFull(reader, line[len(line)-1:])
+		if err != nil {
+			return nil, E.Cause(err, "proxyproto: read v1 header")
+		}
+	}
+	fields := strings.Split(string(line[len(v1Prefix):len(line)-2]), " ")
+	header := &Header{
+		Version: Version1,
+		Command: CommandProxy,
+	}
+	switch fields[0] {
+	case "UNKNOWN":
+		return header, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, E.New("proxyproto: unknown v1 protocol: ", fields[0])
+	}
+	if len(fields) != 5 {
+		return nil, E.New("proxyproto: invalid v1 header")
+	}
+	source, err := parseV1Address(fields[0], fields[1], fields[3])
+	if err != nil {
+		return nil, err
+	}
+	destination, err := parseV1Address(fields[0], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	header.Network = N.NetworkTCP
+	header.Source = source
+	header.Destination = destination
+	return header, nil
+}
+
+func parseV1Address(protocol string, address string, port string) (M.Socksaddr, error) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil || addr.Zone() != "" || addr.Is4() != (protocol == "TCP4") {
+		return M.Socksaddr{}, E.New("proxyproto: invalid v1 address: ", address)
+	}
+	portValue, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return M.Socksaddr{}, E.New("proxyproto: invalid v1 port: ", port)
+	}
+	return M.SocksaddrFrom(addr, uint16(portValue)), nil
+}
+
+func readHeaderV2(reader io.Reader) (*Header, error) {
+	var fixed [4]byte
+	_, err := io.ReadFull(reader, fixed[:])
+	if err != nil {
+		return nil, E.Cause(err, "proxyproto: read v2 header")
+	}
+	if fixed[0]>>4 != Version2 {
+		return nil, E.New("proxyproto: unknown version: ", fixed[0]>>4)
+	}
+	header := &Header{
+		Version: Version2,
+		Command: fixed[0] & 0xF,
+	}
+	if header.Command != CommandLocal && header.Command != CommandProxy {
+		return nil, E.New("proxyproto: unknown command: ", header.Command)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[2:]))
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, E.Cause(err, "proxyproto: read v2 header")
+	}
+	var addressLength int
+	switch fixed[1] >> 4 {
+	case familyInet:
+		addressLength = 12
+	case familyInet6:
+		addressLength = 36
+	case familyUnix:
+		addressLength = 216
+	}
+	if len(payload) < addressLength {
+		return nil, E.New("proxyproto: v2 header too short")
+	}
+	if header.Command == CommandProxy {
+		switch fixed[1] & 0xF {
+		case transportStream:
+			header.Network = N.NetworkTCP
+		case transportDgram:
+			header.Network = N.NetworkUDP
+		}
+		switch fixed[1] >> 4 {
+		case familyInet:
+			header.Source = M.SocksaddrFrom(netip.AddrFrom4([4]byte(payload[0:4])), binary.BigEndian.Uint16(payload[8:]))
+			header.Destination = M.SocksaddrFrom(netip.AddrFrom4([4]byte(payload[4:8])), binary.BigEndian.Uint16(payload[10:]))
+		case familyInet6:
+			header.Source = M.SocksaddrFrom(netip.AddrFrom16([16]byte(payload[0:16])), binary.BigEndian.Uint16(payload[32:]))
+			header.Destination = M.SocksaddrFrom(netip.AddrFrom16([16]byte(payload[16:32])), binary.BigEndian.Uint16(payload[34:]))
+		default:
+			header.Network = ""
+		}
+	}
+	header.TLVs, err = parseTLVs(payload[addressLength:])
+	if err != nil {
+		return nil, err
+	}
+	if checksum, loaded := header.TLV(TLVTypeCRC32C); loaded {
+		if len(checksum) != 4 {
+			return nil, E.New("proxyproto: invalid CRC32C TLV")
+		}
+		expected := binary.BigEndian.Uint32(checksum)
+		clear(checksum)
+		hash := crc32.New(castagnoliTable)
+		common.Must1(hash.Write(v2Signature))
+		common.Must1(hash.Write(fixed[:]))
+		common.Must1(hash.Write(payload))
+		binary.BigEndian.PutUint32(checksum, expected)
+		if hash.Sum32() != expected {
+			return nil, E.New("proxyproto: CRC32C mismatch")
+		}
+	}
+	return header, nil
+}
+
+func parseTLVs(data []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, E.New("proxyproto: truncated TLV")
+		}
+		length := int(binary.BigEndian.Uint16(data[1:]))
+		if len(data) < 3+length {
+			return nil, E.New("proxyproto: truncated TLV")
+		}
+		tlvs = append(tlvs, TLV{Type: data[0], Value: data[3 : 3+length]})
+		data = data[3+length:]
+	}
+	return tlvs, nil
+}
+
+// WriteHeader writes header to writer in a single write.
+// A 4-byte CRC32C vector is filled in with the checksum of the version 2 header.
+// Addresses that are not IP addresses are sent as UNKNOWN in version 1 and as AF_UNSPEC in version 2.
+func WriteHeader(writer io.Writer, header *Header) error {
+	buffer := buf.NewSize(headerLength(header))
+	defer buffer.Release()
+	switch header.Version {
+	case Version1:
+		appendHeaderV1(buffer, header)
+	case Version2:
+		err := appendHeaderV2(buffer, header)
+		if err != nil {
+			return err
+		}
+	default:
+		return E.New("proxyproto: unknown version: ", header.Version)
+	}
+	return common.Error(writer.Write(buffer.Bytes()))
+}
+
+func headerLength(header *Header) int {
+	if header.Version == Version1 {
+		return v1MaxLength
+	}
+	length := len(v2Signature) + 4 + 36
+	for _, tlv := range header.TLVs {
+		length += 3 + len(tlv.Value)
+	}
+	return length
+}
+
+// ipPair returns the source and destination as addresses of the same family.
+func ipPair(header *Header) (source netip.Addr, destination netip.Addr, loaded bool) {
+	if header.Command != CommandProxy || !header.Source.IsIP() || !header.Destination.IsIP() {
+		return
+	}
+	source = header.Source.Addr.Unmap()
+	destination = header.Destination.Addr.Unmap()
+	if source.Is4() != destination.Is4() {
+		source = netip.AddrFrom16(source.As16())
+		destination = netip.AddrFrom16(destination.As16())
+	}
+	return source, destination, true
+}
+
+func appendHeaderV1(buffer *buf.Buffer, header *Header) {
+	source, destination, loaded := ipPair(header)
+	if !loaded || header.Network == N.NetworkUDP {
+		common.Must1(buffer.WriteString("PROXY UNKNOWN\r\n"))
+		return
+	}
+	protocol := "TCP4"
+	if source.Is6() {
+		protocol = "TCP6"
+	}
+	common.Must1(buffer.WriteString(strings.Join([]string{
+		"PROXY", protocol,
+		source.WithZone("").String(), destination.WithZone("").String(),
+		strconv.Itoa(int(header.Source.Port)), strconv.Itoa(int(header.Destination.Port)),
+	}, " ") + "\r\n"))
+}
+
+func appendHeaderV2(buffer *buf.Buffer, header *Header) error {
+	if header.Command != CommandLocal && header.Command != CommandProxy {
+		return E.New("proxyproto: unknown command: ", header.Command)
+	}
+	common.Must1(buffer.Write(v2Signature))
+	common.Must(buffer.WriteByte(Version2<<4 | header.Command))
+	source, destination, loaded := ipPair(header)
+	var family, transport byte
+	if loaded {
+		family = familyInet
+		if source.Is6() {
+			family = familyInet6
+		}
+		switch header.Network {
+		case N.NetworkTCP:
+			transport = transportStream
+		case N.NetworkUDP:
+			transport = transportDgram
+		}
+	}
+	common.Must(buffer.WriteByte(family<<4 | transport))
+	lengthBytes := buffer.Extend(2)
+	payloadStart := buffer.Len()
+	if loaded {
+		common.Must1(buffer.Write(source.AsSlice()))
+		common.Must1(buffer.Write(destination.AsSlice()))
+		binary.BigEndian.PutUint16(buffer.Extend(2), header.Source.Port)
+		binary.BigEndian.PutUint16(buffer.Extend(2), header.Destination.Port)
+	}
+	var checksum []byte
+	for _, tlv := range header.TLVs {
+		if len(tlv.Value) > 0xFFFF {
+			return E.New("proxyproto: TLV too long")
+		}
+		common.Must(buffer.WriteByte(tlv.Type))
+		binary.BigEndian.PutUint16(buffer.Extend(2), uint16(len(tlv.Value)))
+		if tlv.Type == TLVTypeCRC32C && len(tlv.Value) == 4 && checksum == nil {
+			checksum = buffer.Extend(4)
+			clear(checksum)
+		} else {
+			common.Must1(buffer.Write(tlv.Value))
+		}
+	}
+	payloadLength := buffer.Len() - payloadStart
+	if payloadLength > 0xFFFF {
+		return E.New("proxyproto: header too long")
+	}
+	binary.BigEndian.PutUint16(lengthBytes, uint16(payloadLength))
+	if checksum != nil {
+		binary.BigEndian.PutUint32(checksum, crc32.Checksum(buffer.Bytes(), castagnoliTable))
+	}
+	return nil
+}
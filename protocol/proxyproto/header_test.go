@@ -0,0 +1,240 @@
+package proxyproto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderV1(t *testing.T) {
+	t.Parallel()
+	header, err := ReadHeader(bytes.NewReader([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET /")))
+	require.NoError(t, err)
+	require.Equal(t, M.ParseSocksaddr("192.168.0.1:56324"), header.Source)
+	require.Equal(t, M.ParseSocksaddr("192.168.0.11:443"), header.Destination)
+
+	var buffer bytes.Buffer
+	require.NoError(t, WriteHeader(&buffer, &Header{
+		Version:     Version1,
+		Command:     CommandProxy,
+		Network:     N.NetworkTCP,
+		Source:      M.ParseSocksaddr("[2001:db8::1]:1000"),
+		Destination: M.ParseSocksaddr("[2001:db8::2]:443"),
+	}))
+	require.Equal(t, "PROXY TCP6 2001:db8::1 2001:db8::2 1000 443\r\n", buffer.String())
+
+	_, err = ReadHeader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n")))
+	require.ErrorIs(t, err, ErrNoHeader)
+}
+
+func TestHeaderV2(t *testing.T) {
+	t.Parallel()
+	for _, header := range []*Header{
+		{
+			Version:     Version2,
+			Command:     CommandProxy,
+			Network:     N.NetworkTCP,
+			Source:      M.ParseSocksaddr("10.0.0.1:1000"),
+			Destination: M.ParseSocksaddr("10.0.0.2:443"),
+			TLVs: []TLV{
+				{Type: TLVTypeAuthority, Value: []byte("example.com")},
+				{Type: TLVTypeCRC32C, Value: make([]byte, 4)},
+			},
+		},
+		{
+			Version:     Version2,
+			Command:     CommandProxy,
+			Network:     N.NetworkUDP,
+			Source:      M.ParseSocksaddr("[2001:db8::1]:53"),
+			Destination: M.ParseSocksaddr("[2001:db8::2]:53"),
+		},
+		{
+			Version: Version2,
+			Command: CommandLocal,
+		},
+	} {
+		var buffer bytes.Buffer
+		require.NoError(t, WriteHeader(&buffer, header))
+		buffer.WriteString("payload")
+		readHeader, err := ReadHeader(&buffer)
+		require.NoError(t, err)
+		require.Equal(t, header.Command, readHeader.Command)
+		require.Equal(t, header.Network, readHeader.Network)
+		require.Equal(t, header.Source, readHeader.Source)
+		require.Equal(t, header.Destination, readHeader.Destination)
+		if authority, loaded := header.TLV(TLVTypeAuthority); loaded {
+			readAuthority, _ := readHeader.TLV(TLVTypeAuthority)
+			require.Equal(t, authority, readAuthority)
+		}
+		require.Equal(t, "payload", buffer.String())
+	}
+}
+
+func TestHeaderV2Checksum(t *testing.T) {
+	t.Parallel()
+	var buffer bytes.Buffer
+	require.NoError(t, WriteHeader(&buffer, &Header{
+		Version:     Version2,
+		Command:     CommandProxy,
+		Network:     N.NetworkTCP,
+		Source:      M.ParseSocksaddr("10.0.0.1:1000"),
+		Destination: M.ParseSocksaddr("10.0.0.2:443"),
+		TLVs:        []TLV{{Type: TLVTypeCRC32C, Value: make([]byte, 4)}},
+	}))
+	data := buffer.Bytes()
+	data[len(v2Signature)+4]++
+	_, err := ReadHeader(bytes.NewReader(data))
+	require.Error(t, err)
+}
+
+func TestListener(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener = NewListener(listener, ListenerOptions{Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}})
+	defer listener.Close()
+	go func() {
+		conn, err := NewDialer(N.SystemDialer, Version2).DialContext(
+			ContextWithSource(t.Context(), M.ParseSocksaddr("203.0.113.1:1234")),
+			N.NetworkTCP, M.SocksaddrFromNet(listener.Addr()),
+		)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, M.ParseSocksaddr("203.0.113.1:1234"), M.SocksaddrFromNet(conn.RemoteAddr()))
+	var message [5]byte
+	_, err = io.ReadFull(conn, message[:])
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(message[:]))
+}
+
+func TestListenerUntrusted(t *testing.T) {
+	t.Parallel()
+	dialer := NewDialer(N.SystemDialer, Version1)
+	ctx := ContextWithSource(t.Context(), M.ParseSocksaddr("203.0.113.1:1234"))
+	trusted := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	listener = NewListener(listener, ListenerOptions{Trusted: trusted})
+	go func() {
+		conn, err := dialer.DialContext(ctx, N.NetworkTCP, M.SocksaddrFromNet(listener.Addr()))
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "127.0.0.1", M.SocksaddrFromNet(conn.RemoteAddr()).Addr.String())
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(data, []byte("PROXY ")), "untrusted header should be passed through")
+
+	rejectListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	rejectListener = NewListener(rejectListener, ListenerOptions{Trusted: trusted, RejectUntrusted: true})
+	acceptDone := make(chan error, 1)
+	go func() {
+		_, err := rejectListener.Accept()
+		acceptDone <- err
+	}()
+	rejectedConn, err := dialer.DialContext(ctx, N.NetworkTCP, M.SocksaddrFromNet(rejectListener.Addr()))
+	require.NoError(t, err)
+	defer rejectedConn.Close()
+	rejectedConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = rejectedConn.Read(make([]byte, 1))
+	require.True(t, E.IsClosed(err), "untrusted connection should be closed: ", err)
+	rejectListener.Close()
+	require.Error(t, <-acceptDone)
+}
+
+func TestConnHeaderTimeout(t *testing.T) {
+	t.Parallel()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	conn := NewConn(serverConn, 50*time.Millisecond)
+	start := time.Now()
+	require.Equal(t, serverConn.RemoteAddr(), conn.RemoteAddr())
+	require.Less(t, time.Since(start), time.Second)
+	_, err := conn.Header()
+	require.Error(t, err)
+}
+
+func TestConnDeadlineDuringHeader(t *testing.T) {
+	t.Parallel()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	conn := NewConn(serverConn, 5*time.Second)
+	headerDone := make(chan error, 1)
+	go func() {
+		_, err := conn.Header()
+		headerDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(50*time.Millisecond)))
+	require.Less(t, time.Since(start), time.Second, "setting a deadline should not wait for the header")
+	select {
+	case err := <-headerDone:
+		require.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the deadline should interrupt the header read")
+	}
+}
+
+func TestListenerTrustsNoneByDefault(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener = NewListener(listener, ListenerOptions{})
+	defer listener.Close()
+	go func() {
+		conn, err := NewDialer(N.SystemDialer, Version1).DialContext(
+			ContextWithSource(t.Context(), M.ParseSocksaddr("203.0.113.1:1234")),
+			N.NetworkTCP, M.SocksaddrFromNet(listener.Addr()),
+		)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}()
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "127.0.0.1", M.SocksaddrFromNet(conn.RemoteAddr()).Addr.String())
+}
+
+func TestDialerUDP(t *testing.T) {
+	t.Parallel()
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer packetConn.Close()
+	conn, err := NewDialer(N.SystemDialer, Version2).DialContext(t.Context(), N.NetworkUDP, M.SocksaddrFromNet(packetConn.LocalAddr()))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buffer := make([]byte, 64)
+	n, _, err := packetConn.ReadFrom(buffer)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buffer[:n]))
+}
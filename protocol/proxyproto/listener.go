@@ -0,0 +1,171 @@
+package proxyproto
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const DefaultHeaderTimeout = 5 * time.Second
+
+type ListenerOptions struct {
+	// HeaderTimeout bounds reading the header, defaults to DefaultHeaderTimeout.
+	HeaderTimeout time.Duration
+	// Trusted lists the peers allowed to send a header. If it is empty, no peer is trusted,
+	// so it must be set for any header to be read.
+	Trusted []netip.Prefix
+	// RejectUntrusted closes connections from untrusted peers, which are otherwise accepted without reading a header.
+	RejectUntrusted bool
+}
+
+// Listener wraps accepted connections with Conn, so that a handler fed with RemoteAddr sees the true source.
+type Listener struct {
+	net.Listener
+	options ListenerOptions
+}
+
+func NewListener(inner net.Listener, options ListenerOptions) net.Listener {
+	return &Listener{
+		Listener: inner,
+		options:  options,
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.trusted(conn.RemoteAddr()) {
+			return NewConn(conn, l.options.HeaderTimeout), nil
+		}
+		if !l.options.RejectUntrusted {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	peer := M.SocksaddrFromNet(addr).Unwrap().Addr
+	for _, prefix := range l.options.Trusted {
+		if prefix.Contains(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn reads the PROXY protocol header on first use, outside of the accept loop.
+// The header is read under the header timeout, so RemoteAddr and LocalAddr block no longer than that.
+type Conn struct {
+	net.Conn
+	headerTimeout  time.Duration
+	headerOnce     sync.Once
+	header         *Header
+	err            error
+	access         sync.Mutex
+	headerRead     bool
+	headerDeadline time.Time
+	readDeadline   time.Time
+}
+
+func NewConn(conn net.Conn, headerTimeout time.Duration) *Conn {
+	if headerTimeout == 0 {
+		headerTimeout = DefaultHeaderTimeout
+	}
+	return &Conn{
+		Conn:          conn,
+		headerTimeout: headerTimeout,
+	}
+}
+
+// Header reads the header if it has not been read yet.
+func (c *Conn) Header() (*Header, error) {
+	c.headerOnce.Do(c.readHeader)
+	return c.header, c.err
+}
+
+// readHeader holds the lock only around deadline changes, so that deadlines can still be set during the read.
+func (c *Conn) readHeader() {
+	c.access.Lock()
+	c.headerDeadline = time.Now().Add(c.headerTimeout)
+	c.Conn.SetReadDeadline(c.effectiveReadDeadline())
+	c.access.Unlock()
+	header, err := ReadHeader(c.Conn)
+	c.access.Lock()
+	c.header, c.err = header, err
+	c.headerRead = true
+	c.Conn.SetReadDeadline(c.readDeadline)
+	c.access.Unlock()
+}
+
+// effectiveReadDeadline bounds the read deadline by the header timeout while the header is being read.
+func (c *Conn) effectiveReadDeadline() time.Time {
+	if c.headerRead || c.headerDeadline.IsZero() {
+		return c.readDeadline
+	}
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(c.headerDeadline) {
+		return c.readDeadline
+	}
+	return c.headerDeadline
+}
+
+func (c *Conn) Read(p []byte) (n int, err error) {
+	_, err = c.Header()
+	if err != nil {
+		return
+	}
+	return c.Conn.Read(p)
+}
+
+// RemoteAddr returns the source of the header, or the address of the peer for LOCAL and UNKNOWN headers.
+func (c *Conn) RemoteAddr() net.Addr {
+	header, err := c.Header()
+	if err == nil && header.Command == CommandProxy && header.Source.IsValid() {
+		return header.Source.TCPAddr()
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination of the header, or the local address for LOCAL and UNKNOWN headers.
+func (c *Conn) LocalAddr() net.Addr {
+	header, err := c.Header()
+	if err == nil && header.Command == CommandProxy && header.Destination.IsValid() {
+		return header.Destination.TCPAddr()
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	err := c.Conn.SetWriteDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(c.effectiveReadDeadline())
+}
+
+func (c *Conn) ReaderReplaceable() bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.headerRead && c.err == nil
+}
+
+func (c *Conn) WriterReplaceable() bool {
+	return true
+}
+
+func (c *Conn) Upstream() any {
+	return c.Conn
+}
@@ -0,0 +1,198 @@
+package socks
+
+import (
+	std_bufio "bufio"
+	"context"
+	"io"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/auth"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/varbin"
+	"github.com/sagernet/sing/protocol/socks/socks5"
+)
+
+// ServerAuthMethod runs the server side of a SOCKS5 authentication method sub-negotiation.
+// Authenticate is called after the method is selected and must write any failure response itself.
+type ServerAuthMethod interface {
+	Method() byte
+	Authenticate(ctx context.Context, conn io.ReadWriter) (context.Context, error)
+}
+
+// ClientAuthMethod runs the client side of a SOCKS5 authentication method sub-negotiation.
+type ClientAuthMethod interface {
+	Method() byte
+	Authenticate(ctx context.Context, conn io.ReadWriter) error
+}
+
+var _ ServerAuthMethod = NoAuthServer{}
+
+type NoAuthServer struct{}
+
+func (a NoAuthServer) Method() byte {
+	return socks5.AuthTypeNotRequired
+}
+
+func (a NoAuthServer) Authenticate(ctx context.Context, conn io.ReadWriter) (context.Context, error) {
+	return ctx, nil
+}
+
+var _ ClientAuthMethod = NoAuthClient{}
+
+type NoAuthClient struct{}
+
+func (a NoAuthClient) Method() byte {
+	return socks5.AuthTypeNotRequired
+}
+
+func (a NoAuthClient) Authenticate(ctx context.Context, conn io.ReadWriter) error {
+	return nil
+}
+
+var _ ServerAuthMethod = (*UsernamePasswordServer)(nil)
+
+type UsernamePasswordServer struct {
+	Authenticator auth.Verifier
+}
+
+func (a *UsernamePasswordServer) Method() byte {
+	return socks5.AuthTypeUsernamePassword
+}
+
+func (a *UsernamePasswordServer) Authenticate(ctx context.Context, conn io.ReadWriter) (context.Context, error) {
+	request, err := socks5.ReadUsernamePasswordAuthRequest(varbin.StubReader(conn))
+	if err != nil {
+		return nil, err
+	}
+	response := socks5.UsernamePasswordAuthResponse{}
+	authCtx, verifyErr := a.Authenticator.VerifyContext(ctx, request.Username, request.Password)
+	if verifyErr == nil {
+		response.Status = socks5.UsernamePasswordStatusSuccess
+	} else {
+		response.Status = socks5.UsernamePasswordStatusFailure
+	}
+	err = socks5.WriteUsernamePasswordAuthResponse(conn, response)
+	if err != nil {
+		return nil, err
+	}
+	if verifyErr != nil {
+		return nil, E.Cause(verifyErr, "socks5: authentication failed, username=", request.Username)
+	}
+	return authCtx, nil
+}
+
+var _ ClientAuthMethod = (*UsernamePasswordClient)(nil)
+
+type UsernamePasswordClient struct {
+	Username string
+	Password string
+}
+
+func (a *UsernamePasswordClient) Method() byte {
+	return socks5.AuthTypeUsernamePassword
+}
+
+func (a *UsernamePasswordClient) Authenticate(ctx context.Context, conn io.ReadWriter) error {
+	err := socks5.WriteUsernamePasswordAuthRequest(conn, socks5.UsernamePasswordAuthRequest{
+		Username: a.Username,
+		Password: a.Password,
+	})
+	if err != nil {
+		return err
+	}
+	response, err := socks5.ReadUsernamePasswordAuthResponse(varbin.StubReader(conn))
+	if err != nil {
+		return err
+	}
+	if response.Status != socks5.UsernamePasswordStatusSuccess {
+		return E.New("socks5: incorrect user name or password")
+	}
+	return nil
+}
+
+func serverAuthMethods(authenticator auth.Verifier, authMethods []ServerAuthMethod) []ServerAuthMethod {
+	methods := common.Filter(authMethods, func(it ServerAuthMethod) bool {
+		return it != nil
+	})
+	if auth.IsEnabled(authenticator) {
+		methods = append(methods, &UsernamePasswordServer{Authenticator: authenticator})
+	} else if len(methods) == 0 {
+		methods = append(methods, NoAuthServer{})
+	}
+	return methods
+}
+
+func clientAuthMethods(username string, password string, authMethods []ClientAuthMethod) []ClientAuthMethod {
+	methods := common.Filter(authMethods, func(it ClientAuthMethod) bool {
+		return it != nil
+	})
+	if username != "" {
+		methods = append(methods, &UsernamePasswordClient{Username: username, Password: password})
+	} else if len(methods) == 0 {
+		methods = append(methods, NoAuthClient{})
+	}
+	return methods
+}
+
+// negotiateServerAuth selects the first method offered by the client that the server supports,
+// so the client's preference order wins.
+func negotiateServerAuth(ctx context.Context, conn io.ReadWriter, authRequest socks5.AuthRequest, authMethods []ServerAuthMethod) (context.Context, error) {
+	var selected ServerAuthMethod
+	for _, method := range authRequest.Methods {
+		selected = common.Find(authMethods, func(it ServerAuthMethod) bool {
+			return it.Method() == method
+		})
+		if selected != nil {
+			break
+		}
+	}
+	if selected == nil {
+		err := socks5.WriteAuthResponse(conn, socks5.AuthResponse{
+			Method: socks5.AuthTypeNoAcceptedMethods,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return nil, E.New("socks5: no accepted auth methods")
+	}
+	err := socks5.WriteAuthResponse(conn, socks5.AuthResponse{
+		Method: selected.Method(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return selected.Authenticate(ctx, conn)
+}
+
+func negotiateClientAuth(ctx context.Context, conn io.ReadWriter, authMethods []ClientAuthMethod) error {
+	err := socks5.WriteAuthRequest(conn, socks5.AuthRequest{
+		Methods: common.Map(authMethods, ClientAuthMethod.Method),
+	})
+	if err != nil {
+		return err
+	}
+	authResponse, err := socks5.ReadAuthResponse(varbin.StubReader(conn))
+	if err != nil {
+		return err
+	}
+	selected := common.Find(authMethods, func(it ClientAuthMethod) bool {
+		return it.Method() == authResponse.Method
+	})
+	if selected == nil {
+		return E.New("socks5: unsupported auth method: ", authResponse.Method)
+	}
+	return selected.Authenticate(ctx, conn)
+}
+
+type serverConn struct {
+	io.Writer
+	reader *std_bufio.Reader
+}
+
+func (c serverConn) Read(p []byte) (n int, err error) {
+	return c.reader.Read(p)
+}
+
+func (c serverConn) ReadByte() (byte, error) {
+	return c.reader.ReadByte()
+}
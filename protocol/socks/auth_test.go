@@ -0,0 +1,114 @@
+package socks
+
+import (
+	std_bufio "bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/sagernet/sing/common/auth"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/varbin"
+	"github.com/sagernet/sing/protocol/socks/socks5"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testAuthTypeToken byte = 0x80
+
+type testTokenServer struct{}
+
+func (a testTokenServer) Method() byte {
+	return testAuthTypeToken
+}
+
+func (a testTokenServer) Authenticate(ctx context.Context, conn io.ReadWriter) (context.Context, error) {
+	message, err := socks5.ReadGSSAPIMessage(varbin.StubReader(conn))
+	if err != nil {
+		return nil, err
+	}
+	if string(message.Token) != "token" {
+		return nil, E.Errors(E.New("invalid token"), socks5.WriteGSSAPIMessage(conn, socks5.GSSAPIMessage{Type: socks5.GSSAPIMessageTypeAbort}))
+	}
+	err = socks5.WriteGSSAPIMessage(conn, socks5.GSSAPIMessage{Type: socks5.GSSAPIMessageTypeAuthentication, Token: []byte("accepted")})
+	if err != nil {
+		return nil, err
+	}
+	return auth.ContextWithUser(ctx, "token-user"), nil
+}
+
+type testTokenClient struct {
+	token string
+}
+
+func (a testTokenClient) Method() byte {
+	return testAuthTypeToken
+}
+
+func (a testTokenClient) Authenticate(ctx context.Context, conn io.ReadWriter) error {
+	err := socks5.WriteGSSAPIMessage(conn, socks5.GSSAPIMessage{Type: socks5.GSSAPIMessageTypeAuthentication, Token: []byte(a.token)})
+	if err != nil {
+		return err
+	}
+	message, err := socks5.ReadGSSAPIMessage(varbin.StubReader(conn))
+	if err != nil {
+		return err
+	}
+	if message.Type == socks5.GSSAPIMessageTypeAbort {
+		return E.New("token rejected")
+	}
+	return nil
+}
+
+type testUserHandler struct {
+	userChan chan string
+}
+
+func (h *testUserHandler) NewConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	user, _ := auth.UserFromContext[string](ctx)
+	h.userChan <- user
+	N.ReportConnHandshakeSuccess(conn, conn)
+	conn.Close()
+}
+
+func (h *testUserHandler) NewPacketConnectionEx(ctx context.Context, conn N.PacketConn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	conn.Close()
+}
+
+func testAuthMethods(t *testing.T, authenticator auth.Verifier, serverMethods []ServerAuthMethod, clientMethods []ClientAuthMethod) (string, error) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	handler := &testUserHandler{userChan: make(chan string, 1)}
+	go func() {
+		err := HandleConnectionWithOptions(context.Background(), serverConn, std_bufio.NewReader(serverConn), handler, M.Socksaddr{}, nil, ServerOptions{Authenticator: authenticator, AuthMethods: serverMethods})
+		if err != nil {
+			serverConn.Close()
+		}
+	}()
+	_, err := ClientHandshake5Ex(context.Background(), clientConn, socks5.CommandConnect, M.ParseSocksaddr("1.1.1.1:53"), clientMethods)
+	if err != nil {
+		return "", err
+	}
+	return <-handler.userChan, nil
+}
+
+func TestServerAuthMethods(t *testing.T) {
+	t.Parallel()
+	authenticator := auth.NewAuthenticator([]auth.User{{Username: "user", Password: "password"}})
+	user, err := testAuthMethods(t, authenticator, []ServerAuthMethod{testTokenServer{}}, []ClientAuthMethod{testTokenClient{"token"}, &UsernamePasswordClient{"user", "password"}})
+	require.NoError(t, err)
+	require.Equal(t, "token-user", user)
+
+	user, err = testAuthMethods(t, authenticator, nil, []ClientAuthMethod{testTokenClient{"token"}, &UsernamePasswordClient{"user", "password"}})
+	require.NoError(t, err)
+	require.Equal(t, "user", user)
+
+	_, err = testAuthMethods(t, authenticator, []ServerAuthMethod{testTokenServer{}}, []ClientAuthMethod{testTokenClient{"invalid"}})
+	require.Error(t, err)
+
+	_, err = testAuthMethods(t, nil, []ServerAuthMethod{testTokenServer{}}, []ClientAuthMethod{NoAuthClient{}})
+	require.Error(t, err)
+}
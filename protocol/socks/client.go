@@ -3,6 +3,7 @@ package socks
 import (
 	"context"
 	"net"
+	"net/netip"
 	"net/url"
 	"os"
 	"strings"
@@ -10,6 +11,7 @@ import (
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/tls"
 	"github.com/sagernet/sing/protocol/socks/socks4"
 	"github.com/sagernet/sing/protocol/socks/socks5"
 )
@@ -50,11 +52,20 @@ func ParseVersion(version string) (Version, error) {
 var _ N.Dialer = (*Client)(nil)
 
 type Client struct {
-	version    Version
-	dialer     N.Dialer
-	serverAddr M.Socksaddr
-	username   string
-	password   string
+	version     Version
+	dialer      N.Dialer
+	serverAddr  M.Socksaddr
+	username    string
+	password    string
+	authMethods []ClientAuthMethod
+	resolveDNS  bool
+	resolver    Resolver
+	tlsConfig   tls.Config
+}
+
+// Resolver is satisfied by *net.Resolver.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network string, host string) ([]netip.Addr, error)
 }
 
 func NewClient(dialer N.Dialer, serverAddr M.Socksaddr, version Version, username string, password string) *Client {
@@ -78,12 +89,22 @@ func NewClientFromURL(dialer N.Dialer, rawURL string) (*Client, error) {
 	}
 	client.dialer = dialer
 	client.serverAddr = M.ParseSocksaddr(proxyURL.Host)
-	switch proxyURL.Scheme {
+	if client.serverAddr.Port == 0 {
+		client.serverAddr.Port = 1080
+	}
+	scheme, useTLS := strings.CutSuffix(proxyURL.Scheme, "+tls")
+	if useTLS {
+		client.tlsConfig = tls.NewSTDClient(&tls.STDConfig{ServerName: proxyURL.Hostname()})
+	}
+	switch scheme {
 	case "socks4":
 		client.version = Version4
 	case "socks4a":
 		client.version = Version4A
-	case "socks", "socks5", "":
+	case "socks5":
+		client.version = Version5
+		client.resolveDNS = true
+	case "socks", "socks5h", "":
 		client.version = Version5
 	default:
 		return nil, E.New("socks: unknown scheme: ", proxyURL.Scheme)
@@ -99,6 +120,72 @@ func NewClientFromURL(dialer N.Dialer, rawURL string) (*Client, error) {
 	return &client, nil
 }
 
+// SetAuthMethods sets additional SOCKS5 authentication methods, offered in preference order
+// before username/password authentication.
+func (c *Client) SetAuthMethods(authMethods ...ClientAuthMethod) {
+	c.authMethods = authMethods
+}
+
+// SetTLSConfig enables TLS to the proxy server, as selected by a +tls URL scheme such as socks5+tls.
+func (c *Client) SetTLSConfig(tlsConfig tls.Config) {
+	if tlsConfig != nil && tlsConfig.ServerName() == "" && c.serverAddr.IsFqdn() {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.SetServerName(c.serverAddr.Fqdn)
+	}
+	c.tlsConfig = tlsConfig
+}
+
+func (c *Client) dialServer(ctx context.Context) (net.Conn, error) {
+	conn, err := c.dialer.DialContext(ctx, N.NetworkTCP, c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	if c.tlsConfig == nil {
+		return conn, nil
+	}
+	tlsConn, err := tls.ClientHandshake(ctx, conn, c.tlsConfig)
+	if err != nil {
+		conn.Close()
+		return nil, E.Cause(err, "socks: tls handshake")
+	}
+	return tlsConn, nil
+}
+
+// SetResolver sets the resolver used for destinations resolved on the client side,
+// which is the case for socks4 and socks5 (as opposed to socks5h) proxy URLs. It defaults to net.DefaultResolver.
+func (c *Client) SetResolver(resolver Resolver) {
+	c.resolver = resolver
+}
+
+func (c *Client) resolve(ctx context.Context, address M.Socksaddr) (M.Socksaddr, error) {
+	if !address.IsFqdn() {
+		return address, nil
+	}
+	if c.version != Version4 && !c.resolveDNS {
+		return address, nil
+	}
+	resolver := c.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	network := "ip"
+	if c.version != Version5 {
+		network = "ip4"
+	}
+	addresses, err := resolver.LookupNetIP(ctx, network, address.Fqdn)
+	if err != nil {
+		return M.Socksaddr{}, err
+	}
+	if len(addresses) == 0 {
+		return M.Socksaddr{}, E.New("socks: no addresses for ", address.Fqdn)
+	}
+	return M.SocksaddrFrom(addresses[0], address.Port).Unwrap(), nil
+}
+
+func (c *Client) clientAuthMethods() []ClientAuthMethod {
+	return clientAuthMethods(c.username, c.password, c.authMethods)
+}
+
 func (c *Client) DialContext(ctx context.Context, network string, address M.Socksaddr) (net.Conn, error) {
 	network = N.NetworkName(network)
 	var command byte
@@ -113,17 +200,13 @@ func (c *Client) DialContext(ctx context.Context, network string, address M.Sock
 	default:
 		return nil, E.Extend(N.ErrUnknownNetwork, network)
 	}
-	tcpConn, err := c.dialer.DialContext(ctx, N.NetworkTCP, c.serverAddr)
+	address, err := c.resolve(ctx, address)
 	if err != nil {
 		return nil, err
 	}
-	if c.version == Version4 && address.IsDomain() {
-		tcpAddr, err := net.ResolveTCPAddr(network, address.String())
-		if err != nil {
-			tcpConn.Close()
-			return nil, err
-		}
-		address = M.SocksaddrFromNet(tcpAddr)
+	tcpConn, err := c.dialServer(ctx)
+	if err != nil {
+		return nil, err
 	}
 	switch c.version {
 	case Version4, Version4A:
@@ -134,7 +217,7 @@ func (c *Client) DialContext(ctx context.Context, network string, address M.Sock
 		}
 		return tcpConn, nil
 	case Version5:
-		response, err := ClientHandshake5(tcpConn, command, address, c.username, c.password)
+		response, err := ClientHandshake5Ex(ctx, tcpConn, command, address, c.clientAuthMethods())
 		if err != nil {
 			tcpConn.Close()
 			return nil, err
@@ -161,27 +244,44 @@ func (c *Client) ListenPacket(ctx context.Context, destination M.Socksaddr) (net
 	return conn.(*AssociatePacketConn), nil
 }
 
+// BindContext returns after the first BIND reply, so LocalAddr of the returned *BindConn is the bound address.
+// The connection of the peer is waited for by its Accept method or the first Read.
 func (c *Client) BindContext(ctx context.Context, address M.Socksaddr) (net.Conn, error) {
-	tcpConn, err := c.dialer.DialContext(ctx, N.NetworkTCP, c.serverAddr)
+	listener, err := c.ListenBind(ctx, address)
 	if err != nil {
 		return nil, err
 	}
+	return newBindConn(listener.conn, listener.version, listener.bindAddr, address), nil
+}
+
+func (c *Client) ListenBind(ctx context.Context, address M.Socksaddr) (*BindListener, error) {
+	tcpConn, err := c.dialServer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var bindAddr M.Socksaddr
 	switch c.version {
 	case Version4, Version4A:
-		_, err = ClientHandshake4(tcpConn, socks4.CommandBind, address, c.username)
-		if err != nil {
-			tcpConn.Close()
-			return nil, err
-		}
-		return tcpConn, nil
+		var response socks4.Response
+		response, err = ClientHandshake4(tcpConn, socks4.CommandBind, address, c.username)
+		bindAddr = response.Destination
 	case Version5:
-		_, err = ClientHandshake5(tcpConn, socks5.CommandBind, address, c.username, c.password)
-		if err != nil {
-			tcpConn.Close()
-			return nil, err
-		}
-		return tcpConn, nil
+		var response socks5.Response
+		response, err = ClientHandshake5Ex(ctx, tcpConn, socks5.CommandBind, address, c.clientAuthMethods())
+		bindAddr = response.Bind
+	default:
+		err = os.ErrInvalid
 	}
-	_ = tcpConn.Close()
-	return nil, os.ErrInvalid
+	if err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	if bindAddr.IsIP() && bindAddr.Addr.IsUnspecified() && c.serverAddr.IsIP() {
+		bindAddr.Addr = c.serverAddr.Addr
+	}
+	return &BindListener{
+		conn:     tcpConn,
+		version:  c.version,
+		bindAddr: bindAddr,
+	}, nil
 }
@@ -0,0 +1,150 @@
+package socks
+
+import (
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/varbin"
+	"github.com/sagernet/sing/protocol/socks/socks4"
+	"github.com/sagernet/sing/protocol/socks/socks5"
+)
+
+var _ net.Listener = (*BindListener)(nil)
+
+type BindListener struct {
+	conn     net.Conn
+	version  Version
+	bindAddr M.Socksaddr
+	access   sync.Mutex
+	accepted bool
+}
+
+func (l *BindListener) Accept() (net.Conn, error) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	if l.accepted {
+		return nil, net.ErrClosed
+	}
+	l.accepted = true
+	conn := newBindConn(l.conn, l.version, l.bindAddr, M.Socksaddr{})
+	_, err := conn.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (l *BindListener) Close() error {
+	return l.conn.Close()
+}
+
+func (l *BindListener) Addr() net.Addr {
+	return l.bindAddr.TCPAddr()
+}
+
+func (l *BindListener) BindAddr() M.Socksaddr {
+	return l.bindAddr
+}
+
+// BindConn is a BIND connection returned after the first reply, which carries the bound address.
+// The second reply, sent once the peer connects, is read by Accept or the first Read.
+type BindConn struct {
+	net.Conn
+	version     Version
+	localAddr   M.Socksaddr
+	destination M.Socksaddr
+	remoteAddr  M.Socksaddr
+	access      sync.Mutex
+	accepted    atomic.Bool
+	err         error
+}
+
+func newBindConn(conn net.Conn, version Version, bindAddr M.Socksaddr, destination M.Socksaddr) *BindConn {
+	return &BindConn{
+		Conn:        conn,
+		version:     version,
+		localAddr:   bindAddr,
+		destination: destination,
+	}
+}
+
+// Accept waits for the peer to connect to the bound address and returns the address of the peer.
+func (c *BindConn) Accept() (M.Socksaddr, error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.accepted.Load() || c.err != nil {
+		return c.remoteAddr, c.err
+	}
+	peer, err := readBindResponse(c.Conn, c.version)
+	if err != nil {
+		c.err = err
+		c.Conn.Close()
+		return M.Socksaddr{}, err
+	}
+	c.remoteAddr = peer
+	c.accepted.Store(true)
+	return peer, nil
+}
+
+func (c *BindConn) Read(p []byte) (n int, err error) {
+	if !c.accepted.Load() {
+		_, err = c.Accept()
+		if err != nil {
+			return
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+func readBindResponse(conn net.Conn, version Version) (M.Socksaddr, error) {
+	switch version {
+	case Version4, Version4A:
+		response, err := socks4.ReadResponse(varbin.StubReader(conn))
+		if err != nil {
+			return M.Socksaddr{}, err
+		}
+		if response.ReplyCode != socks4.ReplyCodeGranted {
+			return M.Socksaddr{}, E.New("socks4: bind rejected, code= ", response.ReplyCode)
+		}
+		return response.Destination, nil
+	case Version5:
+		response, err := socks5.ReadResponse(varbin.StubReader(conn))
+		if err != nil {
+			return M.Socksaddr{}, err
+		}
+		if response.ReplyCode != socks5.ReplyCodeSuccess {
+			return M.Socksaddr{}, E.New("socks5: bind rejected, code=", response.ReplyCode)
+		}
+		return response.Bind, nil
+	default:
+		return M.Socksaddr{}, os.ErrInvalid
+	}
+}
+
+func (c *BindConn) LocalAddr() net.Addr {
+	return c.localAddr.TCPAddr()
+}
+
+// RemoteAddr returns the address of the peer, or the requested address until the peer is accepted.
+func (c *BindConn) RemoteAddr() net.Addr {
+	if !c.accepted.Load() {
+		return c.destination.TCPAddr()
+	}
+	return c.remoteAddr.TCPAddr()
+}
+
+func (c *BindConn) ReaderReplaceable() bool {
+	return c.accepted.Load()
+}
+
+func (c *BindConn) WriterReplaceable() bool {
+	return true
+}
+
+func (c *BindConn) Upstream() any {
+	return c.Conn
+}
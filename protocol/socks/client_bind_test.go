@@ -0,0 +1,107 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testBindServer(t *testing.T, handler HandlerEx, options ServerOptions) M.Socksaddr {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testServe(t, listener, func(ctx context.Context, listener net.Listener) error {
+		return Serve(ctx, listener, handler, nil, options)
+	})
+	return M.SocksaddrFromNet(listener.Addr())
+}
+
+func TestClientBind(t *testing.T) {
+	t.Parallel()
+	client := NewClient(testDeadlineDialer{}, testBindServer(t, &testUserHandler{}, ServerOptions{BindRelay: true}), Version5, "", "")
+	conn, err := client.BindContext(context.Background(), M.ParseSocksaddr("0.0.0.0:0"))
+	require.NoError(t, err)
+	defer conn.Close()
+	bindAddr := M.SocksaddrFromNet(conn.LocalAddr())
+	require.NotZero(t, bindAddr.Port, "the bound address should be known before the peer connects")
+
+	peerConn, err := net.Dial("tcp", bindAddr.String())
+	require.NoError(t, err)
+	defer peerConn.Close()
+	_, err = peerConn.Write([]byte("ping"))
+	require.NoError(t, err)
+	response := make([]byte, 4)
+	_, err = io.ReadFull(conn, response)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(response))
+	require.Equal(t, M.SocksaddrFromNet(peerConn.LocalAddr()), M.SocksaddrFromNet(conn.RemoteAddr()))
+	_, err = conn.Write([]byte("pong"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(peerConn, response)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(response))
+}
+
+func TestClientBindAccept(t *testing.T) {
+	t.Parallel()
+	client := NewClient(testDeadlineDialer{}, testBindServer(t, &testUserHandler{}, ServerOptions{BindRelay: true}), Version5, "", "")
+	listener, err := client.ListenBind(context.Background(), M.ParseSocksaddr("0.0.0.0:0"))
+	require.NoError(t, err)
+	defer listener.Close()
+	peerConn, err := net.Dial("tcp", listener.BindAddr().String())
+	require.NoError(t, err)
+	defer peerConn.Close()
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	require.Equal(t, M.SocksaddrFromNet(peerConn.LocalAddr()), M.SocksaddrFromNet(conn.RemoteAddr()))
+	_, err = listener.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	conn, err = client.BindContext(context.Background(), M.ParseSocksaddr("192.0.2.1:0"))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, M.ParseSocksaddr("192.0.2.1:0"), M.SocksaddrFromNet(conn.RemoteAddr()))
+	peerConn, err = net.Dial("tcp", M.SocksaddrFromNet(conn.LocalAddr()).String())
+	require.NoError(t, err)
+	defer peerConn.Close()
+	_, err = conn.(*BindConn).Accept()
+	require.Error(t, err, "a peer other than the requested address should be rejected")
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+}
+
+type testBindHandler struct {
+	testUserHandler
+	peerChan chan M.Socksaddr
+}
+
+func (h *testBindHandler) NewBindConnectionEx(ctx context.Context, conn net.Conn, peerConn net.Conn, source M.Socksaddr, peer M.Socksaddr, onClose N.CloseHandlerFunc) {
+	h.peerChan <- peer
+	conn.Close()
+	peerConn.Close()
+}
+
+func TestServerBindHandler(t *testing.T) {
+	t.Parallel()
+	client := NewClient(testDeadlineDialer{}, testBindServer(t, &testUserHandler{}, ServerOptions{}), Version5, "", "")
+	_, err := client.BindContext(context.Background(), M.ParseSocksaddr("0.0.0.0:0"))
+	require.Error(t, err, "bind should be rejected without a bind handler or BindRelay")
+
+	handler := &testBindHandler{peerChan: make(chan M.Socksaddr, 1)}
+	client = NewClient(testDeadlineDialer{}, testBindServer(t, handler, ServerOptions{}), Version5, "", "")
+	conn, err := client.BindContext(context.Background(), M.ParseSocksaddr("0.0.0.0:0"))
+	require.NoError(t, err)
+	defer conn.Close()
+	peerConn, err := net.Dial("tcp", M.SocksaddrFromNet(conn.LocalAddr()).String())
+	require.NoError(t, err)
+	defer peerConn.Close()
+	peer, err := conn.(*BindConn).Accept()
+	require.NoError(t, err)
+	require.Equal(t, M.SocksaddrFromNet(peerConn.LocalAddr()), peer)
+	require.Equal(t, peer, <-handler.peerChan)
+}
@@ -0,0 +1,77 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testDestinationHandler struct {
+	destinationChan chan M.Socksaddr
+}
+
+func (h *testDestinationHandler) NewConnectionEx(ctx context.Context, conn net.Conn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	h.destinationChan <- destination
+	N.ReportConnHandshakeSuccess(conn, conn)
+	conn.Close()
+}
+
+func (h *testDestinationHandler) NewPacketConnectionEx(ctx context.Context, conn N.PacketConn, source M.Socksaddr, destination M.Socksaddr, onClose N.CloseHandlerFunc) {
+	conn.Close()
+}
+
+// testRedirectDialer dials server for every destination.
+type testRedirectDialer struct {
+	server M.Socksaddr
+}
+
+func (d testRedirectDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	return N.SystemDialer.DialContext(ctx, network, d.server)
+}
+
+func (d testRedirectDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return nil, net.ErrClosed
+}
+
+type testResolver struct{}
+
+func (r testResolver) LookupNetIP(ctx context.Context, network string, host string) ([]netip.Addr, error) {
+	return []netip.Addr{netip.MustParseAddr("192.0.2.1")}, nil
+}
+
+func TestClientFromURLResolve(t *testing.T) {
+	t.Parallel()
+	handler := &testDestinationHandler{destinationChan: make(chan M.Socksaddr, 1)}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testServe(t, listener, func(ctx context.Context, listener net.Listener) error {
+		return Serve(ctx, listener, handler, nil, ServerOptions{})
+	})
+	dialer := testRedirectDialer{M.SocksaddrFromNet(listener.Addr())}
+	for _, testCase := range []struct {
+		url      string
+		resolver Resolver
+		expected M.Socksaddr
+	}{
+		{"socks5://proxy.example.com", testResolver{}, M.ParseSocksaddr("192.0.2.1:80")},
+		{"socks5h://proxy.example.com", testResolver{}, M.ParseSocksaddr("example.com:80")},
+		{"socks://proxy.example.com", testResolver{}, M.ParseSocksaddr("example.com:80")},
+		{"socks4a://proxy.example.com", testResolver{}, M.ParseSocksaddr("example.com:80")},
+		{"socks4://proxy.example.com", testResolver{}, M.ParseSocksaddr("192.0.2.1:80")},
+	} {
+		client, err := NewClientFromURL(dialer, testCase.url)
+		require.NoError(t, err)
+		require.Equal(t, uint16(1080), client.serverAddr.Port)
+		client.SetResolver(testCase.resolver)
+		conn, err := client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddr("example.com:80"))
+		require.NoError(t, err, testCase.url)
+		conn.Close()
+		require.Equal(t, testCase.expected, <-handler.destinationChan, testCase.url)
+	}
+}
@@ -0,0 +1,58 @@
+package socks
+
+import (
+	"context"
+	"net/netip"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+var _ TorResolver = (*Client)(nil)
+
+func (c *Client) LookupIP(ctx context.Context, host string) (netip.Addr, error) {
+	tcpConn, err := c.dialServer(ctx)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer tcpConn.Close()
+	destination := M.Socksaddr{Fqdn: host}
+	switch c.version {
+	case Version4, Version4A:
+		response, err := ClientHandshake4(tcpConn, CommandTorResolve, destination, c.username)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		return response.Destination.Addr, nil
+	case Version5:
+		response, err := ClientHandshake5Ex(ctx, tcpConn, CommandTorResolve, destination, c.clientAuthMethods())
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		if !response.Bind.IsIP() {
+			return netip.Addr{}, E.New("socks5: torsocks: unexpected response address: ", response.Bind)
+		}
+		return response.Bind.Addr, nil
+	default:
+		return netip.Addr{}, E.New("socks: unknown version: ", c.version)
+	}
+}
+
+func (c *Client) LookupPTR(ctx context.Context, addr netip.Addr) (string, error) {
+	if c.version != Version5 {
+		return "", E.New("socks", c.version, ": torsocks: PTR lookup requires socks5")
+	}
+	tcpConn, err := c.dialServer(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tcpConn.Close()
+	response, err := ClientHandshake5Ex(ctx, tcpConn, CommandTorResolvePTR, M.SocksaddrFrom(addr, 0), c.clientAuthMethods())
+	if err != nil {
+		return "", err
+	}
+	if response.Bind.IsFqdn() {
+		return response.Bind.Fqdn, nil
+	}
+	return response.Bind.AddrString(), nil
+}
@@ -51,41 +51,14 @@ func ClientHandshake4(conn io.ReadWriter, command byte, destination M.Socksaddr,
 }
 
 func ClientHandshake5(conn io.ReadWriter, command byte, destination M.Socksaddr, username string, password string) (socks5.Response, error) {
-	reader := varbin.StubReader(conn)
-	var method byte
-	if username == "" {
-		method = socks5.AuthTypeNotRequired
-	} else {
-		method = socks5.AuthTypeUsernamePassword
-	}
-	err := socks5.WriteAuthRequest(conn, socks5.AuthRequest{
-		Methods: []byte{method},
-	})
-	if err != nil {
-		return socks5.Response{}, err
-	}
-	authResponse, err := socks5.ReadAuthResponse(reader)
+	return ClientHandshake5Ex(context.Background(), conn, command, destination, clientAuthMethods(username, password, nil))
+}
+
+func ClientHandshake5Ex(ctx context.Context, conn io.ReadWriter, command byte, destination M.Socksaddr, authMethods []ClientAuthMethod) (socks5.Response, error) {
+	err := negotiateClientAuth(ctx, conn, authMethods)
 	if err != nil {
 		return socks5.Response{}, err
 	}
-	if authResponse.Method == socks5.AuthTypeUsernamePassword {
-		err = socks5.WriteUsernamePasswordAuthRequest(conn, socks5.UsernamePasswordAuthRequest{
-			Username: username,
-			Password: password,
-		})
-		if err != nil {
-			return socks5.Response{}, err
-		}
-		usernamePasswordResponse, err := socks5.ReadUsernamePasswordAuthResponse(reader)
-		if err != nil {
-			return socks5.Response{}, err
-		}
-		if usernamePasswordResponse.Status != socks5.UsernamePasswordStatusSuccess {
-			return socks5.Response{}, E.New("socks5: incorrect user name or password")
-		}
-	} else if authResponse.Method != socks5.AuthTypeNotRequired {
-		return socks5.Response{}, E.New("socks5: unsupported auth method: ", authResponse.Method)
-	}
 
 	if command == socks5.CommandUDPAssociate {
 		if destination.Addr.IsPrivate() {
@@ -113,7 +86,7 @@ func ClientHandshake5(conn io.ReadWriter, command byte, destination M.Socksaddr,
 	if err != nil {
 		return socks5.Response{}, err
 	}
-	response, err := socks5.ReadResponse(reader)
+	response, err := socks5.ReadResponse(varbin.StubReader(conn))
 	if err != nil {
 		return socks5.Response{}, err
 	}
@@ -123,16 +96,50 @@ func ClientHandshake5(conn io.ReadWriter, command byte, destination M.Socksaddr,
 	return response, err
 }
 
+type ServerOptions struct {
+	Authenticator     auth.Verifier
+	AuthMethods       []ServerAuthMethod
+	PacketListener    PacketListener
+	HandshakeTimeout  time.Duration
+	Commands          []byte
+	Resolver          TorResolver
+	UDPTimeout        time.Duration
+	UDPBindAddress    netip.Addr
+	UDPAllowAnySource bool
+	UDPFragmentMTU    int
+	// BindRelay relays BIND connections directly for handlers that do not implement BindHandlerEx.
+	BindRelay bool
+}
+
 func HandleConnectionEx(
 	ctx context.Context, conn net.Conn, reader *std_bufio.Reader,
-	authenticator *auth.Authenticator,
+	authenticator auth.Verifier,
 	handler HandlerEx,
 	packetListener PacketListener,
 	udpTimeout time.Duration,
-	// resolver TorResolver,
 	source M.Socksaddr,
 	onClose N.CloseHandlerFunc,
 ) error {
+	return HandleConnectionWithOptions(ctx, conn, reader, handler, source, onClose, ServerOptions{
+		Authenticator:  authenticator,
+		PacketListener: packetListener,
+		UDPTimeout:     udpTimeout,
+	})
+}
+
+func HandleConnectionWithOptions(
+	ctx context.Context, conn net.Conn, reader *std_bufio.Reader,
+	handler HandlerEx,
+	source M.Socksaddr,
+	onClose N.CloseHandlerFunc,
+	options ServerOptions,
+) error {
+	if options.HandshakeTimeout > 0 {
+		err := conn.SetDeadline(time.Now().Add(options.HandshakeTimeout))
+		if err != nil {
+			return err
+		}
+	}
 	version, err := reader.ReadByte()
 	if err != nil {
 		return err
@@ -144,24 +151,40 @@ func HandleConnectionEx(
 		if err != nil {
 			return err
 		}
+		if auth.IsEnabled(options.Authenticator) {
+			ctx, err = options.Authenticator.VerifyContext(ctx, request.Username, "")
+			if err != nil {
+				return E.Errors(E.Cause(err, "socks4: authentication failed, username=", request.Username), socks4.WriteResponse(conn, socks4.Response{
+					ReplyCode: socks4.ReplyCodeRejectedOrFailed,
+				}))
+			}
+		} else {
+			ctx = auth.ContextWithUser(ctx, request.Username)
+		}
+		if !options.commandAllowed(request.Command) {
+			return E.Errors(E.New("socks4: command not allowed: ", request.Command), socks4.WriteResponse(conn, socks4.Response{
+				ReplyCode: socks4.ReplyCodeRejectedOrFailed,
+			}))
+		}
 		switch request.Command {
 		case socks4.CommandConnect:
-			if authenticator != nil && !authenticator.Verify(request.Username, "") {
+			err = options.handshakeFinished(conn)
+			if err != nil {
+				return err
+			}
+			handler.NewConnectionEx(ctx, NewLazyConn(conn, version), source, request.Destination, onClose)
+			return nil
+		case CommandTorResolve, CommandTorResolvePTR:
+			if options.Resolver == nil {
 				err = socks4.WriteResponse(conn, socks4.Response{
 					ReplyCode: socks4.ReplyCodeRejectedOrFailed,
 				})
 				if err != nil {
 					return err
 				}
-				return E.New("socks4: authentication failed, username=", request.Username)
+				return E.New("socks4: torsocks: commands not implemented")
 			}
-			handler.NewConnectionEx(auth.ContextWithUser(ctx, request.Username), NewLazyConn(conn, version), source, request.Destination, onClose)
-			return nil
-		/*case CommandTorResolve, CommandTorResolvePTR:
-		if resolver == nil {
-			return E.New("socks4: torsocks: commands not implemented")
-		}
-		return handleTorSocks4(ctx, conn, request, resolver)*/
+			return handleTorSocks4(ctx, conn, request, options.Resolver)
 		default:
 			err = socks4.WriteResponse(conn, socks4.Response{
 				ReplyCode: socks4.ReplyCodeRejectedOrFailed,
@@ -177,100 +200,43 @@ func HandleConnectionEx(
 		if err != nil {
 			return err
 		}
-		var authMethod byte
-		if authenticator != nil && !common.Contains(authRequest.Methods, socks5.AuthTypeUsernamePassword) {
-			err = socks5.WriteAuthResponse(conn, socks5.AuthResponse{
-				Method: socks5.AuthTypeNoAcceptedMethods,
-			})
-			if err != nil {
-				return err
-			}
-		}
-		if authenticator != nil {
-			authMethod = socks5.AuthTypeUsernamePassword
-		} else {
-			authMethod = socks5.AuthTypeNotRequired
-		}
-		err = socks5.WriteAuthResponse(conn, socks5.AuthResponse{
-			Method: authMethod,
-		})
+		ctx, err = negotiateServerAuth(ctx, serverConn{conn, reader}, authRequest, serverAuthMethods(options.Authenticator, options.AuthMethods))
 		if err != nil {
 			return err
 		}
-		if authMethod == socks5.AuthTypeUsernamePassword {
-			var usernamePasswordAuthRequest socks5.UsernamePasswordAuthRequest
-			usernamePasswordAuthRequest, err = socks5.ReadUsernamePasswordAuthRequest(reader)
-			if err != nil {
-				return err
-			}
-			ctx = auth.ContextWithUser(ctx, usernamePasswordAuthRequest.Username)
-			response := socks5.UsernamePasswordAuthResponse{}
-			if authenticator.Verify(usernamePasswordAuthRequest.Username, usernamePasswordAuthRequest.Password) {
-				response.Status = socks5.UsernamePasswordStatusSuccess
-			} else {
-				response.Status = socks5.UsernamePasswordStatusFailure
-			}
-			err = socks5.WriteUsernamePasswordAuthResponse(conn, response)
-			if err != nil {
-				return err
-			}
-			if response.Status != socks5.UsernamePasswordStatusSuccess {
-				return E.New("socks5: authentication failed, username=", usernamePasswordAuthRequest.Username, ", password=", usernamePasswordAuthRequest.Password)
-			}
-		}
 		var request socks5.Request
 		request, err = socks5.ReadRequest(reader)
 		if err != nil {
 			return err
 		}
+		if !options.commandAllowed(request.Command) {
+			return E.Errors(E.New("socks5: command not allowed: ", request.Command), socks5.WriteResponse(conn, socks5.Response{
+				ReplyCode: socks5.ReplyCodeNotAllowed,
+			}))
+		}
 		switch request.Command {
 		case socks5.CommandConnect:
+			err = options.handshakeFinished(conn)
+			if err != nil {
+				return err
+			}
 			handler.NewConnectionEx(ctx, NewLazyConn(conn, version), source, request.Destination, onClose)
 			return nil
+		case socks5.CommandBind:
+			return handleBind5(ctx, conn, handler, request, source, onClose, options)
 		case socks5.CommandUDPAssociate:
-			var (
-				listenConfig net.ListenConfig
-				udpConn      net.PacketConn
-			)
-			if packetListener != nil {
-				udpConn, err = packetListener.ListenPacket(listenConfig, ctx, M.NetworkFromNetAddr("udp", M.AddrFromNet(conn.LocalAddr())), M.SocksaddrFrom(M.AddrFromNet(conn.LocalAddr()), 0).String())
-			} else {
-				udpConn, err = listenConfig.ListenPacket(ctx, M.NetworkFromNetAddr("udp", M.AddrFromNet(conn.LocalAddr())), M.SocksaddrFrom(M.AddrFromNet(conn.LocalAddr()), 0).String())
-			}
-			if err != nil {
-				return E.Cause(err, "socks5: listen udp")
-			}
-			err = socks5.WriteResponse(conn, socks5.Response{
-				ReplyCode: socks5.ReplyCodeSuccess,
-				Bind:      M.SocksaddrFromNet(udpConn.LocalAddr()).Unwrap(),
-			})
-			if err != nil {
-				return E.Cause(err, "socks5: write response")
-			}
-			var socksPacketConn N.PacketConn = NewAssociatePacketConn(bufio.NewServerPacketConn(udpConn), M.Socksaddr{}, conn)
-			if udpTimeout > 0 {
-				udpConn.SetReadDeadline(time.Now().Add(udpTimeout))
-			}
-			firstPacket := buf.NewPacket()
-			var destination M.Socksaddr
-			destination, err = socksPacketConn.ReadPacket(firstPacket)
-			if err != nil {
-				return E.Cause(err, "socks5: read first packet")
-			}
-			if udpTimeout > 0 {
-				udpConn.SetReadDeadline(time.Time{})
-			}
-			if udpTimeout > 0 {
-				ctx, socksPacketConn = canceler.NewPacketConn(ctx, socksPacketConn, udpTimeout)
+			return handleUDPAssociate5(ctx, conn, handler, request, source, onClose, options)
+		case CommandTorResolve, CommandTorResolvePTR:
+			if options.Resolver == nil {
+				err = socks5.WriteResponse(conn, socks5.Response{
+					ReplyCode: socks5.ReplyCodeUnsupported,
+				})
+				if err != nil {
+					return err
+				}
+				return E.New("socks5: torsocks: commands not implemented")
 			}
-			socksPacketConn = bufio.NewCachedPacketConn(socksPacketConn, firstPacket, destination)
-			handler.NewPacketConnectionEx(ctx, socksPacketConn, source, destination, onClose)
-			return nil
-		/*case CommandTorResolve, CommandTorResolvePTR:
-		if resolver == nil {
-			return E.New("socks4: torsocks: commands not implemented")
-		}
-		return handleTorSocks5(ctx, conn, request, resolver)*/
+			return handleTorSocks5(ctx, conn, request, options.Resolver)
 		default:
 			err = socks5.WriteResponse(conn, socks5.Response{
 				ReplyCode: socks5.ReplyCodeUnsupported,
@@ -283,3 +249,70 @@ func HandleConnectionEx(
 	}
 	return os.ErrInvalid
 }
+
+func handleUDPAssociate5(ctx context.Context, conn net.Conn, handler HandlerEx, request socks5.Request, source M.Socksaddr, onClose N.CloseHandlerFunc, options ServerOptions) error {
+	bindAddr := options.UDPBindAddress
+	if !bindAddr.IsValid() {
+		bindAddr = M.AddrFromNet(conn.LocalAddr())
+	}
+	var (
+		listenConfig net.ListenConfig
+		udpConn      net.PacketConn
+		err          error
+	)
+	if options.PacketListener != nil {
+		udpConn, err = options.PacketListener.ListenPacket(listenConfig, ctx, M.NetworkFromNetAddr("udp", bindAddr), M.SocksaddrFrom(bindAddr, 0).String())
+	} else {
+		udpConn, err = listenConfig.ListenPacket(ctx, M.NetworkFromNetAddr("udp", bindAddr), M.SocksaddrFrom(bindAddr, 0).String())
+	}
+	if err != nil {
+		return E.Cause(err, "socks5: listen udp")
+	}
+	if !options.UDPAllowAnySource {
+		udpConn = newAssociateSourceConn(udpConn, request.Destination, M.SocksaddrFromNet(conn.RemoteAddr()))
+	}
+	err = socks5.WriteResponse(conn, socks5.Response{
+		ReplyCode: socks5.ReplyCodeSuccess,
+		Bind:      M.SocksaddrFromNet(udpConn.LocalAddr()).Unwrap(),
+	})
+	if err != nil {
+		udpConn.Close()
+		return E.Cause(err, "socks5: write response")
+	}
+	err = options.handshakeFinished(conn)
+	if err != nil {
+		udpConn.Close()
+		return err
+	}
+	associatePacketConn := NewAssociatePacketConn(bufio.NewServerPacketConn(udpConn), M.Socksaddr{}, conn)
+	associatePacketConn.SetFragmentMTU(options.UDPFragmentMTU)
+	var socksPacketConn N.PacketConn = associatePacketConn
+	if options.UDPTimeout > 0 {
+		udpConn.SetReadDeadline(time.Now().Add(options.UDPTimeout))
+	}
+	firstPacket := buf.NewPacket()
+	destination, err := socksPacketConn.ReadPacket(firstPacket)
+	if err != nil {
+		firstPacket.Release()
+		udpConn.Close()
+		return E.Cause(err, "socks5: read first packet")
+	}
+	if options.UDPTimeout > 0 {
+		udpConn.SetReadDeadline(time.Time{})
+		ctx, socksPacketConn = canceler.NewPacketConn(ctx, socksPacketConn, options.UDPTimeout)
+	}
+	socksPacketConn = bufio.NewCachedPacketConn(socksPacketConn, firstPacket, destination)
+	handler.NewPacketConnectionEx(ctx, socksPacketConn, source, destination, onClose)
+	return nil
+}
+
+func (o ServerOptions) commandAllowed(command byte) bool {
+	return len(o.Commands) == 0 || common.Contains(o.Commands, command)
+}
+
+func (o ServerOptions) handshakeFinished(conn net.Conn) error {
+	if o.HandshakeTimeout > 0 {
+		return conn.SetDeadline(time.Time{})
+	}
+	return nil
+}
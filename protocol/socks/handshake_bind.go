@@ -0,0 +1,100 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/protocol/socks/socks5"
+)
+
+const DefaultBindTimeout = 2 * time.Minute
+
+// BindHandlerEx receives the connection accepted for a BIND request.
+// When the handler does not implement it, BIND is rejected unless ServerOptions.BindRelay is set,
+// in which case the server relays conn and peerConn directly.
+type BindHandlerEx interface {
+	NewBindConnectionEx(ctx context.Context, conn net.Conn, peerConn net.Conn, source M.Socksaddr, peer M.Socksaddr, onClose N.CloseHandlerFunc)
+}
+
+func handleBind5(ctx context.Context, conn net.Conn, handler HandlerEx, request socks5.Request, source M.Socksaddr, onClose N.CloseHandlerFunc, options ServerOptions) error {
+	bindHandler, isBindHandler := handler.(BindHandlerEx)
+	if !isBindHandler && !options.BindRelay {
+		return E.Errors(E.New("socks5: bind not supported by handler"), socks5.WriteResponse(conn, socks5.Response{
+			ReplyCode: socks5.ReplyCodeUnsupported,
+		}))
+	}
+	var listenConfig net.ListenConfig
+	listener, err := listenConfig.Listen(ctx, M.NetworkFromNetAddr(N.NetworkTCP, M.AddrFromNet(conn.LocalAddr())), M.SocksaddrFrom(M.AddrFromNet(conn.LocalAddr()), 0).String())
+	if err != nil {
+		return E.Errors(E.Cause(err, "socks5: listen tcp"), socks5.WriteResponse(conn, socks5.Response{
+			ReplyCode: socks5.ReplyCodeForError(err),
+		}))
+	}
+	err = socks5.WriteResponse(conn, socks5.Response{
+		ReplyCode: socks5.ReplyCodeSuccess,
+		Bind:      M.SocksaddrFromNet(listener.Addr()).Unwrap(),
+	})
+	if err != nil {
+		listener.Close()
+		return E.Cause(err, "socks5: write response")
+	}
+	err = options.handshakeFinished(conn)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	peerConn, err := acceptBind(ctx, listener)
+	if err != nil {
+		return E.Errors(E.Cause(err, "socks5: accept bind"), socks5.WriteResponse(conn, socks5.Response{
+			ReplyCode: socks5.ReplyCodeFailure,
+		}))
+	}
+	peer := M.SocksaddrFromNet(peerConn.RemoteAddr()).Unwrap()
+	if request.Destination.IsIP() && !request.Destination.Addr.IsUnspecified() && request.Destination.Addr != peer.Addr {
+		peerConn.Close()
+		return E.Errors(E.New("socks5: bind: unexpected peer ", peer, ", expected ", request.Destination.Addr), socks5.WriteResponse(conn, socks5.Response{
+			ReplyCode: socks5.ReplyCodeNotAllowed,
+		}))
+	}
+	err = socks5.WriteResponse(conn, socks5.Response{
+		ReplyCode: socks5.ReplyCodeSuccess,
+		Bind:      peer,
+	})
+	if err != nil {
+		peerConn.Close()
+		return E.Cause(err, "socks5: write response")
+	}
+	if isBindHandler {
+		bindHandler.NewBindConnectionEx(ctx, conn, peerConn, source, peer, onClose)
+		return nil
+	}
+	err = bufio.CopyConn(ctx, conn, peerConn)
+	if onClose != nil {
+		onClose(err)
+	}
+	return nil
+}
+
+func acceptBind(ctx context.Context, listener net.Listener) (net.Conn, error) {
+	defer listener.Close()
+	if deadlineListener, isDeadlineListener := listener.(interface {
+		SetDeadline(t time.Time) error
+	}); isDeadlineListener {
+		deadlineListener.SetDeadline(time.Now().Add(DefaultBindTimeout))
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-done:
+		}
+	}()
+	return listener.Accept()
+}
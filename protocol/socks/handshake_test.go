@@ -0,0 +1,71 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/protocol/socks/socks5"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testPacketListener struct {
+	addressChan chan string
+}
+
+func (l *testPacketListener) ListenPacket(listenConfig net.ListenConfig, ctx context.Context, network string, address string) (net.PacketConn, error) {
+	l.addressChan <- address
+	return listenConfig.ListenPacket(ctx, network, address)
+}
+
+func TestServerOptionsCommands(t *testing.T) {
+	t.Parallel()
+	handler := &testUserHandler{userChan: make(chan string, 1)}
+	dialer := &testServerDialer{handler: handler, options: ServerOptions{Commands: []byte{socks5.CommandConnect}}}
+	client := NewClient(dialer, M.Socksaddr{}, Version5, "", "")
+	conn, err := client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddr("1.1.1.1:53"))
+	require.NoError(t, err)
+	conn.Close()
+	require.Equal(t, "", <-handler.userChan)
+
+	conn, err = dialer.DialContext(context.Background(), N.NetworkTCP, M.Socksaddr{})
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = ClientHandshake5(conn, socks5.CommandUDPAssociate, M.ParseSocksaddr("0.0.0.0:0"), "", "")
+	require.Error(t, err, "commands not listed should be rejected")
+}
+
+func TestServerOptionsHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+	dialer := &testServerDialer{handler: &testUserHandler{}, options: ServerOptions{HandshakeTimeout: 10 * time.Millisecond}}
+	conn, err := dialer.DialContext(context.Background(), N.NetworkTCP, M.Socksaddr{})
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF, "a stalled handshake should be closed by the server")
+}
+
+func TestServerOptionsUDPBindAddress(t *testing.T) {
+	t.Parallel()
+	packetListener := &testPacketListener{addressChan: make(chan string, 1)}
+	dialer := &testServerDialer{handler: &testUserHandler{}, options: ServerOptions{
+		PacketListener: packetListener,
+		UDPBindAddress: netip.MustParseAddr("127.0.0.1"),
+		UDPTimeout:     100 * time.Millisecond,
+	}}
+	conn, err := dialer.DialContext(context.Background(), N.NetworkTCP, M.Socksaddr{})
+	require.NoError(t, err)
+	defer conn.Close()
+	response, err := ClientHandshake5(conn, socks5.CommandUDPAssociate, M.ParseSocksaddr("0.0.0.0:0"), "", "")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:0", <-packetListener.addressChan)
+	require.Equal(t, netip.MustParseAddr("127.0.0.1"), response.Bind.Addr)
+	require.NotZero(t, response.Bind.Port)
+}
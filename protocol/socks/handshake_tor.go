@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/netip"
 	"os"
+	"strconv"
 	"strings"
 
 	E "github.com/sagernet/sing/common/exceptions"
@@ -23,22 +24,25 @@ type TorResolver interface {
 	LookupPTR(ctx context.Context, addr netip.Addr) (string, error)
 }
 
-//nolint:unused
 func handleTorSocks4(ctx context.Context, conn net.Conn, request socks4.Request, resolver TorResolver) error {
 	switch request.Command {
 	case CommandTorResolve:
 		if !request.Destination.IsDomain() {
-			return E.New("socks4: torsocks: invalid destination")
+			return E.Errors(E.New("socks4: torsocks: invalid destination"), socks4.WriteResponse(conn, socks4.Response{
+				ReplyCode: socks4.ReplyCodeRejectedOrFailed,
+			}))
 		}
 		ipAddr, err := resolver.LookupIP(ctx, request.Destination.Fqdn)
 		if err != nil {
-			err = socks4.WriteResponse(conn, socks4.Response{
+			return E.Errors(E.Cause(err, "socks4: torsocks: lookup failed for domain: ", request.Destination.Fqdn), socks4.WriteResponse(conn, socks4.Response{
 				ReplyCode: socks4.ReplyCodeRejectedOrFailed,
-			})
-			if err != nil {
-				return err
-			}
-			return E.Cause(err, "socks4: torsocks: lookup failed for domain: ", request.Destination.Fqdn)
+			}))
+		}
+		ipAddr = ipAddr.Unmap()
+		if !ipAddr.Is4() {
+			return E.Errors(E.New("socks4: torsocks: non-IPv4 result for domain: ", request.Destination.Fqdn), socks4.WriteResponse(conn, socks4.Response{
+				ReplyCode: socks4.ReplyCodeRejectedOrFailed,
+			}))
 		}
 		err = socks4.WriteResponse(conn, socks4.Response{
 			ReplyCode:   socks4.ReplyCodeGranted,
@@ -49,58 +53,40 @@ func handleTorSocks4(ctx context.Context, conn net.Conn, request socks4.Request,
 		}
 		return nil
 	case CommandTorResolvePTR:
-		var ipAddr netip.Addr
-		if request.Destination.IsIP() {
-			ipAddr = request.Destination.Addr
-		} else if strings.HasSuffix(request.Destination.Fqdn, ".in-addr.arpa") {
-			ipAddr, _ = netip.ParseAddr(request.Destination.Fqdn[:len(request.Destination.Fqdn)-len(".in-addr.arpa")])
-		} else if strings.HasSuffix(request.Destination.Fqdn, ".ip6.arpa") {
-			ipAddr, _ = netip.ParseAddr(strings.ReplaceAll(request.Destination.Fqdn[:len(request.Destination.Fqdn)-len(".ip6.arpa")], ".", ":"))
-		}
+		ipAddr := torPTRAddr(request.Destination)
 		if !ipAddr.IsValid() {
-			return E.New("socks4: torsocks: invalid destination")
+			return E.Errors(E.New("socks4: torsocks: invalid destination"), socks4.WriteResponse(conn, socks4.Response{
+				ReplyCode: socks4.ReplyCodeRejectedOrFailed,
+			}))
 		}
 		host, err := resolver.LookupPTR(ctx, ipAddr)
 		if err != nil {
-			err = socks4.WriteResponse(conn, socks4.Response{
+			return E.Errors(E.Cause(err, "socks4: torsocks: lookup PTR failed for ip: ", ipAddr), socks4.WriteResponse(conn, socks4.Response{
 				ReplyCode: socks4.ReplyCodeRejectedOrFailed,
-			})
-			if err != nil {
-				return err
-			}
-			return E.Cause(err, "socks4: torsocks: lookup PTR failed for ip: ", ipAddr)
+			}))
 		}
-		err = socks4.WriteResponse(conn, socks4.Response{
-			ReplyCode: socks4.ReplyCodeGranted,
-			Destination: M.Socksaddr{
-				Fqdn: host,
-			},
-		})
-		if err != nil {
-			return E.Cause(err, "socks4: torsocks: write response")
-		}
-		return nil
+		// A socks4 response only holds an IPv4 address, so the host name is refused like Tor does.
+		return E.Errors(E.New("socks4: torsocks: PTR result requires socks5: ", host), socks4.WriteResponse(conn, socks4.Response{
+			ReplyCode: socks4.ReplyCodeRejectedOrFailed,
+		}))
 	default:
 		return os.ErrInvalid
 	}
 }
 
-//nolint:unused
 func handleTorSocks5(ctx context.Context, conn net.Conn, request socks5.Request, resolver TorResolver) error {
 	switch request.Command {
 	case CommandTorResolve:
 		if !request.Destination.IsDomain() {
-			return E.New("socks5: torsocks: invalid destination")
+			return E.Errors(E.New("socks5: torsocks: invalid destination"), socks5.WriteResponse(conn, socks5.Response{
+				ReplyCode: socks5.ReplyCodeAddressTypeUnsupported,
+			}))
 		}
 		ipAddr, err := resolver.LookupIP(ctx, request.Destination.Fqdn)
 		if err != nil {
-			err = socks5.WriteResponse(conn, socks5.Response{
+			return E.Errors(E.Cause(err, "socks5: torsocks: lookup failed for domain: ", request.Destination.Fqdn), socks5.WriteResponse(conn, socks5.Response{
 				ReplyCode: socks5.ReplyCodeFailure,
-			})
-			if err != nil {
-				return err
-			}
-			return E.Cause(err, "socks5: torsocks: lookup failed for domain: ", request.Destination.Fqdn)
+			}))
 		}
 		err = socks5.WriteResponse(conn, socks5.Response{
 			ReplyCode: socks5.ReplyCodeSuccess,
@@ -111,26 +97,17 @@ func handleTorSocks5(ctx context.Context, conn net.Conn, request socks5.Request,
 		}
 		return nil
 	case CommandTorResolvePTR:
-		var ipAddr netip.Addr
-		if request.Destination.IsIP() {
-			ipAddr = request.Destination.Addr
-		} else if strings.HasSuffix(request.Destination.Fqdn, ".in-addr.arpa") {
-			ipAddr, _ = netip.ParseAddr(request.Destination.Fqdn[:len(request.Destination.Fqdn)-len(".in-addr.arpa")])
-		} else if strings.HasSuffix(request.Destination.Fqdn, ".ip6.arpa") {
-			ipAddr, _ = netip.ParseAddr(strings.ReplaceAll(request.Destination.Fqdn[:len(request.Destination.Fqdn)-len(".ip6.arpa")], ".", ":"))
-		}
+		ipAddr := torPTRAddr(request.Destination)
 		if !ipAddr.IsValid() {
-			return E.New("socks5: torsocks: invalid destination")
+			return E.Errors(E.New("socks5: torsocks: invalid destination"), socks5.WriteResponse(conn, socks5.Response{
+				ReplyCode: socks5.ReplyCodeAddressTypeUnsupported,
+			}))
 		}
 		host, err := resolver.LookupPTR(ctx, ipAddr)
 		if err != nil {
-			err = socks5.WriteResponse(conn, socks5.Response{
+			return E.Errors(E.Cause(err, "socks5: torsocks: lookup PTR failed for ip: ", ipAddr), socks5.WriteResponse(conn, socks5.Response{
 				ReplyCode: socks5.ReplyCodeFailure,
-			})
-			if err != nil {
-				return err
-			}
-			return E.Cause(err, "socks5: torsocks: lookup PTR failed for ip: ", ipAddr)
+			}))
 		}
 		err = socks5.WriteResponse(conn, socks5.Response{
 			ReplyCode: socks5.ReplyCodeSuccess,
@@ -146,3 +123,41 @@ func handleTorSocks5(ctx context.Context, conn net.Conn, request socks5.Request,
 		return os.ErrInvalid
 	}
 }
+
+// torPTRAddr returns the address of a PTR request, given as an IP address or its reverse DNS name.
+func torPTRAddr(destination M.Socksaddr) netip.Addr {
+	if destination.IsIP() {
+		return destination.Addr
+	}
+	var (
+		labels []string
+		ip     []byte
+	)
+	if name, loaded := strings.CutSuffix(destination.Fqdn, ".in-addr.arpa"); loaded {
+		labels = strings.Split(name, ".")
+		if len(labels) != 4 {
+			return netip.Addr{}
+		}
+		for index := len(labels) - 1; index >= 0; index-- {
+			octet, err := strconv.ParseUint(labels[index], 10, 8)
+			if err != nil {
+				return netip.Addr{}
+			}
+			ip = append(ip, byte(octet))
+		}
+	} else if name, loaded = strings.CutSuffix(destination.Fqdn, ".ip6.arpa"); loaded {
+		labels = strings.Split(name, ".")
+		if len(labels) != 32 {
+			return netip.Addr{}
+		}
+		for index := len(labels) - 1; index > 0; index -= 2 {
+			octet, err := strconv.ParseUint(labels[index]+labels[index-1], 16, 8)
+			if err != nil || len(labels[index]) != 1 || len(labels[index-1]) != 1 {
+				return netip.Addr{}
+			}
+			ip = append(ip, byte(octet))
+		}
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr
+}
@@ -0,0 +1,125 @@
+package socks
+
+import (
+	std_bufio "bufio"
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/protocol/socks/socks4"
+	"github.com/sagernet/sing/protocol/socks/socks5"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testServerDialer serves every dialed connection with options over a pipe.
+type testServerDialer struct {
+	handler HandlerEx
+	options ServerOptions
+}
+
+func (d *testServerDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	serverConn, clientConn := net.Pipe()
+	go func() {
+		err := HandleConnectionWithOptions(context.Background(), serverConn, std_bufio.NewReader(serverConn), d.handler, M.ParseSocksaddr("127.0.0.1:1234"), nil, d.options)
+		if err != nil {
+			serverConn.Close()
+		}
+	}()
+	return clientConn, nil
+}
+
+func (d *testServerDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return nil, net.ErrClosed
+}
+
+type testTorResolver struct{}
+
+func (r testTorResolver) LookupIP(ctx context.Context, host string) (netip.Addr, error) {
+	if host != "example.com" {
+		return netip.Addr{}, E.New("not found")
+	}
+	return netip.MustParseAddr("192.0.2.1"), nil
+}
+
+func (r testTorResolver) LookupPTR(ctx context.Context, addr netip.Addr) (string, error) {
+	if addr != netip.MustParseAddr("192.0.2.1") {
+		return "", E.New("not found")
+	}
+	return "example.com", nil
+}
+
+func TestTorResolve(t *testing.T) {
+	t.Parallel()
+	dialer := &testServerDialer{handler: &testUserHandler{userChan: make(chan string, 1)}, options: ServerOptions{Resolver: testTorResolver{}}}
+	for _, version := range []Version{Version4A, Version5} {
+		client := NewClient(dialer, M.Socksaddr{}, version, "", "")
+		addr, err := client.LookupIP(context.Background(), "example.com")
+		require.NoError(t, err, version)
+		require.Equal(t, netip.MustParseAddr("192.0.2.1"), addr)
+		_, err = client.LookupIP(context.Background(), "invalid.example")
+		require.Error(t, err, version)
+	}
+
+	client := NewClient(dialer, M.Socksaddr{}, Version5, "", "")
+	host, err := client.LookupPTR(context.Background(), netip.MustParseAddr("192.0.2.1"))
+	require.NoError(t, err)
+	require.Equal(t, "example.com", host)
+	_, err = client.LookupPTR(context.Background(), netip.MustParseAddr("192.0.2.2"))
+	require.Error(t, err)
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", M.Socksaddr{})
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = ClientHandshake4(conn, CommandTorResolvePTR, M.Socksaddr{Fqdn: "1.2.0.192.in-addr.arpa"}, "")
+	require.Error(t, err, "socks4 can not carry a PTR result")
+
+	client = NewClient(&testServerDialer{handler: dialer.handler}, M.Socksaddr{}, Version5, "", "")
+	_, err = client.LookupIP(context.Background(), "example.com")
+	require.Error(t, err, "resolve should be rejected without a resolver")
+}
+
+func TestTorResolveInvalidDestination(t *testing.T) {
+	t.Parallel()
+	dialer := &testServerDialer{handler: &testUserHandler{userChan: make(chan string, 1)}, options: ServerOptions{Resolver: testTorResolver{}}}
+	for _, testCase := range []struct {
+		command     byte
+		destination M.Socksaddr
+	}{
+		{CommandTorResolve, M.ParseSocksaddr("192.0.2.1:0")},
+		{CommandTorResolvePTR, M.Socksaddr{Fqdn: "example.com"}},
+	} {
+		conn, err := dialer.DialContext(context.Background(), "tcp", M.Socksaddr{})
+		require.NoError(t, err)
+		response, err := ClientHandshake5(conn, testCase.command, testCase.destination, "", "")
+		conn.Close()
+		require.Error(t, err)
+		require.Equal(t, socks5.ReplyCodeAddressTypeUnsupported, response.ReplyCode, testCase.command)
+	}
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", M.Socksaddr{})
+	require.NoError(t, err)
+	defer conn.Close()
+	response, err := ClientHandshake4(conn, CommandTorResolve, M.ParseSocksaddr("192.0.2.1:0"), "")
+	require.Error(t, err)
+	require.Equal(t, socks4.ReplyCodeRejectedOrFailed, response.ReplyCode)
+}
+
+func TestTorPTRAddr(t *testing.T) {
+	t.Parallel()
+	for _, testCase := range []struct {
+		destination M.Socksaddr
+		expected    netip.Addr
+	}{
+		{M.ParseSocksaddr("192.0.2.1:0"), netip.MustParseAddr("192.0.2.1")},
+		{M.Socksaddr{Fqdn: "1.2.0.192.in-addr.arpa"}, netip.MustParseAddr("192.0.2.1")},
+		{M.Socksaddr{Fqdn: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"}, netip.MustParseAddr("2001:db8::1")},
+		{M.Socksaddr{Fqdn: "2.0.192.in-addr.arpa"}, netip.Addr{}},
+		{M.Socksaddr{Fqdn: "example.com"}, netip.Addr{}},
+	} {
+		require.Equal(t, testCase.expected, torPTRAddr(testCase.destination))
+	}
+}
@@ -1,7 +1,7 @@
 package socks
 
 import (
-	"bytes"
+	"io"
 	"net"
 
 	"github.com/sagernet/sing/common"
@@ -22,9 +22,11 @@ var ErrInvalidPacket = E.New("socks5: invalid packet")
 
 type AssociatePacketConn struct {
 	N.AbstractConn
-	conn       N.ExtendedConn
-	remoteAddr M.Socksaddr
-	underlying net.Conn
+	conn        N.ExtendedConn
+	remoteAddr  M.Socksaddr
+	underlying  net.Conn
+	fragments   fragmentQueue
+	fragmentMTU int
 }
 
 func NewAssociatePacketConn(conn net.Conn, remoteAddr M.Socksaddr, underlying net.Conn) *AssociatePacketConn {
@@ -37,27 +39,25 @@ func NewAssociatePacketConn(conn net.Conn, remoteAddr M.Socksaddr, underlying ne
 }
 
 func (c *AssociatePacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	n, err = c.conn.Read(p)
+	buffer := buf.With(p)
+	destination, err := c.ReadPacket(buffer)
 	if err != nil {
 		return
 	}
-	if n < 3 {
-		return 0, nil, ErrInvalidPacket
-	}
-	reader := bytes.NewReader(p[3:n])
-	destination, err := M.SocksaddrSerializer.ReadAddrPort(reader)
-	if err != nil {
-		return
-	}
-	c.remoteAddr = destination
 	addr = destination.UDPAddr()
-	index := 3 + int(reader.Size()) - reader.Len()
-	n = copy(p, p[index:n])
+	n = copy(p, buffer.Bytes())
 	return
 }
 
 func (c *AssociatePacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	destination := M.SocksaddrFromNet(addr)
+	if c.needFragment(destination, len(p)) {
+		err = c.writeFragments(p, destination)
+		if err != nil {
+			return
+		}
+		return len(p), nil
+	}
 	buffer := buf.NewSize(3 + M.SocksaddrSerializer.AddrPortLen(destination) + len(p))
 	defer buffer.Release()
 	common.Must(buffer.WriteZeroN(3))
@@ -73,23 +73,64 @@ func (c *AssociatePacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error
 }
 
 func (c *AssociatePacketConn) ReadPacket(buffer *buf.Buffer) (destination M.Socksaddr, err error) {
-	err = c.conn.ReadBuffer(buffer)
-	if err != nil {
-		return
+	start := buffer.Start()
+	for {
+		err = c.conn.ReadBuffer(buffer)
+		if err != nil {
+			return
+		}
+		var packet *buf.Buffer
+		destination, packet, err = c.readPacket(buffer)
+		if err != nil {
+			return
+		}
+		if packet == buffer {
+			return
+		} else if packet != nil {
+			buffer.Resize(start, 0)
+			if packet.Len() > buffer.FreeLen() {
+				packet.Release()
+				return M.Socksaddr{}, io.ErrShortBuffer
+			}
+			common.Must1(buffer.Write(packet.Bytes()))
+			packet.Release()
+			return
+		}
+		buffer.Resize(start, 0)
 	}
+}
+
+// readPacket parses the header of the datagram in buffer and feeds fragments into the reassembly queue.
+// It returns buffer itself for a standalone datagram, a new buffer for a reassembled one,
+// and nil while the fragment sequence is incomplete.
+func (c *AssociatePacketConn) readPacket(buffer *buf.Buffer) (destination M.Socksaddr, packet *buf.Buffer, err error) {
 	if buffer.Len() < 3 {
-		return M.Socksaddr{}, ErrInvalidPacket
+		return M.Socksaddr{}, nil, ErrInvalidPacket
 	}
+	fragment := buffer.Byte(2)
 	buffer.Advance(3)
 	destination, err = M.SocksaddrSerializer.ReadAddrPort(buffer)
 	if err != nil {
 		return
 	}
+	if fragment == 0 {
+		c.fragments.reset()
+		packet = buffer
+	} else {
+		packet = c.fragments.push(fragment, destination, buffer.Bytes())
+		if packet == nil {
+			return
+		}
+	}
 	c.remoteAddr = destination
-	return destination, nil
+	return
 }
 
 func (c *AssociatePacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	if c.needFragment(destination, buffer.Len()) {
+		defer buffer.Release()
+		return c.writeFragments(buffer.Bytes(), destination)
+	}
 	header := buf.With(buffer.ExtendHeader(3 + M.SocksaddrSerializer.AddrPortLen(destination)))
 	common.Must(header.WriteZeroN(3))
 	err := M.SocksaddrSerializer.WriteAddrPort(header, destination)
@@ -121,6 +162,7 @@ func (c *AssociatePacketConn) FrontHeadroom() int {
 }
 
 func (c *AssociatePacketConn) Close() error {
+	c.fragments.reset()
 	return common.Close(
 		c.conn,
 		c.underlying,
@@ -0,0 +1,55 @@
+package socks
+
+import (
+	"net"
+	"net/netip"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// associateSourceConn drops datagrams that do not come from the client of an UDP ASSOCIATE request,
+// identified by the address in the request or the IP address of the TCP connection (RFC 1928 section 7).
+type associateSourceConn struct {
+	net.PacketConn
+	requestAddr netip.Addr
+	requestPort uint16
+	peerAddr    netip.Addr
+}
+
+func newAssociateSourceConn(conn net.PacketConn, request M.Socksaddr, peer M.Socksaddr) *associateSourceConn {
+	sourceConn := &associateSourceConn{
+		PacketConn:  conn,
+		requestPort: request.Port,
+		peerAddr:    peer.Addr.Unmap(),
+	}
+	if request.IsIP() && !request.Addr.IsUnspecified() {
+		sourceConn.requestAddr = request.Addr.Unmap()
+	}
+	return sourceConn
+}
+
+func (c *associateSourceConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil || c.allowed(M.AddrPortFromNet(addr)) {
+			return
+		}
+	}
+}
+
+// allowed reports whether source matches the endpoint declared in the request.
+// A declared port of zero matches any port, and an unspecified declared address means the peer address.
+// Datagrams from the peer address are also accepted when the request declares another address,
+// which is the case for a client behind NAT, but then the declared port does not apply to them.
+func (c *associateSourceConn) allowed(source netip.AddrPort) bool {
+	sourceAddr := source.Addr().Unmap()
+	portMatched := c.requestPort == 0 || source.Port() == c.requestPort
+	switch {
+	case c.requestAddr.IsValid() && sourceAddr == c.requestAddr:
+		return portMatched
+	case sourceAddr == c.peerAddr:
+		return c.requestAddr.IsValid() || portMatched
+	default:
+		return false
+	}
+}
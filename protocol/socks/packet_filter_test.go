@@ -0,0 +1,35 @@
+package socks
+
+import (
+	"net/netip"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssociateSourceFilter(t *testing.T) {
+	t.Parallel()
+	peer := M.ParseSocksaddr("203.0.113.1:40000")
+	for _, testCase := range []struct {
+		request string
+		source  string
+		allowed bool
+	}{
+		{"0.0.0.0:0", "203.0.113.1:5000", true},
+		{"[::]:0", "203.0.113.1:5000", true},
+		{"0.0.0.0:0", "203.0.113.2:5000", false},
+		{"0.0.0.0:5000", "203.0.113.1:5000", true},
+		{"0.0.0.0:5000", "203.0.113.1:5001", false},
+		{"203.0.113.1:0", "203.0.113.1:5000", true},
+		{"203.0.113.1:5000", "203.0.113.1:5001", false},
+		{"10.0.0.1:5000", "10.0.0.1:5000", true},
+		{"10.0.0.1:5000", "10.0.0.1:5001", false},
+		{"10.0.0.1:5000", "203.0.113.1:6000", true},
+		{"10.0.0.1:5000", "203.0.113.2:5000", false},
+	} {
+		conn := newAssociateSourceConn(nil, M.ParseSocksaddr(testCase.request), peer)
+		require.Equal(t, testCase.allowed, conn.allowed(netip.MustParseAddrPort(testCase.source)), "request %s, source %s", testCase.request, testCase.source)
+	}
+}
@@ -0,0 +1,142 @@
+package socks
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+const (
+	FragmentReassemblyTimeout = 5 * time.Second
+
+	fragmentEnd         byte = 0x80
+	fragmentPositionMax byte = 0x7F
+)
+
+// fragmentQueue implements the reassembly queue described in RFC 1928 section 7.
+// The reassembly timer releases an incomplete sequence when it expires, even if no further packet arrives.
+type fragmentQueue struct {
+	access      sync.Mutex
+	timeout     time.Duration
+	timer       *time.Timer
+	destination M.Socksaddr
+	position    byte
+	expireAt    time.Time
+	buffer      *buf.Buffer
+}
+
+// push adds a fragment to the queue and returns the reassembled datagram once the final fragment arrives.
+// Fragments that do not continue the current sequence abandon it.
+func (q *fragmentQueue) push(fragment byte, destination M.Socksaddr, payload []byte) *buf.Buffer {
+	q.access.Lock()
+	defer q.access.Unlock()
+	position := fragment & fragmentPositionMax
+	now := time.Now()
+	if q.buffer != nil && (now.After(q.expireAt) || position != q.position+1 || destination != q.destination) {
+		q.resetLocked()
+	}
+	if q.buffer == nil {
+		if position != 1 {
+			return nil
+		}
+		timeout := q.timeout
+		if timeout == 0 {
+			timeout = FragmentReassemblyTimeout
+		}
+		q.buffer = buf.NewSize(math.MaxUint16)
+		q.destination = destination
+		q.expireAt = now.Add(timeout)
+		if q.timer == nil {
+			q.timer = time.AfterFunc(timeout, q.expire)
+		} else {
+			q.timer.Reset(timeout)
+		}
+	}
+	if len(payload) > q.buffer.FreeLen() {
+		q.resetLocked()
+		return nil
+	}
+	common.Must1(q.buffer.Write(payload))
+	q.position = position
+	if fragment&fragmentEnd == 0 {
+		return nil
+	}
+	packet := q.buffer
+	q.buffer = nil
+	q.resetLocked()
+	return packet
+}
+
+func (q *fragmentQueue) expire() {
+	q.access.Lock()
+	defer q.access.Unlock()
+	if q.buffer != nil && !time.Now().Before(q.expireAt) {
+		q.resetLocked()
+	}
+}
+
+func (q *fragmentQueue) reset() {
+	q.access.Lock()
+	defer q.access.Unlock()
+	q.resetLocked()
+}
+
+func (q *fragmentQueue) resetLocked() {
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+	if q.buffer != nil {
+		q.buffer.Release()
+		q.buffer = nil
+	}
+	q.position = 0
+}
+
+func (c *AssociatePacketConn) SetFragmentMTU(mtu int) {
+	c.fragmentMTU = mtu
+}
+
+func (c *AssociatePacketConn) needFragment(destination M.Socksaddr, dataLen int) bool {
+	return c.fragmentMTU > 0 && 3+M.SocksaddrSerializer.AddrPortLen(destination)+dataLen > c.fragmentMTU
+}
+
+func (c *AssociatePacketConn) writeFragments(data []byte, destination M.Socksaddr) error {
+	headerLen := 3 + M.SocksaddrSerializer.AddrPortLen(destination)
+	fragmentSize := c.fragmentMTU - headerLen
+	if fragmentSize <= 0 {
+		return E.New("socks5: fragment mtu too small: ", c.fragmentMTU)
+	}
+	fragmentCount := (len(data) + fragmentSize - 1) / fragmentSize
+	if fragmentCount > int(fragmentPositionMax) {
+		return E.New("socks5: too many fragments: ", fragmentCount)
+	}
+	buffer := buf.NewSize(c.fragmentMTU)
+	defer buffer.Release()
+	for index := 0; index < fragmentCount; index++ {
+		fragment := byte(index + 1)
+		if index == fragmentCount-1 {
+			fragment |= fragmentEnd
+		}
+		chunk := data[index*fragmentSize : min(len(data), (index+1)*fragmentSize)]
+		buffer.Reset()
+		common.Must(
+			buffer.WriteZeroN(2),
+			buffer.WriteByte(fragment),
+		)
+		err := M.SocksaddrSerializer.WriteAddrPort(buffer, destination)
+		if err != nil {
+			return err
+		}
+		common.Must1(buffer.Write(chunk))
+		_, err = c.conn.Write(buffer.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
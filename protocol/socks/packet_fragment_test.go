@@ -0,0 +1,92 @@
+package socks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testAssociatePair returns a client writing to a server, which is only used for reading.
+func testAssociatePair(t *testing.T) (*AssociatePacketConn, *AssociatePacketConn, net.Conn) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		serverConn.Close()
+	})
+	serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	clientConn, err := net.DialUDP("udp", nil, serverConn.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		clientConn.Close()
+	})
+	return NewAssociatePacketConn(clientConn, M.Socksaddr{}, nil), NewAssociatePacketConn(serverConn, M.Socksaddr{}, nil), clientConn
+}
+
+func writeFragment(t *testing.T, conn net.Conn, fragment byte, destination M.Socksaddr, payload string) {
+	buffer := buf.New()
+	defer buffer.Release()
+	buffer.Write([]byte{0, 0, fragment})
+	require.NoError(t, M.SocksaddrSerializer.WriteAddrPort(buffer, destination))
+	buffer.WriteString(payload)
+	_, err := conn.Write(buffer.Bytes())
+	require.NoError(t, err)
+}
+
+func TestAssociateFragment(t *testing.T) {
+	t.Parallel()
+	client, server, _ := testAssociatePair(t)
+	destination := M.ParseSocksaddr("1.1.1.1:53")
+	client.SetFragmentMTU(3 + M.SocksaddrSerializer.AddrPortLen(destination) + 16)
+	payload := bytes.Repeat([]byte("0123456789"), 10)
+	_, err := client.WriteTo(payload, destination.UDPAddr())
+	require.NoError(t, err)
+
+	buffer := buf.NewSize(256)
+	defer buffer.Release()
+	buffer.Resize(32, 0)
+	packetDestination, err := server.ReadPacket(buffer)
+	require.NoError(t, err)
+	require.Equal(t, destination, packetDestination)
+	require.Equal(t, payload, buffer.Bytes())
+	require.Equal(t, 32, buffer.Start())
+}
+
+func TestAssociateFragmentAbort(t *testing.T) {
+	t.Parallel()
+	_, server, clientConn := testAssociatePair(t)
+	destination := M.ParseSocksaddr("1.1.1.1:53")
+	writeFragment(t, clientConn, 1, destination, "first")
+	writeFragment(t, clientConn, 0, destination, "standalone")
+	writeFragment(t, clientConn, 2|fragmentEnd, destination, "second")
+	writeFragment(t, clientConn, 1, destination, "new ")
+	writeFragment(t, clientConn, 2|fragmentEnd, destination, "sequence")
+	buffer := make([]byte, 64)
+	for _, expected := range []string{"standalone", "new sequence"} {
+		n, _, err := server.ReadFrom(buffer)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(buffer[:n]))
+	}
+}
+
+func TestFragmentQueueTimeout(t *testing.T) {
+	t.Parallel()
+	queue := fragmentQueue{timeout: 10 * time.Millisecond}
+	destination := M.ParseSocksaddr("1.1.1.1:53")
+	require.Nil(t, queue.push(1, destination, []byte("first")))
+	require.Eventually(t, func() bool {
+		queue.access.Lock()
+		defer queue.access.Unlock()
+		return queue.buffer == nil
+	}, time.Second, 5*time.Millisecond)
+	require.Nil(t, queue.push(2|fragmentEnd, destination, []byte("second")))
+	packet := queue.push(1|fragmentEnd, destination, []byte("single"))
+	require.NotNil(t, packet)
+	require.Equal(t, "single", string(packet.Bytes()))
+	packet.Release()
+}
@@ -30,6 +30,12 @@ func NewVectorisedAssociateConn(conn net.Conn, writer N.VectorisedWriter, remote
 }
 
 func (c *VectorisedAssociatePacketConn) WriteVectorisedPacket(buffers []*buf.Buffer, destination M.Socksaddr) error {
+	if dataLen := buf.LenMulti(buffers); c.needFragment(destination, dataLen) {
+		defer buf.ReleaseMulti(buffers)
+		data := make([]byte, dataLen)
+		buf.CopyMulti(data, buffers)
+		return c.writeFragments(data, destination)
+	}
 	header := buf.NewSize(3 + M.SocksaddrSerializer.AddrPortLen(destination))
 	defer header.Release()
 	common.Must(header.WriteZeroN(3))
@@ -1,6 +1,7 @@
 package socks
 
 import (
+	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
 	M "github.com/sagernet/sing/common/metadata"
@@ -14,7 +15,7 @@ func (c *AssociatePacketConn) CreateReadWaiter() (N.PacketReadWaiter, bool) {
 	if !isReadWaiter {
 		return nil, false
 	}
-	return &AssociatePacketReadWaiter{c, readWaiter}, true
+	return &AssociatePacketReadWaiter{conn: c, readWaiter: readWaiter}, true
 }
 
 var _ N.PacketReadWaiter = (*AssociatePacketReadWaiter)(nil)
@@ -22,27 +23,35 @@ var _ N.PacketReadWaiter = (*AssociatePacketReadWaiter)(nil)
 type AssociatePacketReadWaiter struct {
 	conn       *AssociatePacketConn
 	readWaiter N.ReadWaiter
+	options    N.ReadWaitOptions
 }
 
 func (w *AssociatePacketReadWaiter) InitializeReadWaiter(options N.ReadWaitOptions) (needCopy bool) {
+	w.options = options
 	return w.readWaiter.InitializeReadWaiter(options)
 }
 
 func (w *AssociatePacketReadWaiter) WaitReadPacket() (buffer *buf.Buffer, destination M.Socksaddr, err error) {
-	buffer, err = w.readWaiter.WaitReadBuffer()
-	if err != nil {
-		return
-	}
-	if buffer.Len() < 3 {
-		buffer.Release()
-		return nil, M.Socksaddr{}, ErrInvalidPacket
-	}
-	buffer.Advance(3)
-	destination, err = M.SocksaddrSerializer.ReadAddrPort(buffer)
-	if err != nil {
+	for {
+		buffer, err = w.readWaiter.WaitReadBuffer()
+		if err != nil {
+			return
+		}
+		var packet *buf.Buffer
+		destination, packet, err = w.conn.readPacket(buffer)
+		if err != nil {
+			buffer.Release()
+			return nil, M.Socksaddr{}, err
+		}
+		if packet == buffer {
+			return
+		}
 		buffer.Release()
-		return
+		if packet != nil {
+			buffer = w.options.NewBufferSize(packet.Len())
+			common.Must1(buffer.Write(packet.Bytes()))
+			packet.Release()
+			return
+		}
 	}
-	w.conn.remoteAddr = destination
-	return
 }
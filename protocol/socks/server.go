@@ -0,0 +1,27 @@
+package socks
+
+import (
+	std_bufio "bufio"
+	"context"
+	"net"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/tls"
+)
+
+// Serve accepts connections from listener and handles each of them with HandleConnectionWithOptions
+// until the listener is closed or ctx is done, retrying temporary accept errors. onClose receives the result of every connection.
+func Serve(ctx context.Context, listener net.Listener, handler HandlerEx, onClose N.CloseHandlerFunc, options ServerOptions) error {
+	return N.AcceptLoop(ctx, listener, func(conn net.Conn) {
+		err := HandleConnectionWithOptions(ctx, conn, std_bufio.NewReader(conn), handler, M.SocksaddrFromNet(conn.RemoteAddr()), onClose, options)
+		if err != nil {
+			N.CloseOnHandshakeFailure(conn, onClose, err)
+		}
+	})
+}
+
+// ServeTLS is like Serve, but performs a TLS handshake with tlsConfig on every accepted connection.
+func ServeTLS(ctx context.Context, listener net.Listener, tlsConfig tls.ServerConfig, handler HandlerEx, onClose N.CloseHandlerFunc, options ServerOptions) error {
+	return Serve(ctx, tls.NewListener(listener, tlsConfig), handler, onClose, options)
+}
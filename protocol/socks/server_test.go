@@ -0,0 +1,131 @@
+package socks
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	std_tls "crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/tls"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testDeadlineDialer fails handshakes with servers that stopped accepting, instead of blocking.
+type testDeadlineDialer struct{}
+
+func (d testDeadlineDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	conn, err := N.SystemDialer.DialContext(ctx, network, destination)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, nil
+}
+
+func (d testDeadlineDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return nil, net.ErrClosed
+}
+
+func testServe(t *testing.T, listener net.Listener, serve func(ctx context.Context, listener net.Listener) error) chan error {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, listener)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return done
+}
+
+func TestServe(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	handler := &testUserHandler{userChan: make(chan string, 1)}
+	testServe(t, listener, func(ctx context.Context, listener net.Listener) error {
+		return Serve(ctx, listener, handler, nil, ServerOptions{})
+	})
+	client := NewClient(testDeadlineDialer{}, M.SocksaddrFromNet(listener.Addr()), Version5, "", "")
+	conn, err := client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddr("1.1.1.1:53"))
+	require.NoError(t, err)
+	conn.Close()
+	require.Equal(t, "", <-handler.userChan)
+}
+
+func TestServeError(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener.Close()
+	err = Serve(context.Background(), listener, &testUserHandler{}, nil, ServerOptions{})
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, listener, &testUserHandler{}, nil, ServerOptions{})
+	}()
+	cancel()
+	select {
+	case err = <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after cancel")
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	t.Parallel()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	parsed, err := x509.ParseCertificate(certificate)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	handler := &testUserHandler{userChan: make(chan string, 1)}
+	serverConfig := tls.NewSTDServer(&tls.STDConfig{Certificates: []std_tls.Certificate{{Certificate: [][]byte{certificate}, PrivateKey: key}}})
+	testServe(t, listener, func(ctx context.Context, listener net.Listener) error {
+		return ServeTLS(ctx, listener, serverConfig, handler, nil, ServerOptions{})
+	})
+	client := NewClient(testDeadlineDialer{}, M.SocksaddrFromNet(listener.Addr()), Version5, "", "")
+	client.SetTLSConfig(tls.NewSTDClient(&tls.STDConfig{ServerName: "example.com", RootCAs: pool}))
+	conn, err := client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddr("1.1.1.1:53"))
+	require.NoError(t, err)
+	conn.Close()
+	require.Equal(t, "", <-handler.userChan)
+
+	plainConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer plainConn.Close()
+	plainConn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = plainConn.Write([]byte{byte(Version5), 1, 0, byte(Version5), 1})
+	require.NoError(t, err)
+	response := make([]byte, 2)
+	n, _ := plainConn.Read(response)
+	require.False(t, n == 2 && Version(response[0]) == Version5, "plain socks should be rejected by a TLS server")
+}
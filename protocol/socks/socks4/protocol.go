@@ -159,13 +159,18 @@ func ReadResponse(reader varbin.Reader) (response Response, err error) {
 }
 
 func WriteResponse(writer io.Writer, response Response) error {
+	// The response always holds an IPv4 address, which is zero in failure replies.
+	addr := response.Destination.Addr.Unmap()
+	if !addr.Is4() {
+		addr = netip.IPv4Unspecified()
+	}
 	buffer := buf.NewSize(8)
 	defer buffer.Release()
 	common.Must(
 		buffer.WriteByte(0),
 		buffer.WriteByte(response.ReplyCode),
 		binary.Write(buffer, binary.BigEndian, response.Destination.Port),
-		common.Error(buffer.Write(response.Destination.Addr.AsSlice())),
+		common.Error(buffer.Write(addr.AsSlice())),
 	)
 	return common.Error(writer.Write(buffer.Bytes()))
 }
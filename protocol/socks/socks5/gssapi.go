@@ -0,0 +1,75 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/varbin"
+)
+
+const (
+	GSSAPIVersion byte = 1
+
+	GSSAPIMessageTypeAuthentication byte = 1
+	GSSAPIMessageTypeProtection     byte = 2
+	GSSAPIMessageTypeAbort          byte = 0xFF
+)
+
+// +------+------+------+.......................+
+// + ver  | mtyp | len  |       token           |
+// +------+------+------+.......................+
+// + 0x01 | 0x01 | 0x02 | up to 2^16 - 1 octets |
+// +------+------+------+.......................+
+
+type GSSAPIMessage struct {
+	Type  byte
+	Token []byte
+}
+
+func WriteGSSAPIMessage(writer io.Writer, message GSSAPIMessage) error {
+	if message.Type == GSSAPIMessageTypeAbort {
+		return common.Error(writer.Write([]byte{GSSAPIVersion, GSSAPIMessageTypeAbort}))
+	}
+	if len(message.Token) > math.MaxUint16 {
+		return E.New("gssapi token too long")
+	}
+	buffer := buf.NewSize(4 + len(message.Token))
+	defer buffer.Release()
+	common.Must(
+		buffer.WriteByte(GSSAPIVersion),
+		buffer.WriteByte(message.Type),
+		binary.Write(buffer, binary.BigEndian, uint16(len(message.Token))),
+		common.Error(buffer.Write(message.Token)),
+	)
+	return common.Error(writer.Write(buffer.Bytes()))
+}
+
+func ReadGSSAPIMessage(reader varbin.Reader) (message GSSAPIMessage, err error) {
+	version, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+	if version != GSSAPIVersion {
+		err = E.New("excepted gssapi version 1, got ", version)
+		return
+	}
+	message.Type, err = reader.ReadByte()
+	if err != nil {
+		return
+	}
+	if message.Type == GSSAPIMessageTypeAbort {
+		return
+	}
+	var tokenLen uint16
+	err = binary.Read(reader, binary.BigEndian, &tokenLen)
+	if err != nil {
+		return
+	}
+	message.Token = make([]byte, tokenLen)
+	_, err = io.ReadFull(reader, message.Token)
+	return
+}